@@ -0,0 +1,295 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// connInfo describes an open connection in the admin API
+type connInfo struct {
+	ID          uint64    `json:"id"`
+	RemoteAddr  string    `json:"remote_addr"`
+	Path        string    `json:"path"`
+	Subprotocol string    `json:"subprotocol,omitempty"`
+	Opened      time.Time `json:"opened"`
+	Uptime      duration  `json:"uptime"`
+	MessagesIn  uint64    `json:"messages_in"`
+	MessagesOut uint64    `json:"messages_out"`
+	BytesIn     uint64    `json:"bytes_in"`
+	BytesOut    uint64    `json:"bytes_out"`
+	// RTT is the round trip time of the last answered ping
+	RTT        duration `json:"rtt,omitempty"`
+	QueueDepth int      `json:"queue_depth"`
+}
+
+func newConnInfo(c *conn, now time.Time) connInfo {
+	info := connInfo{
+		ID:          c.id,
+		RemoteAddr:  c.remoteAddr().String(),
+		Subprotocol: c.subprotocol,
+		Opened:      c.opened,
+		Uptime:      duration(now.Sub(c.opened).Round(time.Millisecond)),
+		MessagesIn:  c.stats.messagesIn.Load(),
+		MessagesOut: c.stats.messagesOut.Load(),
+		BytesIn:     c.stats.bytesIn.Load(),
+		BytesOut:    c.stats.bytesOut.Load(),
+		RTT:         duration(c.stats.rtt.Load()),
+		QueueDepth:  len(c.sendq),
+	}
+	if c.req != nil {
+		info.Path = c.req.path
+	}
+	return info
+}
+
+// closeRequest is the body of a request to close a connection
+type closeRequest struct {
+	Code   int    `json:"code"`
+	Reason string `json:"reason"`
+}
+
+// sendRequest is the body of a request to send a message, it holds either
+// text or binary data, which is base64 encoded in JSON
+type sendRequest struct {
+	Text   *string `json:"text"`
+	Binary []byte  `json:"binary"`
+}
+
+func (r *sendRequest) message() (opCode, []byte, error) {
+	switch {
+	case r.Text != nil && r.Binary != nil:
+		return 0, nil, fmt.Errorf("only one of text and binary may be given")
+	case r.Text != nil:
+		if !utf8.ValidString(*r.Text) {
+			return 0, nil, fmt.Errorf("text must be valid UTF-8")
+		}
+		return text, []byte(*r.Text), nil
+	case r.Binary != nil:
+		return binary, r.Binary, nil
+	}
+	return 0, nil, fmt.Errorf("one of text or binary is required")
+}
+
+// sendResult reports how many connections a message was queued for
+type sendResult struct {
+	Sent    int `json:"sent"`
+	Dropped int `json:"dropped"`
+}
+
+// newAdminHandler serves the admin API for 's', every request must carry
+// 'token' as a bearer token
+func newAdminHandler(s *server, token string) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.Handle("GET /metrics", metrics)
+
+	mux.HandleFunc("GET /conns", func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+		conns := s.openConns()
+		infos := make([]connInfo, 0, len(conns))
+		for _, c := range conns {
+			infos = append(infos, newConnInfo(c, now))
+		}
+		writeJSON(w, http.StatusOK, infos)
+	})
+
+	mux.HandleFunc("GET /conns/{id}", func(w http.ResponseWriter, r *http.Request) {
+		c, ok := lookupConn(s, w, r)
+		if !ok {
+			return
+		}
+		writeJSON(w, http.StatusOK, newConnInfo(c, time.Now()))
+	})
+
+	mux.HandleFunc("POST /conns/{id}/close", func(w http.ResponseWriter, r *http.Request) {
+		c, ok := lookupConn(s, w, r)
+		if !ok {
+			return
+		}
+
+		req := closeRequest{Code: int(statusNormal)}
+		if !readJSON(w, r, &req) {
+			return
+		}
+		if req.Code < 0 || req.Code > 0xffff || !validCloseCode(status(req.Code)) {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid close code %d", req.Code))
+			return
+		}
+		if !utf8.ValidString(req.Reason) || len(req.Reason) > 123 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("reason must be valid UTF-8 of at most 123 bytes"))
+			return
+		}
+
+		if err := c.closeWith(r.Context(), status(req.Code), req.Reason); err != nil {
+			writeError(w, http.StatusConflict, err)
+			return
+		}
+		c.log.Info("closed by admin", "code", req.Code, "reason", req.Reason)
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("POST /conns/{id}/send", func(w http.ResponseWriter, r *http.Request) {
+		c, ok := lookupConn(s, w, r)
+		if !ok {
+			return
+		}
+		op, data, ok := readMessage(w, r)
+		if !ok {
+			return
+		}
+		if !c.enqueue(op, data) {
+			writeError(w, http.StatusServiceUnavailable, fmt.Errorf("send queue for connection %d is full", c.id))
+			return
+		}
+		writeJSON(w, http.StatusAccepted, sendResult{Sent: 1})
+	})
+
+	mux.HandleFunc("POST /broadcast", func(w http.ResponseWriter, r *http.Request) {
+		op, data, ok := readMessage(w, r)
+		if !ok {
+			return
+		}
+		var res sendResult
+		for _, c := range s.openConns() {
+			if c.enqueue(op, data) {
+				res.Sent++
+			} else {
+				res.Dropped++
+			}
+		}
+		writeJSON(w, http.StatusAccepted, res)
+	})
+
+	mux.HandleFunc("GET /ip-filter", func(w http.ResponseWriter, r *http.Request) {
+		allow, deny := s.filter.lists()
+		writeJSON(w, http.StatusOK, ipFilterConfig{Allow: prefixStrings(allow), Deny: prefixStrings(deny)})
+	})
+
+	// Changes to the filter last until the configuration is next reloaded
+	mux.HandleFunc("POST /ip-filter/{list}", func(w http.ResponseWriter, r *http.Request) {
+		deny, ok := filterList(w, r)
+		if !ok {
+			return
+		}
+		var req struct {
+			Network string `json:"network"`
+		}
+		if !readJSON(w, r, &req) {
+			return
+		}
+		p, err := parsePrefix(req.Network)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if s.filter.add(deny, p) {
+			s.log().Info("network added to ip filter by admin", "list", r.PathValue("list"), "network", p.String())
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("DELETE /ip-filter/{list}/{network...}", func(w http.ResponseWriter, r *http.Request) {
+		deny, ok := filterList(w, r)
+		if !ok {
+			return
+		}
+		p, err := parsePrefix(r.PathValue("network"))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if !s.filter.remove(deny, p) {
+			writeError(w, http.StatusNotFound, fmt.Errorf("%s is not in the %s list", p, r.PathValue("list")))
+			return
+		}
+		s.log().Info("network removed from ip filter by admin", "list", r.PathValue("list"), "network", p.String())
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	return adminAuth(token, mux)
+}
+
+// adminAuth only lets requests carrying 'token' through to 'h'
+func adminAuth(token string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scheme, got, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+		if !ok || !strings.EqualFold(scheme, "Bearer") ||
+			subtle.ConstantTimeCompare([]byte(strings.TrimSpace(got)), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			writeError(w, http.StatusUnauthorized, fmt.Errorf("missing or invalid token"))
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func lookupConn(s *server, w http.ResponseWriter, r *http.Request) (*conn, bool) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid connection id %q", r.PathValue("id")))
+		return nil, false
+	}
+	c, ok := s.lookup(id)
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no open connection with id %d", id))
+		return nil, false
+	}
+	return c, true
+}
+
+// filterList reports whether the request is for the deny list rather than
+// the allow list
+func filterList(w http.ResponseWriter, r *http.Request) (bool, bool) {
+	switch r.PathValue("list") {
+	case "allow":
+		return false, true
+	case "deny":
+		return true, true
+	}
+	writeError(w, http.StatusNotFound, fmt.Errorf("unknown list %q, expected allow or deny", r.PathValue("list")))
+	return false, false
+}
+
+func readMessage(w http.ResponseWriter, r *http.Request) (opCode, []byte, bool) {
+	var req sendRequest
+	if !readJSON(w, r, &req) {
+		return 0, nil, false
+	}
+	op, data, err := req.message()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return 0, nil, false
+	}
+	return op, data, true
+}
+
+// readJSON decodes the request body in to 'v', an empty body leaves 'v' as
+// it is. It responds with 400 and returns false on failure.
+func readJSON(w http.ResponseWriter, r *http.Request, v any) bool {
+	d := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	d.DisallowUnknownFields()
+	if err := d.Decode(v); err != nil && err != io.EOF {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
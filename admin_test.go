@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+// adminRequest sends a request to the admin API and decodes the JSON
+// response in to 'v' when it's not nil
+func adminRequest(t *testing.T, base, token, method, path, body string, v any) int {
+	t.Helper()
+
+	req, err := http.NewRequest(method, base+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if v != nil {
+		if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+			t.Fatalf("%s %s: failed to decode response: %v", method, path, err)
+		}
+	}
+	return res.StatusCode
+}
+
+func TestAdminAPI(t *testing.T) {
+	s := &server{}
+	l, err := s.listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go s.serve(context.Background(), l)
+
+	admin := httptest.NewServer(newAdminHandler(s, "secret"))
+	defer admin.Close()
+
+	if code := adminRequest(t, admin.URL, "wrong", "GET", "/conns", "", nil); code != http.StatusUnauthorized {
+		t.Errorf("expected a bad token to be refused, got %d", code)
+	}
+	if code := adminRequest(t, admin.URL, "wrong", "GET", "/metrics", "", nil); code != http.StatusUnauthorized {
+		t.Errorf("expected the metrics to need the token, got %d", code)
+	}
+	if code := adminRequest(t, admin.URL, "secret", "GET", "/metrics", "", nil); code != http.StatusOK {
+		t.Errorf("expected the metrics to be served, got %d", code)
+	}
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(c)
+	if err := writeUpgradeRequest(c, "/chat", "Sec-WebSocket-Protocol: chat"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readUpgradeResponse(r); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFrame(c, true, text, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := readFrame(r); err != nil {
+		t.Fatal(err)
+	}
+
+	var conns []connInfo
+	if code := adminRequest(t, admin.URL, "secret", "GET", "/conns", "", &conns); code != http.StatusOK {
+		t.Fatalf("expected to list connections, got %d", code)
+	}
+	if len(conns) != 1 {
+		t.Fatalf("expected 1 connection, got %d", len(conns))
+	}
+	info := conns[0]
+	if info.Path != "/chat" || info.RemoteAddr != c.LocalAddr().String() || info.MessagesIn != 1 || info.BytesIn != 5 ||
+		info.MessagesOut != 1 || info.BytesOut != 5 {
+		t.Errorf("unexpected connection info: %+v", info)
+	}
+	id := fmt.Sprint(info.ID)
+
+	if code := adminRequest(t, admin.URL, "secret", "POST", "/conns/"+id+"/send", `{"text": "from admin"}`, nil); code != http.StatusAccepted {
+		t.Errorf("expected send to be accepted, got %d", code)
+	}
+	if h, data, err := readFrame(r); err != nil || h.op != text || string(data) != "from admin" {
+		t.Errorf("expected the sent message, got %v %q %v", h, data, err)
+	}
+
+	var res sendResult
+	adminRequest(t, admin.URL, "secret", "POST", "/broadcast", `{"binary": "AQID"}`, &res)
+	if res.Sent != 1 || res.Dropped != 0 {
+		t.Errorf("expected broadcast to 1 connection, got %+v", res)
+	}
+	if h, data, err := readFrame(r); err != nil || h.op != binary || string(data) != "\x01\x02\x03" {
+		t.Errorf("expected the broadcast message, got %v %q %v", h, data, err)
+	}
+
+	if code := adminRequest(t, admin.URL, "secret", "POST", "/conns/"+id+"/close", `{"code": 1005}`, nil); code != http.StatusBadRequest {
+		t.Errorf("expected a reserved close code to be refused, got %d", code)
+	}
+	if code := adminRequest(t, admin.URL, "secret", "POST", "/conns/"+id+"/close", `{"code": 4000, "reason": "bye"}`, nil); code != http.StatusNoContent {
+		t.Errorf("expected close to succeed, got %d", code)
+	}
+	h, data, err := readFrame(r)
+	if err != nil || h.op != connclose || string(data) != "\x0f\xa0bye" {
+		t.Fatalf("expected close with 4000 and reason, got %v %q %v", h, data, err)
+	}
+
+	// Answering the close finishes the handshake
+	if err := writeFrame(c, true, connclose, data[:2]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Errorf("expected the server to close the connection, got %v", err)
+	}
+	for i := 0; ; i++ {
+		if code := adminRequest(t, admin.URL, "secret", "GET", "/conns/"+id, "", nil); code == http.StatusNotFound {
+			break
+		}
+		if i == 100 {
+			t.Fatal("expected the closed connection to be gone")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAdminIPFilter(t *testing.T) {
+	s := &server{}
+	admin := httptest.NewServer(newAdminHandler(s, "secret"))
+	defer admin.Close()
+
+	if code := adminRequest(t, admin.URL, "secret", "POST", "/ip-filter/deny", `{"network": "192.0.2.0/24"}`, nil); code != http.StatusCreated {
+		t.Errorf("expected the network to be added, got %d", code)
+	}
+	if code := adminRequest(t, admin.URL, "secret", "POST", "/ip-filter/deny", `{"network": "nope"}`, nil); code != http.StatusBadRequest {
+		t.Errorf("expected an invalid network to be refused, got %d", code)
+	}
+
+	var lists ipFilterConfig
+	adminRequest(t, admin.URL, "secret", "GET", "/ip-filter", "", &lists)
+	if len(lists.Allow) != 0 || len(lists.Deny) != 1 || lists.Deny[0] != "192.0.2.0/24" {
+		t.Errorf("unexpected lists: %+v", lists)
+	}
+
+	if code := adminRequest(t, admin.URL, "secret", "DELETE", "/ip-filter/deny/192.0.2.0/24", "", nil); code != http.StatusNoContent {
+		t.Errorf("expected the network to be removed, got %d", code)
+	}
+	if code := adminRequest(t, admin.URL, "secret", "DELETE", "/ip-filter/deny/192.0.2.0/24", "", nil); code != http.StatusNotFound {
+		t.Errorf("expected removing a missing network to fail, got %d", code)
+	}
+}
+
+func TestClosePayload(t *testing.T) {
+	if p := closePayload(statusNormal, ""); string(p) != "\x03\xe8" {
+		t.Errorf("expected just the code, got %q", p)
+	}
+
+	p := closePayload(statusGoingAway, strings.Repeat("é", 100))
+	if len(p) > 125 || !utf8.Valid(p[2:]) {
+		t.Errorf("expected a reason cut short on a rune boundary, got %d byte(s)", len(p))
+	}
+}
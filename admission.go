@@ -0,0 +1,209 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// sweepThreshold is how many rate limit buckets are kept before full ones are
+// dropped
+const sweepThreshold = 4096
+
+// sweepInterval is the least time between sweeps, so that a flood of
+// addresses isn't met with a full scan on every handshake
+const sweepInterval = time.Second
+
+type admissionLimits struct {
+	// maxConns caps the open connections, zero is unlimited
+	maxConns int
+	// maxConnsPerIP caps the open connections from a single address, zero
+	// is unlimited
+	maxConnsPerIP int
+	// handshakeRate is the handshakes per second allowed from a single
+	// address, with bursts of handshakeBurst, zero is unlimited
+	handshakeRate  float64
+	handshakeBurst int
+	// cidrHandshakeRate is the handshakes per second allowed from a whole
+	// network, sized by cidrPrefixV4 and cidrPrefixV6, zero is unlimited
+	cidrHandshakeRate  float64
+	cidrHandshakeBurst int
+	cidrPrefixV4       int
+	cidrPrefixV6       int
+}
+
+// admission decides whether a handshake may go ahead. The zero value admits
+// everyone.
+type admission struct {
+	mu          sync.Mutex
+	limits      admissionLimits
+	total       int
+	perIP       map[netip.Addr]int
+	ipBuckets   map[netip.Addr]*tokenBucket
+	cidrBuckets map[netip.Prefix]*tokenBucket
+	lastSweep   time.Time
+}
+
+// setLimits replaces the limits, connections already admitted are kept even
+// if they're now over the limit
+func (a *admission) setLimits(l admissionLimits) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	// The buckets were sized for the old rates
+	if l.handshakeRate != a.limits.handshakeRate || l.handshakeBurst != a.limits.handshakeBurst {
+		a.ipBuckets = nil
+	}
+	if l.cidrHandshakeRate != a.limits.cidrHandshakeRate || l.cidrHandshakeBurst != a.limits.cidrHandshakeBurst ||
+		l.cidrPrefixV4 != a.limits.cidrPrefixV4 || l.cidrPrefixV6 != a.limits.cidrPrefixV6 {
+		a.cidrBuckets = nil
+	}
+	a.limits = l
+}
+
+// admit reserves a connection for 'addr'. On success the returned function
+// must be called once the connection closes, otherwise the error is a
+// *rejection to send to the client.
+func (a *admission) admit(addr net.Addr, now time.Time) (func(), error) {
+	ip := addrIP(addr)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	l := a.limits
+
+	if l.maxConns > 0 && a.total >= l.maxConns {
+		return nil, retryAfter(http.StatusServiceUnavailable, "too many connections", time.Second)
+	}
+	if l.maxConnsPerIP > 0 && a.perIP[ip] >= l.maxConnsPerIP {
+		return nil, retryAfter(http.StatusTooManyRequests, "too many connections from address", time.Second)
+	}
+
+	// Check both buckets before taking from either, so a handshake refused
+	// by one doesn't use up the other
+	var ipBucket, cidrBucket *tokenBucket
+	if l.handshakeRate > 0 {
+		if a.ipBuckets == nil {
+			a.ipBuckets = make(map[netip.Addr]*tokenBucket)
+		}
+		ipBucket = a.ipBuckets[ip]
+		if ipBucket == nil {
+			ipBucket = newTokenBucket(l.handshakeRate, l.handshakeBurst, now)
+			a.ipBuckets[ip] = ipBucket
+		}
+		if ok, wait := ipBucket.check(now, 1); !ok {
+			return nil, retryAfter(http.StatusTooManyRequests, "handshake rate exceeded", wait)
+		}
+	}
+	if l.cidrHandshakeRate > 0 {
+		if a.cidrBuckets == nil {
+			a.cidrBuckets = make(map[netip.Prefix]*tokenBucket)
+		}
+		prefix := networkOf(ip, l.cidrPrefixV4, l.cidrPrefixV6)
+		cidrBucket = a.cidrBuckets[prefix]
+		if cidrBucket == nil {
+			cidrBucket = newTokenBucket(l.cidrHandshakeRate, l.cidrHandshakeBurst, now)
+			a.cidrBuckets[prefix] = cidrBucket
+		}
+		if ok, wait := cidrBucket.check(now, 1); !ok {
+			return nil, retryAfter(http.StatusTooManyRequests, "handshake rate exceeded for network", wait)
+		}
+	}
+	if ipBucket != nil {
+		ipBucket.allow(now, 1)
+	}
+	if cidrBucket != nil {
+		cidrBucket.allow(now, 1)
+	}
+
+	a.sweep(now)
+
+	if a.perIP == nil {
+		a.perIP = make(map[netip.Addr]int)
+	}
+	a.total++
+	a.perIP[ip]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { a.release(ip) })
+	}, nil
+}
+
+func (a *admission) release(ip netip.Addr) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.total--
+	if a.perIP[ip]--; a.perIP[ip] <= 0 {
+		delete(a.perIP, ip)
+	}
+}
+
+// sweep drops buckets that have refilled once there are too many of them,
+// at most once every sweepInterval. A full bucket behaves the same as a
+// missing one.
+func (a *admission) sweep(now time.Time) {
+	if len(a.ipBuckets) <= sweepThreshold && len(a.cidrBuckets) <= sweepThreshold {
+		return
+	}
+	if now.Sub(a.lastSweep) < sweepInterval {
+		return
+	}
+	a.lastSweep = now
+
+	if len(a.ipBuckets) > sweepThreshold {
+		for ip, b := range a.ipBuckets {
+			if b.full(now) {
+				delete(a.ipBuckets, ip)
+			}
+		}
+	}
+	if len(a.cidrBuckets) > sweepThreshold {
+		for p, b := range a.cidrBuckets {
+			if b.full(now) {
+				delete(a.cidrBuckets, p)
+			}
+		}
+	}
+}
+
+// retryAfter creates a rejection telling the client when to try again,
+// Retry-After is in whole seconds so 'wait' is rounded up
+func retryAfter(status int, reason string, wait time.Duration) *rejection {
+	rej := reject(status, reason)
+	rej.header.Set("Retry-After", strconv.Itoa(int(math.Max(1, math.Ceil(wait.Seconds())))))
+	return rej
+}
+
+// addrIP returns the IP address of 'addr', IPv4-mapped IPv6 addresses are
+// unmapped so both forms count as the same client
+func addrIP(addr net.Addr) netip.Addr {
+	if ap, err := netip.ParseAddrPort(addr.String()); err == nil {
+		return ap.Addr().Unmap()
+	}
+	if ip, err := netip.ParseAddr(addr.String()); err == nil {
+		return ip.Unmap()
+	}
+	return netip.Addr{}
+}
+
+// networkOf returns the network 'ip' belongs to for per-network limits
+func networkOf(ip netip.Addr, v4Bits, v6Bits int) netip.Prefix {
+	bits := v6Bits
+	if ip.Is4() {
+		bits = v4Bits
+	}
+	if bits <= 0 || bits > ip.BitLen() {
+		bits = ip.BitLen()
+	}
+	p, err := ip.Prefix(bits)
+	if err != nil {
+		return netip.PrefixFrom(ip, ip.BitLen())
+	}
+	return p
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func rejectionOf(t *testing.T, err error) *rejection {
+	t.Helper()
+	var rej *rejection
+	if !errors.As(err, &rej) {
+		t.Fatalf("expected a rejection, got %v", err)
+	}
+	return rej
+}
+
+func TestAdmissionConnectionLimits(t *testing.T) {
+	var a admission
+	a.setLimits(admissionLimits{maxConns: 3, maxConnsPerIP: 2})
+	now := time.Now()
+
+	one := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1000}
+	two := &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 1000}
+
+	release, err := a.admit(one, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The same address over IPv6 counts towards the same limit
+	if _, err := a.admit(&net.TCPAddr{IP: net.ParseIP("::ffff:192.0.2.1"), Port: 1001}, now); err != nil {
+		t.Fatal(err)
+	}
+	_, err = a.admit(one, now)
+	if rej := rejectionOf(t, err); rej.status != 429 || rej.header.Get("Retry-After") == "" {
+		t.Errorf("expected 429 with Retry-After for the per-address limit, got %d %v", rej.status, rej.header)
+	}
+
+	if _, err := a.admit(two, now); err != nil {
+		t.Fatal(err)
+	}
+	_, err = a.admit(two, now)
+	if rej := rejectionOf(t, err); rej.status != 503 {
+		t.Errorf("expected 503 for the global limit, got %d", rej.status)
+	}
+
+	release()
+	release()
+	if _, err := a.admit(two, now); err != nil {
+		t.Errorf("expected a released connection to make room: %v", err)
+	}
+}
+
+func TestAdmissionHandshakeRate(t *testing.T) {
+	var a admission
+	a.setLimits(admissionLimits{handshakeRate: 1, handshakeBurst: 1, cidrHandshakeRate: 1, cidrHandshakeBurst: 2, cidrPrefixV4: 24})
+	now := time.Now()
+
+	addr := func(ip string) net.Addr { return &net.TCPAddr{IP: net.ParseIP(ip), Port: 1000} }
+
+	if _, err := a.admit(addr("198.51.100.1"), now); err != nil {
+		t.Fatal(err)
+	}
+	_, err := a.admit(addr("198.51.100.1"), now)
+	if rej := rejectionOf(t, err); rej.status != 429 || rej.header.Get("Retry-After") != "1" {
+		t.Errorf("expected 429 retrying after 1s, got %d %v", rej.status, rej.header)
+	}
+
+	// A second address in the same /24 uses up the network's burst
+	if _, err := a.admit(addr("198.51.100.2"), now); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.admit(addr("198.51.100.3"), now); err == nil {
+		t.Errorf("expected the network's rate to be exceeded")
+	}
+	if _, err := a.admit(addr("203.0.113.1"), now); err != nil {
+		t.Errorf("expected another network to be unaffected: %v", err)
+	}
+
+	if _, err := a.admit(addr("198.51.100.1"), now.Add(2*time.Second)); err != nil {
+		t.Errorf("expected handshakes to be allowed once the buckets refill: %v", err)
+	}
+}
+
+func TestAdmissionSweep(t *testing.T) {
+	var a admission
+	a.setLimits(admissionLimits{handshakeRate: 100, handshakeBurst: 1})
+	now := time.Now()
+
+	admitMany := func(n int, at time.Time) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			addr := &net.TCPAddr{IP: net.IPv4(10, byte(i>>16), byte(i>>8), byte(i)), Port: 1000}
+			if _, err := a.admit(addr, at); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	admitMany(sweepThreshold+1, now)
+	// The buckets have refilled but a sweep has only just been done
+	admitMany(1, now.Add(sweepInterval/2))
+	if len(a.ipBuckets) != sweepThreshold+1 {
+		t.Errorf("expected no sweep within the interval, have %d bucket(s)", len(a.ipBuckets))
+	}
+	admitMany(1, now.Add(sweepInterval))
+	if len(a.ipBuckets) != 1 {
+		t.Errorf("expected the full buckets to be swept, have %d bucket(s)", len(a.ipBuckets))
+	}
+}
+
+func TestServerMaxConnections(t *testing.T) {
+	s := &server{}
+	s.admission.setLimits(admissionLimits{maxConns: 1})
+	l, err := s.listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go s.serve(context.Background(), l)
+
+	dial := func() (net.Conn, int, string) {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := writeUpgradeRequest(c, "/"); err != nil {
+			t.Fatal(err)
+		}
+		res, err := readUpgradeResponse(bufio.NewReader(c))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c, res.StatusCode, res.Header.Get("Retry-After")
+	}
+
+	first, status, _ := dial()
+	if status != 101 {
+		t.Fatalf("expected first connection to be accepted, got %d", status)
+	}
+
+	second, status, retry := dial()
+	second.Close()
+	if status != 503 || retry == "" {
+		t.Errorf("expected 503 with Retry-After, got %d %q", status, retry)
+	}
+
+	first.Close()
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// identity is who an authenticator decided the peer is
+type identity struct {
+	subject string
+	// claims holds any extra information the authenticator found, such as
+	// the claims of a JWT
+	claims map[string]any
+}
+
+// authenticateFunc inspects an upgrade request and returns the identity of the
+// peer. Returning a *rejection controls the response sent to the client, any
+// other error rejects the upgrade with 401.
+type authenticateFunc func(r *request) (*identity, error)
+
+// rejection is returned from upgrade hooks to refuse the upgrade with a
+// specific status and headers
+type rejection struct {
+	status int
+	header http.Header
+	reason string
+}
+
+func (r *rejection) Error() string {
+	return fmt.Sprintf("%d %s: %s", r.status, http.StatusText(r.status), r.reason)
+}
+
+func reject(status int, reason string) *rejection {
+	return &rejection{status: status, header: http.Header{}, reason: reason}
+}
+
+// bearerToken returns the token from an "Authorization: Bearer" header
+func bearerToken(r *request) (string, bool) {
+	h := r.header.Get("Authorization")
+	scheme, token, ok := strings.Cut(h, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+// bearerAuth accepts requests carrying one of 'tokens', which maps each token
+// to the subject of the identity it grants
+func bearerAuth(tokens map[string]string) authenticateFunc {
+	return func(r *request) (*identity, error) {
+		token, ok := bearerToken(r)
+		if !ok {
+			return nil, bearerChallenge("missing bearer token")
+		}
+
+		// Compare against every token so timing doesn't reveal a partial match
+		var subject string
+		found := false
+		for t, s := range tokens {
+			if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+				subject, found = s, true
+			}
+		}
+		if !found {
+			return nil, bearerChallenge("invalid bearer token")
+		}
+
+		return &identity{subject: subject}, nil
+	}
+}
+
+func bearerChallenge(reason string) *rejection {
+	rej := reject(http.StatusUnauthorized, reason)
+	rej.header.Set("WWW-Authenticate", `Bearer`)
+	return rej
+}
+
+// basicAuth accepts requests with HTTP Basic credentials that 'check' allows,
+// the user name becomes the identity's subject
+func basicAuth(realm string, check func(user, pass string) bool) authenticateFunc {
+	challenge := func(reason string) *rejection {
+		rej := reject(http.StatusUnauthorized, reason)
+		rej.header.Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", realm))
+		return rej
+	}
+
+	return func(r *request) (*identity, error) {
+		scheme, encoded, ok := strings.Cut(r.header.Get("Authorization"), " ")
+		if !ok || !strings.EqualFold(scheme, "Basic") {
+			return nil, challenge("missing basic credentials")
+		}
+
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, challenge("malformed basic credentials")
+		}
+
+		user, pass, ok := strings.Cut(string(decoded), ":")
+		if !ok || !check(user, pass) {
+			return nil, challenge("invalid basic credentials")
+		}
+
+		return &identity{subject: user}, nil
+	}
+}
+
+type jwtOptions struct {
+	secret []byte
+	// issuer and audience are only checked when set
+	issuer   string
+	audience string
+	// cookie is the name of a cookie to read the token from when there's no
+	// Authorization header, browsers can't set headers on a WebSocket
+	cookie string
+	// leeway allows for clock skew when checking 'exp' and 'nbf'
+	leeway time.Duration
+}
+
+// jwtAuth accepts requests carrying a JWT signed with HMAC-SHA256 using
+// 'opts.secret', the 'sub' claim becomes the identity's subject
+func jwtAuth(opts jwtOptions) authenticateFunc {
+	return func(r *request) (*identity, error) {
+		token, ok := bearerToken(r)
+		if !ok && opts.cookie != "" {
+			if c, found := r.cookie(opts.cookie); found {
+				token, ok = c.Value, true
+			}
+		}
+		if !ok {
+			return nil, bearerChallenge("missing token")
+		}
+
+		claims, err := verifyJWT(token, opts, time.Now())
+		if err != nil {
+			return nil, bearerChallenge(err.Error())
+		}
+
+		sub, _ := claims["sub"].(string)
+		return &identity{subject: sub, claims: claims}, nil
+	}
+}
+
+// verifyJWT checks the signature and time based claims of an HS256 JWT and
+// returns its claims
+func verifyJWT(token string, opts jwtOptions, now time.Time) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("malformed token header: %w", err)
+	}
+	// Only accept the algorithm we sign with, never 'none'
+	if header.Alg != "HS256" {
+		return nil, fmt.Errorf("unsupported token algorithm %q", header.Alg)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token signature")
+	}
+	mac := hmac.New(sha256.New, opts.secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return nil, fmt.Errorf("invalid token signature")
+	}
+
+	var claims map[string]any
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("malformed token claims: %w", err)
+	}
+
+	if exp, ok := claims["exp"].(float64); ok && now.After(time.Unix(int64(exp), 0).Add(opts.leeway)) {
+		return nil, fmt.Errorf("token has expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Before(time.Unix(int64(nbf), 0).Add(-opts.leeway)) {
+		return nil, fmt.Errorf("token is not valid yet")
+	}
+	if opts.issuer != "" && claims["iss"] != opts.issuer {
+		return nil, fmt.Errorf("unexpected token issuer")
+	}
+	if opts.audience != "" && !hasAudience(claims["aud"], opts.audience) {
+		return nil, fmt.Errorf("unexpected token audience")
+	}
+
+	return claims, nil
+}
+
+func decodeJWTPart(part string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// hasAudience reports whether the 'aud' claim, a string or a list of strings,
+// contains 'audience'
+func hasAudience(aud any, audience string) bool {
+	switch v := aud.(type) {
+	case string:
+		return v == audience
+	case []any:
+		for _, a := range v {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// signJWT creates an HS256 JWT holding 'claims'
+func signJWT(secret []byte, claims map[string]any) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "HS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	body, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(body)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signed))
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
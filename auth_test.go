@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// upgradeOverPipe runs upgrade with 'opts' against a client request for
+// 'path' and returns the response along with the server side result
+func upgradeOverPipe(t *testing.T, opts *upgradeOptions, path string, headers ...string) (*http.Response, *request) {
+	t.Helper()
+
+	client, srv := net.Pipe()
+	defer client.Close()
+	defer srv.Close()
+
+	done := make(chan *request, 1)
+	go func() {
+		req, _ := upgrade(context.Background(), srv, bufio.NewReader(srv), opts)
+		done <- req
+	}()
+
+	if err := writeUpgradeRequest(client, path, headers...); err != nil {
+		t.Fatalf("failed to write request: %v", err)
+	}
+	res, err := readUpgradeResponse(bufio.NewReader(client))
+	if err != nil {
+		t.Fatalf("failed to read response: %v", err)
+	}
+
+	return res, <-done
+}
+
+func TestUpgradeAuthenticate(t *testing.T) {
+	opts := &upgradeOptions{authenticate: bearerAuth(map[string]string{"s3cret": "alice"})}
+
+	res, req := upgradeOverPipe(t, opts, "/", "Authorization: Bearer s3cret")
+	if res.StatusCode != 101 {
+		t.Fatalf("expected status 101, got %d", res.StatusCode)
+	}
+	if req.identity == nil || req.identity.subject != "alice" {
+		t.Errorf("expected identity alice, got %+v", req.identity)
+	}
+
+	res, req = upgradeOverPipe(t, opts, "/", "Authorization: Bearer wrong")
+	if res.StatusCode != 401 {
+		t.Errorf("expected status 401, got %d", res.StatusCode)
+	}
+	if res.Header.Get("WWW-Authenticate") != "Bearer" {
+		t.Errorf("expected bearer challenge, got %q", res.Header.Get("WWW-Authenticate"))
+	}
+	if req != nil {
+		t.Errorf("expected rejected upgrade to return no request")
+	}
+}
+
+func TestUpgradeRejection(t *testing.T) {
+	opts := &upgradeOptions{authenticate: func(r *request) (*identity, error) {
+		if r.query.Get("room") != "lobby" {
+			rej := reject(http.StatusTooManyRequests, "try later")
+			rej.header.Set("Retry-After", "5")
+			return nil, rej
+		}
+		return &identity{subject: r.remoteAddr}, nil
+	}}
+
+	res, _ := upgradeOverPipe(t, opts, "/chat?room=other")
+	if res.StatusCode != http.StatusTooManyRequests || res.Header.Get("Retry-After") != "5" {
+		t.Errorf("expected 429 with Retry-After, got %d %v", res.StatusCode, res.Header)
+	}
+
+	res, _ = upgradeOverPipe(t, opts, "/chat?room=lobby")
+	if res.StatusCode != 101 {
+		t.Errorf("expected status 101, got %d", res.StatusCode)
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	auth := basicAuth("fws", func(user, pass string) bool { return user == "bob" && pass == "hunter2" })
+
+	creds := base64.StdEncoding.EncodeToString([]byte("bob:hunter2"))
+	id, err := auth(&request{header: http.Header{"Authorization": {"Basic " + creds}}})
+	if err != nil || id.subject != "bob" {
+		t.Errorf("expected bob to be accepted, id=%+v, err=%v", id, err)
+	}
+
+	creds = base64.StdEncoding.EncodeToString([]byte("bob:wrong"))
+	if _, err := auth(&request{header: http.Header{"Authorization": {"Basic " + creds}}}); err == nil {
+		t.Errorf("expected wrong password to be rejected")
+	}
+}
+
+func TestJWTAuth(t *testing.T) {
+	secret := []byte("secret")
+	now := time.Now()
+
+	sign := func(claims map[string]any) string {
+		token, err := signJWT(secret, claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		valid bool
+	}{
+		{"valid", sign(map[string]any{"sub": "alice", "exp": now.Add(time.Minute).Unix(), "aud": "fws"}), true},
+		{"audience list", sign(map[string]any{"sub": "alice", "aud": []string{"other", "fws"}}), true},
+		{"expired", sign(map[string]any{"sub": "alice", "exp": now.Add(-time.Minute).Unix(), "aud": "fws"}), false},
+		{"not yet valid", sign(map[string]any{"sub": "alice", "nbf": now.Add(time.Minute).Unix(), "aud": "fws"}), false},
+		{"wrong audience", sign(map[string]any{"sub": "alice", "aud": "other"}), false},
+		{"unsigned", "eyJhbGciOiJub25lIn0.eyJzdWIiOiJhbGljZSIsImF1ZCI6ImZ3cyJ9.", false},
+		{"malformed", "not-a-token", false},
+	}
+
+	auth := jwtAuth(jwtOptions{secret: secret, audience: "fws", cookie: "session"})
+
+	for _, test := range tests {
+		id, err := auth(&request{header: http.Header{"Authorization": {"Bearer " + test.token}}})
+		if test.valid && (err != nil || id.subject != "alice") {
+			t.Errorf("%s: expected token to be accepted, id=%+v, err=%v", test.name, id, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%s: expected token to be rejected", test.name)
+		}
+	}
+
+	// Browsers can only send the token as a cookie
+	token := sign(map[string]any{"sub": "alice", "aud": "fws"})
+	id, err := auth(&request{header: http.Header{}, cookies: []*http.Cookie{{Name: "session", Value: token}}})
+	if err != nil || id.subject != "alice" {
+		t.Errorf("expected token from cookie to be accepted, id=%+v, err=%v", id, err)
+	}
+}
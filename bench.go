@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+type benchOptions struct {
+	dial        dialOptions
+	connections int
+	// rampUp spreads the connections out, messages echoed during it aren't
+	// measured
+	rampUp   time.Duration
+	duration time.Duration
+	// rate is messages a second for each connection, zero sends the next
+	// message as soon as the last is echoed. Messages that can't be sent on
+	// time because an echo is late are sent as soon as it arrives, with the
+	// wait counted in their latency.
+	rate float64
+	size int
+	op   opCode
+	// timeout is how long connecting and each echo can take
+	timeout time.Duration
+}
+
+// benchConnResult is what one connection measured
+type benchConnResult struct {
+	connected bool
+	latencies []time.Duration
+	bytes     uint64
+	errors    map[string]int
+}
+
+// latencySummary is in milliseconds
+type latencySummary struct {
+	Min  float64 `json:"min"`
+	Mean float64 `json:"mean"`
+	P50  float64 `json:"p50"`
+	P90  float64 `json:"p90"`
+	P99  float64 `json:"p99"`
+	P999 float64 `json:"p99_9"`
+	Max  float64 `json:"max"`
+}
+
+type benchReport struct {
+	URL         string    `json:"url"`
+	Started     time.Time `json:"started"`
+	Connections int       `json:"connections"`
+	Connected   int       `json:"connected"`
+	Op          string    `json:"op"`
+	Size        int       `json:"message_size"`
+	Rate        float64   `json:"rate_per_connection,omitempty"`
+	// Duration is the measured time in seconds, after the ramp-up
+	Duration          float64        `json:"duration_s"`
+	Messages          int            `json:"messages"`
+	Bytes             uint64         `json:"bytes"`
+	MessagesPerSecond float64        `json:"messages_per_second"`
+	BytesPerSecond    float64        `json:"bytes_per_second"`
+	Latency           latencySummary `json:"latency_ms"`
+	Errors            map[string]int `json:"errors"`
+}
+
+// runBench opens the connections and sends each message once the last was
+// echoed, until the ramp-up and duration have passed or 'ctx' is done
+func runBench(ctx context.Context, rawURL string, opts *benchOptions) *benchReport {
+	report := &benchReport{URL: rawURL, Started: time.Now(), Connections: opts.connections, Op: opts.op.String(), Size: opts.size, Rate: opts.rate, Errors: map[string]int{}}
+	measureStart := report.Started.Add(opts.rampUp)
+
+	ctx, cancel := context.WithDeadline(ctx, measureStart.Add(opts.duration))
+	defer cancel()
+
+	results := make([]benchConnResult, opts.connections)
+	var wg sync.WaitGroup
+	for i := range results {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			delay := opts.rampUp * time.Duration(i) / time.Duration(opts.connections)
+			if sleepContext(ctx, delay) != nil {
+				return
+			}
+			results[i] = benchConn(ctx, rawURL, opts, measureStart)
+		}()
+	}
+	wg.Wait()
+
+	var latencies []time.Duration
+	for _, res := range results {
+		if res.connected {
+			report.Connected++
+		}
+		latencies = append(latencies, res.latencies...)
+		report.Bytes += res.bytes
+		for kind, n := range res.errors {
+			report.Errors[kind] += n
+		}
+	}
+
+	elapsed := time.Since(measureStart)
+	if elapsed > opts.duration {
+		elapsed = opts.duration
+	}
+	report.Duration = elapsed.Seconds()
+	report.Messages = len(latencies)
+	if elapsed > 0 {
+		report.MessagesPerSecond = float64(report.Messages) / elapsed.Seconds()
+		report.BytesPerSecond = float64(report.Bytes) / elapsed.Seconds()
+	}
+	report.Latency = summarise(latencies)
+	return report
+}
+
+// benchConn echoes messages over one connection until 'ctx' is done, only
+// measuring those sent after 'measureStart'
+func benchConn(ctx context.Context, rawURL string, opts *benchOptions, measureStart time.Time) benchConnResult {
+	res := benchConnResult{errors: map[string]int{}}
+
+	dialCtx, cancel := context.WithTimeout(ctx, opts.timeout)
+	c, _, err := dial(dialCtx, rawURL, &opts.dial)
+	cancel()
+	if err != nil {
+		if ctx.Err() == nil {
+			res.errors["connect"]++
+		}
+		return res
+	}
+	res.connected = true
+	defer closeBenchConn(c)
+
+	// With a rate, messages are due on a fixed schedule and latency is
+	// measured from when they were due. A slow echo then shows up in the
+	// latency of the messages queued behind it rather than in fewer being
+	// sent.
+	var interval time.Duration
+	if opts.rate > 0 {
+		interval = time.Duration(float64(time.Second) / opts.rate)
+	}
+	due := time.Now()
+
+	// Socket deadlines are set from 'ctx' and can go off before it's done
+	end, _ := ctx.Deadline()
+	data := payloadOf('*', opts.size)
+	for {
+		switch {
+		case interval > 0:
+			if sleepContext(ctx, time.Until(due)) != nil {
+				return res
+			}
+		case ctx.Err() != nil:
+			return res
+		default:
+			due = time.Now()
+		}
+		sent := due
+		due = due.Add(interval)
+
+		echoCtx, cancel := context.WithTimeout(ctx, opts.timeout)
+		err := c.writeMessage(echoCtx, opts.op, data)
+		var op opCode
+		var got []byte
+		if err == nil {
+			op, got, err = c.readMessage(echoCtx)
+		}
+		cancel()
+		latency := time.Since(sent)
+
+		switch {
+		case ctx.Err() != nil || !time.Now().Before(end):
+			// The run ended while waiting for the echo
+			return res
+		case errors.Is(err, context.DeadlineExceeded):
+			// A late echo would be taken for the next one's
+			res.errors["timeout"]++
+			return res
+		case err != nil:
+			res.errors["connection"]++
+			return res
+		case op != opts.op || !bytes.Equal(got, data):
+			// Whatever was echoed out of turn would be taken for the next one's
+			res.errors["mismatch"]++
+			return res
+		}
+
+		if !sent.Before(measureStart) {
+			res.latencies = append(res.latencies, latency)
+			res.bytes += uint64(len(data))
+		}
+	}
+}
+
+// closeBenchConn closes 'c', reading whatever is still to be echoed so the
+// close handshake can finish
+func closeBenchConn(c *conn) {
+	ctx, cancel := context.WithTimeout(context.Background(), closeTimeout)
+	defer cancel()
+
+	if err := c.closeWith(ctx, statusNormal, ""); err != nil {
+		return
+	}
+	for {
+		if _, _, err := c.readMessage(ctx); err != nil {
+			return
+		}
+	}
+}
+
+// summarise works out the latency percentiles, by nearest rank
+func summarise(latencies []time.Duration) latencySummary {
+	if len(latencies) == 0 {
+		return latencySummary{}
+	}
+	slices.Sort(latencies)
+
+	ms := func(d time.Duration) float64 {
+		return float64(d) / float64(time.Millisecond)
+	}
+	// 'permille' keeps the rank exact, 99.9% of 1000 is 999 not 1000
+	percentile := func(permille int) float64 {
+		rank := (permille*len(latencies) + 999) / 1000
+		return ms(latencies[max(rank-1, 0)])
+	}
+
+	var total time.Duration
+	for _, l := range latencies {
+		total += l
+	}
+	return latencySummary{
+		Min:  ms(latencies[0]),
+		Mean: ms(total / time.Duration(len(latencies))),
+		P50:  percentile(500),
+		P90:  percentile(900),
+		P99:  percentile(990),
+		P999: percentile(999),
+		Max:  ms(latencies[len(latencies)-1]),
+	}
+}
+
+func (r *benchReport) writeText(w io.Writer) error {
+	fmt.Fprintf(w, "%d of %d connection(s) to %s, %d byte %s messages", r.Connected, r.Connections, r.URL, r.Size, r.Op)
+	if r.Rate > 0 {
+		fmt.Fprintf(w, " at %g a second each", r.Rate)
+	}
+	fmt.Fprintf(w, "\n\nmessages    %d in %.1fs, %.0f/s\n", r.Messages, r.Duration, r.MessagesPerSecond)
+	fmt.Fprintf(w, "throughput  %.2f MiB/s\n", r.BytesPerSecond/(1<<20))
+	l := r.Latency
+	fmt.Fprintf(w, "latency ms  min %.3f  mean %.3f  p50 %.3f  p90 %.3f  p99 %.3f  p99.9 %.3f  max %.3f\n", l.Min, l.Mean, l.P50, l.P90, l.P99, l.P999, l.Max)
+
+	kinds := make([]string, 0, len(r.Errors))
+	for kind := range r.Errors {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	_, err := fmt.Fprint(w, "errors      ")
+	if len(kinds) == 0 {
+		_, err = fmt.Fprintln(w, "none")
+	}
+	for i, kind := range kinds {
+		sep := "  "
+		if i == len(kinds)-1 {
+			sep = "\n"
+		}
+		_, err = fmt.Fprintf(w, "%s %d%s", kind, r.Errors[kind], sep)
+	}
+	return err
+}
+
+func (r *benchReport) writeJSON(w io.Writer) error {
+	e := json.NewEncoder(w)
+	e.SetIndent("", "  ")
+	return e.Encode(r)
+}
+
+// errorCount is the total of every kind of error
+func (r *benchReport) errorCount() int {
+	n := 0
+	for _, c := range r.Errors {
+		n += c
+	}
+	return n
+}
+
+// benchCommand measures how quickly a server echoes messages, exiting with
+// 1 if there were any errors
+func benchCommand(args []string) int {
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	connections := fs.Int("connections", 10, "number of concurrent connections")
+	rampUp := fs.Duration("ramp-up", 0, "time to spread opening the connections over, messages echoed during it aren't measured")
+	duration := fs.Duration("duration", 10*time.Second, "time to measure for, after the ramp-up")
+	rate := fs.Float64("rate", 0, "messages a second for each connection (default as fast as they're echoed)")
+	size := fs.Int("size", 32, "message size in bytes")
+	opName := fs.String("op", "text", "message op code, text or binary")
+	timeout := fs.Duration("timeout", 5*time.Second, "time allowed to connect and for each echo")
+	jsonFile := fs.String("json", "", "write the report as JSON to this file")
+	insecure := fs.Bool("insecure", false, "don't verify the server's certificate for wss:// URLs")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: ws bench [flags] ws://host:port/path\n\nthe server is expected to echo each message")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	opts := &benchOptions{connections: *connections, rampUp: *rampUp, duration: *duration, rate: *rate, size: *size, timeout: *timeout}
+	switch *opName {
+	case "text":
+		opts.op = text
+	case "binary":
+		opts.op = binary
+	default:
+		fmt.Fprintf(os.Stderr, "unknown op %q, expected text or binary\n", *opName)
+		return 2
+	}
+	if opts.connections < 1 || opts.size < 0 || opts.rate < 0 || opts.duration <= 0 {
+		fmt.Fprintln(os.Stderr, "-connections and -duration must be positive, -size and -rate can't be negative")
+		return 2
+	}
+	if *insecure {
+		opts.dial.tlsConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	// Echoes of the largest messages have to be accepted
+	opts.dial.maxMessageSize = max(opts.size, payloadSize)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	report := runBench(ctx, fs.Arg(0), opts)
+	report.writeText(os.Stdout)
+
+	if *jsonFile != "" {
+		if err := writeReportFile(*jsonFile, report.writeJSON); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+	if report.errorCount() > 0 || report.Messages == 0 {
+		return 1
+	}
+	return 0
+}
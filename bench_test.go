@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBench(t *testing.T) {
+	l := startServer(t, &server{})
+
+	opts := &benchOptions{connections: 4, rampUp: 100 * time.Millisecond, duration: 300 * time.Millisecond, size: 1000, op: binary, timeout: 5 * time.Second}
+	report := runBench(context.Background(), "ws://"+l.Addr().String()+"/", opts)
+
+	if report.Connected != 4 || report.errorCount() != 0 {
+		t.Errorf("expected 4 connections without errors, got %d and %v", report.Connected, report.Errors)
+	}
+	if report.Messages == 0 || report.Bytes != uint64(report.Messages)*1000 || report.MessagesPerSecond <= 0 {
+		t.Errorf("expected messages to be echoed, got %d messages of %d bytes at %g/s", report.Messages, report.Bytes, report.MessagesPerSecond)
+	}
+	if l := report.Latency; l.Min <= 0 || l.Min > l.P50 || l.P50 > l.P99 || l.P99 > l.Max {
+		t.Errorf("expected ordered latencies, got %+v", l)
+	}
+
+	var b bytes.Buffer
+	if err := report.writeText(&b); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(b.String(), "errors      none\n") {
+		t.Errorf("expected no errors to be reported, got:\n%s", b.String())
+	}
+	b.Reset()
+	if err := report.writeJSON(&b); err != nil {
+		t.Fatal(err)
+	}
+	var decoded benchReport
+	if err := json.Unmarshal(b.Bytes(), &decoded); err != nil || decoded.Messages != report.Messages || decoded.Op != "binary" {
+		t.Errorf("expected the JSON report to round trip, got %+v %v", decoded, err)
+	}
+}
+
+func TestBenchRate(t *testing.T) {
+	l := startServer(t, &server{})
+
+	opts := &benchOptions{connections: 2, duration: 500 * time.Millisecond, rate: 20, op: text, timeout: 5 * time.Second}
+	report := runBench(context.Background(), "ws://"+l.Addr().String()+"/", opts)
+
+	// 2 connections at 20 a second for half a second send about 20
+	if report.Messages < 10 || report.Messages > 22 {
+		t.Errorf("expected about 20 messages, got %d", report.Messages)
+	}
+}
+
+func TestBenchRateSlowEcho(t *testing.T) {
+	slow := func(c *conn, op opCode, data []byte) error {
+		time.Sleep(100 * time.Millisecond)
+		return c.writeMessage(c.context(), op, data)
+	}
+	l := startServer(t, &server{handler: slow})
+
+	// Messages are due every 20ms but each echo takes 100ms, so the ones
+	// queued behind it wait longer and longer
+	opts := &benchOptions{connections: 1, duration: 600 * time.Millisecond, rate: 50, op: text, timeout: 5 * time.Second}
+	report := runBench(context.Background(), "ws://"+l.Addr().String()+"/", opts)
+
+	if report.Messages == 0 || report.Latency.Max < 300 {
+		t.Errorf("expected the time spent waiting to send to be counted, got %d messages with %+v", report.Messages, report.Latency)
+	}
+}
+
+func TestBenchMismatch(t *testing.T) {
+	wrong := func(c *conn, op opCode, data []byte) error {
+		return c.writeMessage(c.context(), op, []byte("wrong"))
+	}
+	l := startServer(t, &server{handler: wrong})
+
+	opts := &benchOptions{connections: 2, duration: 300 * time.Millisecond, op: text, timeout: 5 * time.Second}
+	report := runBench(context.Background(), "ws://"+l.Addr().String()+"/", opts)
+
+	if report.Errors["mismatch"] != 2 || report.Messages != 0 {
+		t.Errorf("expected each connection to stop at its first mismatch, got %v and %d messages", report.Errors, report.Messages)
+	}
+}
+
+func TestBenchConnectErrors(t *testing.T) {
+	l := startServer(t, &server{})
+	addr := l.Addr().String()
+	l.Close()
+
+	opts := &benchOptions{connections: 3, duration: 100 * time.Millisecond, op: text, timeout: time.Second}
+	report := runBench(context.Background(), "ws://"+addr+"/", opts)
+	if report.Connected != 0 || report.Errors["connect"] != 3 {
+		t.Errorf("expected 3 failed connections, got %d connected and %v", report.Connected, report.Errors)
+	}
+}
+
+func TestSummarise(t *testing.T) {
+	latencies := make([]time.Duration, 1000)
+	for i := range latencies {
+		// Out of order, to be sorted
+		latencies[i] = time.Duration(1000-i) * time.Millisecond
+	}
+	got := summarise(latencies)
+	want := latencySummary{Min: 1, Mean: 500.5, P50: 500, P90: 900, P99: 990, P999: 999, Max: 1000}
+	if got != want {
+		t.Errorf("expected %+v, got %+v", want, got)
+	}
+	if got := summarise(nil); got != (latencySummary{}) {
+		t.Errorf("expected nothing to summarise to zero, got %+v", got)
+	}
+}
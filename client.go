@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+type dialOptions struct {
+	// tlsConfig is used for wss:// URLs, nil uses the defaults
+	tlsConfig *tls.Config
+	// header holds extra headers to send with the upgrade request
+	header http.Header
+	// subprotocols are offered to the server in order of preference
+	subprotocols []string
+	// maxMessageSize limits received messages, zero uses payloadSize
+	maxMessageSize int
+	// onPong is called from the reading goroutine with each pong's payload
+	onPong func(data []byte)
+}
+
+// dial opens a WebSocket connection to 'rawURL', a ws:// or wss:// URL.
+// 'ctx' bounds connecting and the upgrade, once connected the connection
+// lives until it's closed. The server's response is returned even when it
+// refuses the upgrade.
+func dial(ctx context.Context, rawURL string, opts *dialOptions) (*conn, *http.Response, error) {
+	if opts == nil {
+		opts = &dialOptions{}
+	}
+
+	c, r, res, err := dialRaw(ctx, rawURL, opts)
+	if err != nil {
+		return nil, res, err
+	}
+
+	// The connection outlives the context it was dialled with
+	conn := newConn(context.Background(), c, r)
+	conn.client = true
+	conn.subprotocol = res.Header.Get("Sec-WebSocket-Protocol")
+	conn.handler = deliver
+	conn.incoming = make(chan queuedMessage)
+	conn.onPong = opts.onPong
+	if opts.maxMessageSize > 0 {
+		conn.p = newPayloadSize(opts.maxMessageSize)
+	}
+
+	go func() {
+		defer c.Close()
+		var ce *CloseError
+		if err := conn.handle(); !errors.As(err, &ce) {
+			conn.log.Info("connection failed", "err", err)
+		}
+	}()
+
+	return conn, res, nil
+}
+
+// dialRaw connects to 'rawURL' and upgrades the connection, leaving the
+// framing to the caller. 'r' reads from the connection and may hold frames
+// that arrived with the response.
+func dialRaw(ctx context.Context, rawURL string, opts *dialOptions) (net.Conn, *bufio.Reader, *http.Response, error) {
+	if opts == nil {
+		opts = &dialOptions{}
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	host := u.Host
+	switch u.Scheme {
+	case "ws":
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "80")
+		}
+	case "wss":
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "443")
+		}
+	default:
+		return nil, nil, nil, fmt.Errorf("unsupported scheme %q, expected ws or wss", u.Scheme)
+	}
+
+	var d net.Dialer
+	c, err := d.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if u.Scheme == "wss" {
+		cfg := &tls.Config{}
+		if opts.tlsConfig != nil {
+			cfg = opts.tlsConfig.Clone()
+		}
+		if cfg.ServerName == "" {
+			cfg.ServerName = u.Hostname()
+		}
+		tc := tls.Client(c, cfg)
+		if err := tc.HandshakeContext(ctx); err != nil {
+			c.Close()
+			return nil, nil, nil, err
+		}
+		c = tc
+	}
+
+	r, res, err := clientHandshake(ctx, c, u, opts)
+	if err != nil {
+		c.Close()
+		return nil, nil, res, err
+	}
+	return c, r, res, nil
+}
+
+// clientHandshake asks the server to upgrade 'c'
+func clientHandshake(ctx context.Context, c net.Conn, u *url.URL, opts *dialOptions) (*bufio.Reader, *http.Response, error) {
+	stop := context.AfterFunc(ctx, func() {
+		c.SetDeadline(aLongTimeAgo)
+	})
+	defer stop()
+
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	key := base64.StdEncoding.EncodeToString(nonce)
+
+	header := http.Header{}
+	for k, vs := range opts.header {
+		header[k] = vs
+	}
+	header.Set("Upgrade", "websocket")
+	header.Set("Connection", "Upgrade")
+	header.Set("Sec-WebSocket-Key", key)
+	header.Set("Sec-WebSocket-Version", "13")
+	if len(opts.subprotocols) > 0 {
+		header.Set("Sec-WebSocket-Protocol", strings.Join(opts.subprotocols, ", "))
+	}
+
+	req := &http.Request{
+		Method:     "GET",
+		URL:        &url.URL{Path: u.Path, RawPath: u.RawPath, RawQuery: u.RawQuery},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     header,
+		Host:       u.Host,
+	}
+	if req.URL.Path == "" {
+		req.URL.Path = "/"
+	}
+	if err := req.Write(c); err != nil {
+		return nil, nil, contextErr(ctx, err)
+	}
+
+	r := bufio.NewReader(c)
+	res, err := http.ReadResponse(r, req)
+	if err != nil {
+		return nil, nil, contextErr(ctx, err)
+	}
+
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		return nil, res, &ErrHandshake{Status: res.StatusCode}
+	}
+	want, _ := generateAcceptKey(key)
+	if !headerHasToken(res.Header, "Upgrade", "websocket") || !headerHasToken(res.Header, "Connection", "upgrade") ||
+		res.Header.Get("Sec-WebSocket-Accept") != want {
+		return nil, res, handshakeError(res.StatusCode, "invalid upgrade response from server")
+	}
+
+	subprotocol := res.Header.Get("Sec-WebSocket-Protocol")
+	if subprotocol != "" && !containsToken(opts.subprotocols, subprotocol) {
+		return nil, res, handshakeError(res.StatusCode, "server chose subprotocol %q which wasn't offered", subprotocol)
+	}
+
+	if !stop() {
+		return nil, res, ctx.Err()
+	}
+	c.SetDeadline(time.Time{})
+
+	return r, res, nil
+}
+
+func containsToken(tokens []string, token string) bool {
+	for _, t := range tokens {
+		if strings.EqualFold(t, token) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// startServer serves 's' on a loopback listener until the test ends
+func startServer(t *testing.T, s *server) net.Listener {
+	t.Helper()
+	l, err := s.listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go s.serve(context.Background(), l)
+	return l
+}
+
+func TestDial(t *testing.T) {
+	s := &server{}
+	s.upgrade.subprotocols = []string{"chat"}
+	l := startServer(t, s)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	c, res, err := dial(ctx, "ws://"+l.Addr().String()+"/echo?room=1", &dialOptions{subprotocols: []string{"other", "chat"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != 101 || c.subprotocol != "chat" {
+		t.Errorf("expected an upgrade to chat, got %d %q", res.StatusCode, c.subprotocol)
+	}
+
+	// Big enough to be split in to several masked frames
+	big := make([]byte, 10000)
+	for i := range big {
+		big[i] = byte(i)
+	}
+	for _, msg := range [][]byte{[]byte("hello"), big, nil} {
+		if err := c.writeMessage(ctx, binary, msg); err != nil {
+			t.Fatal(err)
+		}
+		op, data, err := c.readMessage(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if op != binary || !isEqual(data, msg) {
+			t.Errorf("expected echo of %d byte(s), got %s of %d byte(s)", len(msg), op, len(data))
+		}
+	}
+
+	if err := c.closeWith(ctx, statusNormal, "done"); err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = c.readMessage(ctx)
+	var ce *CloseError
+	if !errors.As(err, &ce) || ce.Code != statusNormal || !ce.Clean {
+		t.Errorf("expected a clean close with %d, got %v", statusNormal, err)
+	}
+	if c.context().Err() == nil {
+		t.Errorf("expected the connection's context to be cancelled once closed")
+	}
+}
+
+func TestDialRefused(t *testing.T) {
+	s := &server{}
+	s.upgrade.router = &router{}
+	l := startServer(t, s)
+
+	_, res, err := dial(context.Background(), "ws://"+l.Addr().String()+"/missing", nil)
+	if err == nil || res == nil || res.StatusCode != 404 {
+		t.Errorf("expected the upgrade to be refused with 404, got %v %v", res, err)
+	}
+}
+
+func TestDialContext(t *testing.T) {
+	// A server that never responds
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, _, err := dial(ctx, "ws://"+l.Addr().String(), nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the deadline to be exceeded, got %v", err)
+	}
+}
+
+func TestServeContext(t *testing.T) {
+	s := &server{}
+	l, err := s.listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- s.serve(ctx, l) }()
+
+	c, _, err := dial(context.Background(), "ws://"+l.Addr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+	if err := <-served; !errors.Is(err, context.Canceled) {
+		t.Errorf("expected serve to return the context's error, got %v", err)
+	}
+
+	// The connection is closed as going away
+	select {
+	case <-c.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the connection to be closed")
+	}
+	if err := s.waitClosed(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.writeMessage(context.Background(), text, []byte("late")); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("expected writing to a closed connection to fail, got %v", err)
+	}
+}
+
+func TestWriteMessageContext(t *testing.T) {
+	client, srv := net.Pipe()
+	defer client.Close()
+	c := newConn(context.Background(), srv, nil)
+
+	// Nobody reads from the pipe so the write blocks until it's cancelled
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := c.writeMessage(ctx, text, []byte("hello")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the deadline to be exceeded, got %v", err)
+	}
+}
@@ -0,0 +1,675 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// duration is a time.Duration written as a string such as "30s" in config files
+type duration time.Duration
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"30s\"")
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+type tlsConfig struct {
+	Cert              string   `json:"cert"`
+	Key               string   `json:"key"`
+	ClientCA          string   `json:"client_ca"`
+	RequireClientCert bool     `json:"require_client_cert"`
+	MinVersion        string   `json:"min_version"`
+	CipherSuites      []string `json:"cipher_suites"`
+}
+
+type limitsConfig struct {
+	MaxMessageSize int `json:"max_message_size"`
+	// MaxConnections and MaxConnectionsPerIP cap open connections, zero is
+	// unlimited
+	MaxConnections      int `json:"max_connections"`
+	MaxConnectionsPerIP int `json:"max_connections_per_ip"`
+	// HandshakeRate is per second from a single address, CIDRHandshakeRate
+	// from a network of CIDRPrefixV4 or CIDRPrefixV6 bits, zero is unlimited
+	HandshakeRate      float64 `json:"handshake_rate"`
+	HandshakeBurst     int     `json:"handshake_burst"`
+	CIDRHandshakeRate  float64 `json:"cidr_handshake_rate"`
+	CIDRHandshakeBurst int     `json:"cidr_handshake_burst"`
+	CIDRPrefixV4       int     `json:"cidr_prefix_v4"`
+	CIDRPrefixV6       int     `json:"cidr_prefix_v6"`
+	// MessageRate and ByteRate limit what each connection may send per
+	// second, RatePolicy is what happens over the limit: delay, drop or
+	// close. EgressByteRate limits what's sent to each connection. Zero is
+	// unlimited.
+	MessageRate     float64 `json:"message_rate"`
+	MessageBurst    int     `json:"message_burst"`
+	ByteRate        float64 `json:"byte_rate"`
+	ByteBurst       int     `json:"byte_burst"`
+	RatePolicy      string  `json:"rate_policy"`
+	EgressByteRate  float64 `json:"egress_byte_rate"`
+	EgressByteBurst int     `json:"egress_byte_burst"`
+}
+
+func (l *limitsConfig) admissionLimits() admissionLimits {
+	return admissionLimits{
+		maxConns:           l.MaxConnections,
+		maxConnsPerIP:      l.MaxConnectionsPerIP,
+		handshakeRate:      l.HandshakeRate,
+		handshakeBurst:     l.HandshakeBurst,
+		cidrHandshakeRate:  l.CIDRHandshakeRate,
+		cidrHandshakeBurst: l.CIDRHandshakeBurst,
+		cidrPrefixV4:       l.CIDRPrefixV4,
+		cidrPrefixV6:       l.CIDRPrefixV6,
+	}
+}
+
+// connLimits returns the per connection rate limits, RatePolicy must be valid
+func (l *limitsConfig) connLimits() connLimits {
+	policy, _ := parseLimitPolicy(l.RatePolicy)
+	return connLimits{
+		messageRate:     l.MessageRate,
+		messageBurst:    l.MessageBurst,
+		byteRate:        l.ByteRate,
+		byteBurst:       l.ByteBurst,
+		policy:          policy,
+		egressByteRate:  l.EgressByteRate,
+		egressByteBurst: l.EgressByteBurst,
+	}
+}
+
+// ipFilterConfig holds addresses or CIDR networks, e.g. "10.0.0.0/8". Deny
+// wins over Allow, and when Allow is set only those networks may connect.
+type ipFilterConfig struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+// prefixes parses the lists, they must be valid
+func (f *ipFilterConfig) prefixes() (allow, deny []netip.Prefix) {
+	allow, _ = parsePrefixes(f.Allow)
+	deny, _ = parsePrefixes(f.Deny)
+	return allow, deny
+}
+
+type proxyConfig struct {
+	// Protocol expects a PROXY protocol v1 or v2 header on every connection
+	Protocol bool `json:"protocol"`
+	// Trusted are the networks of proxies whose Forwarded and
+	// X-Forwarded-For headers are believed
+	Trusted []string `json:"trusted"`
+}
+
+type adminConfig struct {
+	// Listen is the address of the admin API, empty disables it
+	Listen string `json:"listen"`
+	// Token must be sent as a bearer token with every admin request
+	Token string `json:"token"`
+	// PublicMetrics also serves /metrics on the socket listeners, where
+	// anyone can read it without the token
+	PublicMetrics bool `json:"public_metrics"`
+}
+
+type timeoutsConfig struct {
+	// Handshake bounds reading the upgrade request
+	Handshake duration `json:"handshake"`
+	// Read closes a connection that sends nothing for this long, pongs count
+	Read duration `json:"read"`
+	// Write bounds sending a single message
+	Write duration `json:"write"`
+}
+
+type keepaliveConfig struct {
+	Interval duration `json:"interval"`
+}
+
+type logConfig struct {
+	Level    string `json:"level"`
+	Format   string `json:"format"`
+	Payloads bool   `json:"payloads"`
+}
+
+// config is the server binary's configuration, read from a file and flags
+type config struct {
+	Listen         []string        `json:"listen"`
+	TLS            tlsConfig       `json:"tls"`
+	Limits         limitsConfig    `json:"limits"`
+	IPFilter       ipFilterConfig  `json:"ip_filter"`
+	Proxy          proxyConfig     `json:"proxy"`
+	Admin          adminConfig     `json:"admin"`
+	Timeouts       timeoutsConfig  `json:"timeouts"`
+	Keepalive      keepaliveConfig `json:"keepalive"`
+	AllowedOrigins []string        `json:"allowed_origins"`
+	Subprotocols   []string        `json:"subprotocols"`
+	Log            logConfig       `json:"log"`
+	// Handler is what connections are served with, "echo" or "discard"
+	Handler string `json:"handler"`
+}
+
+func defaultConfig() *config {
+	return &config{
+		Listen:    []string{sockAddr},
+		Limits:    limitsConfig{MaxMessageSize: payloadSize, CIDRPrefixV4: 24, CIDRPrefixV6: 64, RatePolicy: "delay"},
+		Timeouts:  timeoutsConfig{Handshake: duration(10 * time.Second)},
+		Keepalive: keepaliveConfig{Interval: duration(30 * time.Second)},
+		Log:       logConfig{Level: "info", Format: "text"},
+		Handler:   "echo",
+	}
+}
+
+// handlers are the handler modes that can be selected in the config
+var handlers = map[string]handler{
+	"echo":    echoHandler,
+	"discard": discardHandler,
+}
+
+// loadConfigFile reads a JSON or TOML file on top of 'cfg', the format is
+// picked by the file extension
+func loadConfigFile(cfg *config, name string) error {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return err
+	}
+
+	if strings.EqualFold(filepath.Ext(name), ".toml") {
+		values, err := parseTOML(string(b))
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		// Round trip through JSON so both formats share the struct tags
+		if b, err = json.Marshal(values); err != nil {
+			return err
+		}
+	}
+
+	d := json.NewDecoder(strings.NewReader(string(b)))
+	d.DisallowUnknownFields()
+	if err := d.Decode(cfg); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
+
+// validate checks the config for errors, reporting all of them at once
+func (cfg *config) validate() error {
+	var errs []error
+
+	if len(cfg.Listen) == 0 {
+		errs = append(errs, fmt.Errorf("at least one listen address is required"))
+	}
+	if (cfg.TLS.Cert == "") != (cfg.TLS.Key == "") {
+		errs = append(errs, fmt.Errorf("tls: cert and key must be set together"))
+	}
+	if cfg.TLS.Cert == "" && (cfg.TLS.ClientCA != "" || cfg.TLS.RequireClientCert) {
+		errs = append(errs, fmt.Errorf("tls: client certificates require a cert and key"))
+	}
+	if cfg.TLS.RequireClientCert && cfg.TLS.ClientCA == "" {
+		errs = append(errs, fmt.Errorf("tls: require_client_cert needs client_ca"))
+	}
+	if cfg.TLS.MinVersion != "" {
+		if _, err := parseTLSVersion(cfg.TLS.MinVersion); err != nil {
+			errs = append(errs, fmt.Errorf("tls: %w", err))
+		}
+	}
+	if _, err := parseCipherSuites(cfg.TLS.CipherSuites); err != nil {
+		errs = append(errs, fmt.Errorf("tls: %w", err))
+	}
+	if cfg.Limits.MaxMessageSize <= 0 {
+		errs = append(errs, fmt.Errorf("limits: max_message_size must be positive"))
+	}
+	if cfg.Limits.MaxConnections < 0 || cfg.Limits.MaxConnectionsPerIP < 0 {
+		errs = append(errs, fmt.Errorf("limits: connection limits must not be negative"))
+	}
+	if cfg.Limits.HandshakeRate < 0 || cfg.Limits.HandshakeBurst < 0 ||
+		cfg.Limits.CIDRHandshakeRate < 0 || cfg.Limits.CIDRHandshakeBurst < 0 {
+		errs = append(errs, fmt.Errorf("limits: handshake rates must not be negative"))
+	}
+	if cfg.Limits.CIDRPrefixV4 < 0 || cfg.Limits.CIDRPrefixV4 > 32 {
+		errs = append(errs, fmt.Errorf("limits: cidr_prefix_v4 must be between 0 and 32"))
+	}
+	if cfg.Limits.CIDRPrefixV6 < 0 || cfg.Limits.CIDRPrefixV6 > 128 {
+		errs = append(errs, fmt.Errorf("limits: cidr_prefix_v6 must be between 0 and 128"))
+	}
+	if cfg.Limits.MessageRate < 0 || cfg.Limits.MessageBurst < 0 || cfg.Limits.ByteRate < 0 || cfg.Limits.ByteBurst < 0 ||
+		cfg.Limits.EgressByteRate < 0 || cfg.Limits.EgressByteBurst < 0 {
+		errs = append(errs, fmt.Errorf("limits: connection rates must not be negative"))
+	}
+	if _, err := parseLimitPolicy(cfg.Limits.RatePolicy); err != nil {
+		errs = append(errs, fmt.Errorf("limits: %w", err))
+	}
+	if _, err := parsePrefixes(cfg.IPFilter.Allow); err != nil {
+		errs = append(errs, fmt.Errorf("ip_filter.allow: %w", err))
+	}
+	if _, err := parsePrefixes(cfg.IPFilter.Deny); err != nil {
+		errs = append(errs, fmt.Errorf("ip_filter.deny: %w", err))
+	}
+	if _, err := parsePrefixes(cfg.Proxy.Trusted); err != nil {
+		errs = append(errs, fmt.Errorf("proxy.trusted: %w", err))
+	}
+	if cfg.Admin.Listen != "" && cfg.Admin.Token == "" {
+		errs = append(errs, fmt.Errorf("admin: a token is required to enable the admin API"))
+	}
+	for name, d := range map[string]duration{
+		"timeouts.handshake": cfg.Timeouts.Handshake,
+		"timeouts.read":      cfg.Timeouts.Read,
+		"timeouts.write":     cfg.Timeouts.Write,
+		"keepalive.interval": cfg.Keepalive.Interval,
+	} {
+		if d < 0 {
+			errs = append(errs, fmt.Errorf("%s must not be negative", name))
+		}
+	}
+	if cfg.Timeouts.Read > 0 && cfg.Keepalive.Interval > 0 && cfg.Timeouts.Read <= cfg.Keepalive.Interval {
+		errs = append(errs, fmt.Errorf("timeouts.read must be longer than keepalive.interval or idle connections will be closed"))
+	}
+	for _, o := range cfg.AllowedOrigins {
+		host := o
+		if _, h, ok := strings.Cut(o, "://"); ok {
+			host = h
+		}
+		if host == "" || strings.ContainsAny(host, " /?#") {
+			errs = append(errs, fmt.Errorf("allowed_origins: invalid origin %q", o))
+		}
+	}
+	if _, err := parseLogLevel(cfg.Log.Level); err != nil {
+		errs = append(errs, fmt.Errorf("log: %w", err))
+	}
+	if _, err := newLogger(io.Discard, cfg.Log.Format, nil); err != nil {
+		errs = append(errs, fmt.Errorf("log: %w", err))
+	}
+	if _, ok := handlers[cfg.Handler]; !ok {
+		errs = append(errs, fmt.Errorf("unknown handler %q", cfg.Handler))
+	}
+
+	return errors.Join(errs...)
+}
+
+// redactedToken replaces the admin token when the config is printed
+const redactedToken = "<redacted>"
+
+// print writes the config as JSON for -print-config, with the admin token
+// redacted so it doesn't end up in logs
+func (cfg *config) print(w io.Writer) error {
+	printed := *cfg
+	if printed.Admin.Token != "" {
+		printed.Admin.Token = redactedToken
+	}
+	e := json.NewEncoder(w)
+	e.SetIndent("", "  ")
+	e.SetEscapeHTML(false)
+	return e.Encode(printed)
+}
+
+// newLogger creates the logger described by the config, its level can be
+// changed through the returned LevelVar
+func (cfg *config) newLogger(w io.Writer) (*slog.Logger, *slog.LevelVar, error) {
+	level, err := parseLogLevel(cfg.Log.Level)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var v slog.LevelVar
+	v.Set(level)
+
+	logger, err := newLogger(w, cfg.Log.Format, &v)
+	if err != nil {
+		return nil, nil, err
+	}
+	return logger, &v, nil
+}
+
+// newServer creates a server from a validated config
+func (cfg *config) newServer(logger *slog.Logger) (*server, error) {
+	s := &server{
+		http:             newHTTPHandler(cfg.Admin.PublicMetrics),
+		handler:          handlers[cfg.Handler],
+		maxMessageSize:   cfg.Limits.MaxMessageSize,
+		handshakeTimeout: time.Duration(cfg.Timeouts.Handshake),
+		readTimeout:      time.Duration(cfg.Timeouts.Read),
+		writeTimeout:     time.Duration(cfg.Timeouts.Write),
+		pingInterval:     time.Duration(cfg.Keepalive.Interval),
+		logger:           logger,
+		logPayloads:      cfg.Log.Payloads,
+		proxyProtocol:    cfg.Proxy.Protocol,
+	}
+	s.trustedProxies, _ = parsePrefixes(cfg.Proxy.Trusted)
+	s.upgrade.origin.allowed = cfg.AllowedOrigins
+	s.upgrade.subprotocols = cfg.Subprotocols
+	s.connLimits = cfg.Limits.connLimits()
+	s.admission.setLimits(cfg.Limits.admissionLimits())
+	s.filter.setLists(cfg.IPFilter.prefixes())
+
+	if cfg.TLS.Cert != "" {
+		s.tls = &tlsOptions{
+			certFile:          cfg.TLS.Cert,
+			keyFile:           cfg.TLS.Key,
+			clientCAFile:      cfg.TLS.ClientCA,
+			requireClientCert: cfg.TLS.RequireClientCert,
+		}
+		if cfg.TLS.MinVersion != "" {
+			v, err := parseTLSVersion(cfg.TLS.MinVersion)
+			if err != nil {
+				return nil, err
+			}
+			s.tls.minVersion = v
+		}
+		if len(cfg.TLS.CipherSuites) > 0 {
+			ids, err := parseCipherSuites(cfg.TLS.CipherSuites)
+			if err != nil {
+				return nil, err
+			}
+			s.tls.cipherSuites = ids
+		}
+	}
+
+	return s, nil
+}
+
+// stringList is a flag holding a comma separated list
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(v string) error {
+	*l = nil
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			*l = append(*l, s)
+		}
+	}
+	return nil
+}
+
+// durationFlag is a flag.Value for our duration
+type durationFlag struct {
+	d *duration
+}
+
+func (f durationFlag) String() string {
+	if f.d == nil {
+		return ""
+	}
+	return time.Duration(*f.d).String()
+}
+
+func (f durationFlag) Set(v string) error {
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return err
+	}
+	*f.d = duration(d)
+	return nil
+}
+
+// parseFlags builds the config from the defaults, the config file named by
+// -config and then any flags given, in that order of precedence. It returns
+// whether -print-config was given.
+func parseFlags(fs *flag.FlagSet, args []string) (*config, bool, error) {
+	// The flags are bound to a scratch config so that only those explicitly
+	// given are copied over the file's values
+	var f config
+	fs.Var((*stringList)(&f.Listen), "listen", "comma separated addresses to listen on (default "+sockAddr+")")
+	fs.StringVar(&f.TLS.Cert, "tls-cert", "", "path to a PEM encoded certificate, enables wss://")
+	fs.StringVar(&f.TLS.Key, "tls-key", "", "path to the PEM encoded key for -tls-cert")
+	fs.StringVar(&f.TLS.ClientCA, "tls-client-ca", "", "path to a PEM bundle of CAs that client certificates are verified against")
+	fs.BoolVar(&f.TLS.RequireClientCert, "tls-require-client-cert", false, "reject clients that don't present a certificate")
+	fs.StringVar(&f.TLS.MinVersion, "tls-min-version", "", "minimum TLS version, e.g. 1.3 (default 1.2)")
+	fs.Var((*stringList)(&f.TLS.CipherSuites), "tls-cipher-suites", "comma separated TLS 1.2 cipher suite names")
+	fs.IntVar(&f.Limits.MaxMessageSize, "max-message-size", 0, fmt.Sprintf("largest message accepted in bytes (default %d)", payloadSize))
+	fs.IntVar(&f.Limits.MaxConnections, "max-connections", 0, "maximum open connections, 0 is unlimited")
+	fs.IntVar(&f.Limits.MaxConnectionsPerIP, "max-connections-per-ip", 0, "maximum open connections from one address, 0 is unlimited")
+	fs.Float64Var(&f.Limits.HandshakeRate, "handshake-rate", 0, "handshakes per second allowed from one address, 0 is unlimited")
+	fs.Float64Var(&f.Limits.MessageRate, "message-rate", 0, "messages per second each connection may send, 0 is unlimited")
+	fs.IntVar(&f.Limits.MessageBurst, "message-burst", 0, "messages each connection may send at once (default the message rate)")
+	fs.Float64Var(&f.Limits.ByteRate, "byte-rate", 0, "payload bytes per second each connection may send, 0 is unlimited")
+	fs.IntVar(&f.Limits.ByteBurst, "byte-burst", 0, "payload bytes each connection may send at once (default the byte rate)")
+	fs.StringVar(&f.Limits.RatePolicy, "rate-policy", "", "what to do with messages over the rate: delay, drop or close (default delay)")
+	fs.Float64Var(&f.Limits.EgressByteRate, "egress-byte-rate", 0, "payload bytes per second sent to each connection, 0 is unlimited")
+	fs.IntVar(&f.Limits.EgressByteBurst, "egress-byte-burst", 0, "payload bytes sent to each connection at once (default the egress byte rate)")
+	fs.Var((*stringList)(&f.IPFilter.Allow), "allow-cidrs", "comma separated networks allowed to connect, everyone else is refused")
+	fs.Var((*stringList)(&f.IPFilter.Deny), "deny-cidrs", "comma separated networks refused as soon as they connect")
+	fs.BoolVar(&f.Proxy.Protocol, "proxy-protocol", false, "expect a PROXY protocol header on every connection")
+	fs.Var((*stringList)(&f.Proxy.Trusted), "trusted-proxies", "comma separated networks whose X-Forwarded-For and Forwarded headers are trusted")
+	fs.StringVar(&f.Admin.Listen, "admin-listen", "", "address to serve the admin API on, disabled by default")
+	fs.StringVar(&f.Admin.Token, "admin-token", "", "bearer token required by the admin API")
+	fs.BoolVar(&f.Admin.PublicMetrics, "public-metrics", false, "also serve /metrics on the socket listeners, without the admin token")
+	fs.Var(durationFlag{&f.Timeouts.Handshake}, "handshake-timeout", "time allowed to send the upgrade request (default 10s)")
+	fs.Var(durationFlag{&f.Timeouts.Read}, "read-timeout", "close connections that send nothing for this long, 0 disables")
+	fs.Var(durationFlag{&f.Timeouts.Write}, "write-timeout", "time allowed to send a message, 0 disables")
+	fs.Var(durationFlag{&f.Keepalive.Interval}, "ping-interval", "how often to ping connections, 0 disables (default 30s)")
+	fs.Var((*stringList)(&f.AllowedOrigins), "allowed-origins", "comma separated origins allowed to connect besides the server's own")
+	fs.Var((*stringList)(&f.Subprotocols), "subprotocols", "comma separated subprotocols to accept, in order of preference")
+	fs.StringVar(&f.Log.Level, "log-level", "", "minimum level to log: debug, info, warn or error (default info)")
+	fs.StringVar(&f.Log.Format, "log-format", "", "log format: text or json (default text)")
+	fs.BoolVar(&f.Log.Payloads, "log-payloads", false, "include frame payloads in debug logs, they may contain user data")
+	fs.StringVar(&f.Handler, "handler", "", "how to handle messages: echo or discard (default echo)")
+	configFile := fs.String("config", "", "path to a JSON or TOML config file")
+	printConfig := fs.Bool("print-config", false, "print the effective configuration and exit")
+
+	if err := fs.Parse(args); err != nil {
+		return nil, false, err
+	}
+
+	cfg := defaultConfig()
+	if *configFile != "" {
+		if err := loadConfigFile(cfg, *configFile); err != nil {
+			return nil, false, err
+		}
+	}
+
+	fs.Visit(func(fl *flag.Flag) {
+		switch fl.Name {
+		case "listen":
+			cfg.Listen = f.Listen
+		case "tls-cert":
+			cfg.TLS.Cert = f.TLS.Cert
+		case "tls-key":
+			cfg.TLS.Key = f.TLS.Key
+		case "tls-client-ca":
+			cfg.TLS.ClientCA = f.TLS.ClientCA
+		case "tls-require-client-cert":
+			cfg.TLS.RequireClientCert = f.TLS.RequireClientCert
+		case "tls-min-version":
+			cfg.TLS.MinVersion = f.TLS.MinVersion
+		case "tls-cipher-suites":
+			cfg.TLS.CipherSuites = f.TLS.CipherSuites
+		case "max-message-size":
+			cfg.Limits.MaxMessageSize = f.Limits.MaxMessageSize
+		case "max-connections":
+			cfg.Limits.MaxConnections = f.Limits.MaxConnections
+		case "max-connections-per-ip":
+			cfg.Limits.MaxConnectionsPerIP = f.Limits.MaxConnectionsPerIP
+		case "handshake-rate":
+			cfg.Limits.HandshakeRate = f.Limits.HandshakeRate
+		case "message-rate":
+			cfg.Limits.MessageRate = f.Limits.MessageRate
+		case "message-burst":
+			cfg.Limits.MessageBurst = f.Limits.MessageBurst
+		case "byte-rate":
+			cfg.Limits.ByteRate = f.Limits.ByteRate
+		case "byte-burst":
+			cfg.Limits.ByteBurst = f.Limits.ByteBurst
+		case "rate-policy":
+			cfg.Limits.RatePolicy = f.Limits.RatePolicy
+		case "egress-byte-rate":
+			cfg.Limits.EgressByteRate = f.Limits.EgressByteRate
+		case "egress-byte-burst":
+			cfg.Limits.EgressByteBurst = f.Limits.EgressByteBurst
+		case "allow-cidrs":
+			cfg.IPFilter.Allow = f.IPFilter.Allow
+		case "deny-cidrs":
+			cfg.IPFilter.Deny = f.IPFilter.Deny
+		case "proxy-protocol":
+			cfg.Proxy.Protocol = f.Proxy.Protocol
+		case "trusted-proxies":
+			cfg.Proxy.Trusted = f.Proxy.Trusted
+		case "admin-listen":
+			cfg.Admin.Listen = f.Admin.Listen
+		case "admin-token":
+			cfg.Admin.Token = f.Admin.Token
+		case "public-metrics":
+			cfg.Admin.PublicMetrics = f.Admin.PublicMetrics
+		case "handshake-timeout":
+			cfg.Timeouts.Handshake = f.Timeouts.Handshake
+		case "read-timeout":
+			cfg.Timeouts.Read = f.Timeouts.Read
+		case "write-timeout":
+			cfg.Timeouts.Write = f.Timeouts.Write
+		case "ping-interval":
+			cfg.Keepalive.Interval = f.Keepalive.Interval
+		case "allowed-origins":
+			cfg.AllowedOrigins = f.AllowedOrigins
+		case "subprotocols":
+			cfg.Subprotocols = f.Subprotocols
+		case "log-level":
+			cfg.Log.Level = f.Log.Level
+		case "log-format":
+			cfg.Log.Format = f.Log.Format
+		case "log-payloads":
+			cfg.Log.Payloads = f.Log.Payloads
+		case "handler":
+			cfg.Handler = f.Handler
+		}
+	})
+
+	return cfg, *printConfig, nil
+}
+
+// parseTOML parses the subset of TOML the config needs: tables, and keys
+// holding strings, integers, floats, booleans or single line arrays of those
+func parseTOML(src string) (map[string]any, error) {
+	root := make(map[string]any)
+	table := root
+
+	for i, line := range strings.Split(src, "\n") {
+		line = strings.TrimSpace(stripTOMLComment(line))
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") || strings.HasPrefix(line, "[[") {
+				return nil, fmt.Errorf("line %d: malformed table %q", i+1, line)
+			}
+			table = root
+			for _, name := range strings.Split(strings.Trim(line, "[]"), ".") {
+				name = strings.TrimSpace(name)
+				next, ok := table[name].(map[string]any)
+				if !ok {
+					next = make(map[string]any)
+					table[name] = next
+				}
+				table = next
+			}
+			continue
+		}
+
+		key, raw, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected key = value", i+1)
+		}
+		key = strings.Trim(strings.TrimSpace(key), `"`)
+
+		v, err := parseTOMLValue(strings.TrimSpace(raw))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+		table[key] = v
+	}
+
+	return root, nil
+}
+
+// stripTOMLComment removes a trailing comment that isn't inside a string
+func stripTOMLComment(line string) string {
+	var quote rune
+	for i, r := range line {
+		switch {
+		case quote != 0 && r == quote && (quote == '\'' || i == 0 || line[i-1] != '\\'):
+			quote = 0
+		case quote == 0 && (r == '"' || r == '\''):
+			quote = r
+		case quote == 0 && r == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func parseTOMLValue(raw string) (any, error) {
+	switch {
+	case raw == "true":
+		return true, nil
+	case raw == "false":
+		return false, nil
+	case strings.HasPrefix(raw, `"`):
+		return strconv.Unquote(raw)
+	case strings.HasPrefix(raw, "'") && strings.HasSuffix(raw, "'") && len(raw) >= 2:
+		return raw[1 : len(raw)-1], nil
+	case strings.HasPrefix(raw, "["):
+		if !strings.HasSuffix(raw, "]") {
+			return nil, fmt.Errorf("arrays must be on a single line")
+		}
+		items := []any{}
+		for _, item := range splitTOMLArray(raw[1 : len(raw)-1]) {
+			v, err := parseTOMLValue(item)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, v)
+		}
+		return items, nil
+	}
+
+	if n, err := strconv.ParseInt(strings.ReplaceAll(raw, "_", ""), 0, 64); err == nil {
+		return n, nil
+	}
+	if f, err := strconv.ParseFloat(raw, 64); err == nil {
+		return f, nil
+	}
+	return nil, fmt.Errorf("unsupported value %q", raw)
+}
+
+// splitTOMLArray splits the inside of an array on commas outside of strings
+func splitTOMLArray(s string) []string {
+	var items []string
+	var quote rune
+	start := 0
+	for i, r := range s {
+		switch {
+		case quote != 0 && r == quote && (quote == '\'' || s[i-1] != '\\'):
+			quote = 0
+		case quote == 0 && (r == '"' || r == '\''):
+			quote = r
+		case quote == 0 && r == ',':
+			items = append(items, strings.TrimSpace(s[start:i]))
+			start = i + 1
+		}
+	}
+	if last := strings.TrimSpace(s[start:]); last != "" {
+		items = append(items, last)
+	}
+	return items
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTOML(t *testing.T) {
+	src := `
+# Top level keys
+listen = [":3000", "127.0.0.1:3001"] # trailing comment
+handler = 'discard'
+
+[limits]
+max_message_size = 1_048_576
+
+[log]
+level = "debug # not a comment"
+payloads = true
+`
+	values, err := parseTOML(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]any{
+		"listen":  []any{":3000", "127.0.0.1:3001"},
+		"handler": "discard",
+		"limits":  map[string]any{"max_message_size": int64(1048576)},
+		"log":     map[string]any{"level": "debug # not a comment", "payloads": true},
+	}
+	if !reflect.DeepEqual(values, expected) {
+		t.Errorf("unexpected values:\n%#v\nexpected:\n%#v", values, expected)
+	}
+
+	for _, bad := range []string{"[tls", "key", "key = [1,", "key = nope"} {
+		if _, err := parseTOML(bad); err == nil {
+			t.Errorf("expected %q to fail to parse", bad)
+		}
+	}
+}
+
+func TestParseFlags(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "fws.toml")
+	err := os.WriteFile(file, []byte(`
+listen = [":4000"]
+allowed_origins = ["https://*.example.com"]
+
+[timeouts]
+read = "90s"
+
+[keepalive]
+interval = "20s"
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs := flag.NewFlagSet("ws", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	cfg, printConfig, err := parseFlags(fs, []string{"-config", file, "-ping-interval", "45s", "-print-config"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !printConfig {
+		t.Errorf("expected -print-config to be reported")
+	}
+	if !reflect.DeepEqual(cfg.Listen, []string{":4000"}) {
+		t.Errorf("expected listen from the file, got %v", cfg.Listen)
+	}
+	if time.Duration(cfg.Keepalive.Interval) != 45*time.Second {
+		t.Errorf("expected the flag to override the file, got %v", time.Duration(cfg.Keepalive.Interval))
+	}
+	if time.Duration(cfg.Timeouts.Handshake) != 10*time.Second {
+		t.Errorf("expected defaults to remain for unset values, got %v", time.Duration(cfg.Timeouts.Handshake))
+	}
+	if err := cfg.validate(); err != nil {
+		t.Errorf("expected config to be valid: %v", err)
+	}
+
+	s, err := cfg.newServer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.readTimeout != 90*time.Second || !reflect.DeepEqual(s.upgrade.origin.allowed, cfg.AllowedOrigins) {
+		t.Errorf("server doesn't reflect the config: %+v", s)
+	}
+}
+
+func TestBurstFlags(t *testing.T) {
+	fs := flag.NewFlagSet("ws", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	cfg, _, err := parseFlags(fs, []string{"-message-burst", "5", "-byte-burst", "4096", "-egress-byte-burst", "8192"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l := cfg.Limits.connLimits(); l.messageBurst != 5 || l.byteBurst != 4096 || l.egressByteBurst != 8192 {
+		t.Errorf("expected the bursts from the flags, got %+v", l)
+	}
+}
+
+func TestConfigPrintRedactsToken(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Admin.Listen = "127.0.0.1:9090"
+	cfg.Admin.Token = "s3cret-admin-token"
+
+	var b bytes.Buffer
+	if err := cfg.print(&b); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(b.String(), "s3cret-admin-token") {
+		t.Errorf("expected the token to be redacted, got %s", b.String())
+	}
+	if !strings.Contains(b.String(), `"token": "<redacted>"`) {
+		t.Errorf("expected the token to be shown as redacted, got %s", b.String())
+	}
+	if cfg.Admin.Token != "s3cret-admin-token" {
+		t.Errorf("expected printing to leave the config's token alone")
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	cfg := defaultConfig()
+	if err := cfg.validate(); err != nil {
+		t.Fatalf("expected default config to be valid: %v", err)
+	}
+
+	cfg.TLS.Key = "key.pem"
+	cfg.TLS.MinVersion = "1.9"
+	cfg.Limits.MaxMessageSize = 0
+	cfg.Timeouts.Read = duration(time.Second)
+	cfg.AllowedOrigins = []string{"https://example.com/path"}
+	cfg.IPFilter.Deny = []string{"10.0.0.0/33"}
+	cfg.Handler = "nope"
+
+	err := cfg.validate()
+	if err == nil {
+		t.Fatal("expected config to be invalid")
+	}
+	for _, want := range []string{"cert and key", "tls version", "max_message_size", "timeouts.read", "allowed_origins", "ip_filter.deny", "unknown handler"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected error to mention %q:\n%v", want, err)
+		}
+	}
+}
+
+func TestLoadConfigFileUnknownField(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "fws.json")
+	if err := os.WriteFile(file, []byte(`{"listne": [":3000"]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadConfigFile(defaultConfig(), file); err == nil {
+		t.Errorf("expected misspelt field to be rejected")
+	}
+}
@@ -0,0 +1,643 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// outcome is how a server did in a conformance case
+type outcome string
+
+const (
+	outcomePass outcome = "pass"
+	// outcomeNonStrict is behaviour the RFC allows but doesn't recommend,
+	// like failing a connection late or without a close frame
+	outcomeNonStrict outcome = "non-strict"
+	outcomeFail      outcome = "fail"
+)
+
+// conformanceCloseWait is how long the server has to close the TCP
+// connection once the close handshake is done
+const conformanceCloseWait = time.Second
+
+// maxConformanceFrame is the largest frame or message read from the peer,
+// anything bigger is more than any case asks for
+const maxConformanceFrame = 64 << 20
+
+// testFrame is a frame as a conformance case sends it, which may well break
+// the protocol
+type testFrame struct {
+	fin  bool
+	rsv  byte
+	op   opCode
+	data []byte
+	// chunk writes the frame in pieces of this many bytes, zero writes it
+	// all at once
+	chunk int
+	// unmasked sends the frame without the mask a client must use
+	unmasked bool
+	// length, when set, is the payload length given in the header in place
+	// of the real one
+	length uint64
+	// truncate, when set, sends only this many bytes of the encoded frame
+	truncate int
+}
+
+// encode masks the frame as a client must, unless it's unmasked
+func (f testFrame) encode() []byte {
+	h := header{isFin: f.fin, rsv: f.rsv, op: f.op, length: uint64(len(f.data))}
+	if f.length > 0 {
+		h.length = f.length
+	}
+	if !f.unmasked {
+		h.isMasked, h.mask = true, make([]byte, 4)
+		rand.Read(h.mask)
+	}
+
+	var b bytes.Buffer
+	w := bufio.NewWriter(&b)
+	h.write(w)
+	for i, c := range f.data {
+		if h.isMasked {
+			c ^= h.mask[i%4]
+		}
+		w.WriteByte(c)
+	}
+	w.Flush()
+	if f.truncate > 0 && f.truncate < b.Len() {
+		b.Truncate(f.truncate)
+	}
+	return b.Bytes()
+}
+
+// message is a data message or pong the server sent
+type message struct {
+	op   opCode
+	data []byte
+}
+
+func (m message) String() string {
+	return fmt.Sprintf("%s of %d byte(s)", m.op, len(m.data))
+}
+
+// caseConn is a connection to the peer under test, usually a server, framed
+// by hand so cases can send whatever they like
+type caseConn struct {
+	c net.Conn
+	r *bufio.Reader
+	// server is set when we're the server, testing a client whose frames
+	// must be masked
+	server bool
+
+	mu        sync.Mutex
+	messages  []message
+	closeCode status
+	// violation is the first rule the peer broke
+	violation string
+	sentClose bool
+
+	// closed is closed when the peer's close frame arrives, and eof when
+	// the peer closes the TCP connection
+	closed chan struct{}
+	eof    chan struct{}
+}
+
+func newCaseConn(c net.Conn, r *bufio.Reader) *caseConn {
+	return &caseConn{c: c, r: r, closed: make(chan struct{}), eof: make(chan struct{})}
+}
+
+// readLoop reads frames from the peer until it closes the connection
+func (cc *caseConn) readLoop() {
+	defer close(cc.eof)
+
+	h := &header{}
+	var partial *message
+	for {
+		if err := cc.readHeader(h); err != nil {
+			return
+		}
+
+		data := make([]byte, h.length)
+		if _, err := io.ReadFull(cc.r, data); err != nil {
+			return
+		}
+		if h.isMasked {
+			for i := range data {
+				data[i] ^= h.mask[i%4]
+			}
+		}
+
+		select {
+		case <-cc.closed:
+			cc.violate(cc.peer() + " sent a frame after its close frame")
+			continue
+		default:
+		}
+
+		switch {
+		case h.op == connclose:
+			code := statusNoStatus
+			if len(data) >= 2 {
+				code = status(data[0])<<8 | status(data[1])
+			}
+			cc.mu.Lock()
+			cc.closeCode = code
+			cc.mu.Unlock()
+			close(cc.closed)
+		case h.op == pong:
+			cc.add(message{pong, data})
+		case h.op == ping:
+			// The peer may be pinging to keep the connection alive, there's
+			// no need to answer within a case
+		case h.op == continuation && partial == nil:
+			cc.violate(cc.peer() + " sent a continuation frame without a message")
+		case h.op == continuation && len(partial.data)+len(data) > maxConformanceFrame:
+			cc.violate(fmt.Sprintf("%s sent a message over %d bytes", cc.peer(), maxConformanceFrame))
+			return
+		case h.op == continuation:
+			partial.data = append(partial.data, data...)
+			if h.isFin {
+				cc.add(*partial)
+				partial = nil
+			}
+		case partial != nil:
+			cc.violate(cc.peer() + " started a message before finishing the last")
+		case h.isFin:
+			cc.add(message{h.op, data})
+		default:
+			partial = &message{h.op, data}
+		}
+	}
+}
+
+// readHeader reads a frame header from the peer, checking what it can
+func (cc *caseConn) readHeader(h *header) error {
+	if err := h.read(cc.r); err != nil {
+		return err
+	}
+	peer := cc.peer()
+
+	// Checked before anything else, as every frame that's read is allocated
+	// in full and the peer may not be trusted
+	if h.length > maxConformanceFrame {
+		cc.violate(fmt.Sprintf("%s sent a %d byte frame", peer, h.length))
+		return fmt.Errorf("frame too large")
+	}
+
+	switch {
+	case h.isMasked != cc.server:
+		cc.violate(fmt.Sprintf("%s sent a frame masked = %t", peer, h.isMasked))
+	case h.rsv != 0:
+		cc.violate(peer + " set reserved bits")
+	case h.op.isReserved():
+		cc.violate(fmt.Sprintf("%s used reserved op code %d", peer, h.op))
+	case h.op.isControl() && (!h.isFin || h.length > 125):
+		cc.violate(peer + " sent an invalid control frame")
+	}
+	return nil
+}
+
+// peer names who's on the other end in violations
+func (cc *caseConn) peer() string {
+	if cc.server {
+		return "client"
+	}
+	return "server"
+}
+
+func (cc *caseConn) add(m message) {
+	cc.mu.Lock()
+	cc.messages = append(cc.messages, m)
+	cc.mu.Unlock()
+}
+
+func (cc *caseConn) violate(v string) {
+	cc.mu.Lock()
+	if cc.violation == "" {
+		cc.violation = v
+	}
+	cc.mu.Unlock()
+}
+
+// send writes 'f' to the peer
+func (cc *caseConn) send(f testFrame) error {
+	if f.op == connclose {
+		cc.sentClose = true
+	}
+
+	b := f.encode()
+	if f.chunk <= 0 {
+		_, err := cc.c.Write(b)
+		return err
+	}
+	for len(b) > 0 {
+		n := min(f.chunk, len(b))
+		if _, err := cc.c.Write(b[:n]); err != nil {
+			return err
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+// waitClose reports whether the peer's close frame arrives within 'd'
+func (cc *caseConn) waitClose(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-cc.closed:
+		return true
+	case <-cc.eof:
+		return true
+	case <-t.C:
+		return false
+	}
+}
+
+// isClosed reports whether the peer has sent its close frame
+func (cc *caseConn) isClosed() bool {
+	select {
+	case <-cc.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// isEOF reports whether the peer has closed the TCP connection
+func (cc *caseConn) isEOF() bool {
+	select {
+	case <-cc.eof:
+		return true
+	default:
+		return false
+	}
+}
+
+// finishClose answers the peer's close frame, if it sent one, and gives it
+// a moment to hang up
+func (cc *caseConn) finishClose(ctx context.Context) {
+	if !cc.isClosed() {
+		return
+	}
+	if !cc.sentClose {
+		cc.send(testFrame{fin: true, op: connclose, data: closePayload(statusNormal, ""), unmasked: cc.server})
+	}
+
+	t := time.NewTimer(conformanceCloseWait)
+	defer t.Stop()
+	select {
+	case <-cc.eof:
+	case <-ctx.Done():
+	case <-t.C:
+	}
+}
+
+// conformanceCase is a single test of how a server handles what it's sent
+type conformanceCase struct {
+	id          string
+	category    string
+	description string
+	frames      []testFrame
+	// expect are the messages and pongs the server should send back, in
+	// order
+	expect []message
+	// fail is set when the server should fail the connection
+	fail bool
+	// codes are the close codes the server may answer with, by default
+	// statusProtoErr when it should fail the connection and statusNormal
+	// otherwise
+	codes []status
+	// failFast is the number of frames after which a strict server has
+	// already failed the connection, zero when it doesn't matter
+	failFast int
+}
+
+// closes reports whether the case sends its own close frame, otherwise one
+// with statusNormal follows its frames
+func (tc *conformanceCase) closes() bool {
+	return slices.ContainsFunc(tc.frames, func(f testFrame) bool { return f.op == connclose })
+}
+
+func (tc *conformanceCase) closeCodes() []status {
+	switch {
+	case len(tc.codes) > 0:
+		return tc.codes
+	case tc.fail:
+		return []status{statusProtoErr}
+	}
+	return []status{statusNormal}
+}
+
+// evaluate decides how the server did, 'late' is set when it didn't fail
+// the connection by the case's failFast frame
+func (tc *conformanceCase) evaluate(cc *caseConn, late bool) (outcome, string) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	if cc.violation != "" {
+		return outcomeFail, cc.violation
+	}
+
+	for i, want := range tc.expect {
+		if i >= len(cc.messages) {
+			return outcomeFail, fmt.Sprintf("expected %d message(s) back, got %d", len(tc.expect), len(cc.messages))
+		}
+		if got := cc.messages[i]; got.op != want.op || string(got.data) != string(want.data) {
+			return outcomeFail, fmt.Sprintf("expected message %d to be a %s, got a %s", i+1, want, got)
+		}
+	}
+	if len(cc.messages) > len(tc.expect) {
+		return outcomeFail, fmt.Sprintf("expected %d message(s) back, got %d", len(tc.expect), len(cc.messages))
+	}
+
+	eof := cc.isEOF()
+	codes := tc.closeCodes()
+	switch {
+	case !cc.isClosed() && eof && tc.fail:
+		return outcomeNonStrict, "dropped the connection without a close frame"
+	case !cc.isClosed() && eof:
+		return outcomeFail, "closed the connection without a close frame"
+	case !cc.isClosed():
+		return outcomeFail, "timed out waiting for a close frame"
+	case !slices.Contains(codes, cc.closeCode):
+		return outcomeFail, fmt.Sprintf("closed with %d, expected %s", cc.closeCode, statusList(codes))
+	case late && tc.fail:
+		return outcomeNonStrict, "failed the connection only once the message was complete"
+	case !eof:
+		return outcomeNonStrict, "didn't close the TCP connection after the close handshake"
+	}
+	return outcomePass, ""
+}
+
+func statusList(codes []status) string {
+	s := make([]string, len(codes))
+	for i, c := range codes {
+		s[i] = fmt.Sprint(int(c))
+	}
+	return strings.Join(s, " or ")
+}
+
+type conformanceOptions struct {
+	dial dialOptions
+	// timeout bounds each case
+	timeout time.Duration
+	// failFastWait is how long a strict server has to fail the connection
+	// before the rest of a case's frames are sent
+	failFastWait time.Duration
+}
+
+// caseResult is how the server did in one case
+type caseResult struct {
+	ID          string  `json:"id"`
+	Category    string  `json:"category"`
+	Description string  `json:"description"`
+	Outcome     outcome `json:"outcome"`
+	Reason      string  `json:"reason,omitempty"`
+	// Duration is in milliseconds
+	Duration float64 `json:"duration_ms"`
+}
+
+type conformanceReport struct {
+	URL       string       `json:"url"`
+	Started   time.Time    `json:"started"`
+	Passed    int          `json:"passed"`
+	NonStrict int          `json:"non_strict"`
+	Failed    int          `json:"failed"`
+	Cases     []caseResult `json:"cases"`
+}
+
+// runConformance runs 'cases' against the server at 'rawURL' one at a time
+func runConformance(ctx context.Context, rawURL string, cases []conformanceCase, opts *conformanceOptions) *conformanceReport {
+	report := &conformanceReport{URL: rawURL, Started: time.Now()}
+	for _, tc := range cases {
+		if ctx.Err() != nil {
+			break
+		}
+
+		res := runCase(ctx, rawURL, tc, opts)
+		switch res.Outcome {
+		case outcomePass:
+			report.Passed++
+		case outcomeNonStrict:
+			report.NonStrict++
+		default:
+			report.Failed++
+		}
+		report.Cases = append(report.Cases, res)
+	}
+	return report
+}
+
+func runCase(ctx context.Context, rawURL string, tc conformanceCase, opts *conformanceOptions) (res caseResult) {
+	res = caseResult{ID: tc.id, Category: tc.category, Description: tc.description}
+	start := time.Now()
+	defer func() {
+		res.Duration = float64(time.Since(start).Microseconds()) / 1000
+	}()
+
+	ctx, cancel := context.WithTimeout(ctx, opts.timeout)
+	defer cancel()
+
+	c, r, _, err := dialRaw(ctx, rawURL, &opts.dial)
+	if err != nil {
+		res.Outcome, res.Reason = outcomeFail, fmt.Sprintf("failed to connect: %v", err)
+		return res
+	}
+	defer c.Close()
+
+	stop := context.AfterFunc(ctx, func() {
+		c.SetDeadline(aLongTimeAgo)
+	})
+	defer stop()
+
+	cc := newCaseConn(c, r)
+	go cc.readLoop()
+
+	frames := tc.frames
+	if !tc.closes() {
+		frames = append(slices.Clip(frames), testFrame{fin: true, op: connclose, data: closePayload(statusNormal, "")})
+	}
+
+	late := false
+	for i, f := range frames {
+		if tc.failFast > 0 && i == tc.failFast {
+			late = !cc.waitClose(opts.failFastWait)
+		}
+		// Nothing may be sent once the server has closed
+		if cc.isClosed() {
+			break
+		}
+		if err := cc.send(f); err != nil {
+			break
+		}
+	}
+
+	select {
+	case <-cc.closed:
+	case <-cc.eof:
+	case <-ctx.Done():
+	}
+
+	cc.finishClose(ctx)
+
+	res.Outcome, res.Reason = tc.evaluate(cc, late)
+	return res
+}
+
+// selectCases returns the cases whose id is, or starts with, one of the
+// comma separated ids in 'only'. An empty 'only' selects every case.
+func selectCases(cases []conformanceCase, only string) []conformanceCase {
+	if only == "" {
+		return cases
+	}
+
+	var selected []conformanceCase
+	for _, tc := range cases {
+		for _, id := range strings.Split(only, ",") {
+			id = strings.TrimSuffix(strings.TrimSpace(id), ".")
+			if tc.id == id || strings.HasPrefix(tc.id, id+".") {
+				selected = append(selected, tc)
+				break
+			}
+		}
+	}
+	return selected
+}
+
+func (r *conformanceReport) writeText(w io.Writer) error {
+	for _, c := range r.Cases {
+		line := fmt.Sprintf("%-8s %-10s %s: %s", c.ID, c.Outcome, c.Category, c.Description)
+		if c.Reason != "" {
+			line += " (" + c.Reason + ")"
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "\n%d case(s) against %s: %d passed, %d non-strict, %d failed\n", len(r.Cases), r.URL, r.Passed, r.NonStrict, r.Failed)
+	return err
+}
+
+func (r *conformanceReport) writeJSON(w io.Writer) error {
+	e := json.NewEncoder(w)
+	e.SetIndent("", "  ")
+	return e.Encode(r)
+}
+
+var reportTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>WebSocket conformance report</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+td, th { padding: 0.25em 0.75em; text-align: left; border-bottom: 1px solid #ddd; }
+.pass { background: #dfd; }
+.non-strict { background: #ffd; }
+.fail { background: #fdd; }
+</style>
+</head>
+<body>
+<h1>WebSocket conformance report</h1>
+<p>{{.URL}} at {{.Started.Format "2006-01-02 15:04:05 MST"}}: {{.Passed}} passed, {{.NonStrict}} non-strict, {{.Failed}} failed</p>
+<table>
+<tr><th>Case</th><th>Category</th><th>Description</th><th>Outcome</th><th>Reason</th><th>Time (ms)</th></tr>
+{{range .Cases}}<tr class="{{.Outcome}}"><td>{{.ID}}</td><td>{{.Category}}</td><td>{{.Description}}</td><td>{{.Outcome}}</td><td>{{.Reason}}</td><td>{{printf "%.1f" .Duration}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+func (r *conformanceReport) writeHTML(w io.Writer) error {
+	return reportTemplate.Execute(w, r)
+}
+
+// writeReportFile writes a report to 'name' with 'write'
+func writeReportFile(name string, write func(io.Writer) error) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// conformanceCommand runs the conformance cases against a server, exiting
+// with 1 when it fails any of them
+func conformanceCommand(args []string) int {
+	fs := flag.NewFlagSet("conformance", flag.ContinueOnError)
+	jsonFile := fs.String("json", "", "write the report as JSON to this file")
+	htmlFile := fs.String("html", "", "write the report as HTML to this file")
+	only := fs.String("cases", "", "comma separated case ids to run, a prefix like 6.4 runs every case under it (default all)")
+	timeout := fs.Duration("timeout", 10*time.Second, "time allowed for each case")
+	failFastWait := fs.Duration("fail-fast-wait", 500*time.Millisecond, "time a strict server has to fail the connection before the rest of the message is sent")
+	maxMessageSize := fs.Int("max-message-size", 0, "largest message the server accepts in bytes, bigger messages are expected to be refused (default unknown)")
+	insecure := fs.Bool("insecure", false, "don't verify the server's certificate for wss:// URLs")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: ws conformance [flags] ws://host:port/path")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	opts := &conformanceOptions{timeout: *timeout, failFastWait: *failFastWait}
+	if *insecure {
+		opts.dial.tlsConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	cases := selectCases(conformanceCases(*maxMessageSize), *only)
+	if len(cases) == 0 {
+		fmt.Fprintf(os.Stderr, "no cases match %q\n", *only)
+		return 2
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	report := runConformance(ctx, fs.Arg(0), cases, opts)
+	report.writeText(os.Stdout)
+
+	if *jsonFile != "" {
+		if err := writeReportFile(*jsonFile, report.writeJSON); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+	if *htmlFile != "" {
+		if err := writeReportFile(*htmlFile, report.writeHTML); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+
+	if report.Failed > 0 || ctx.Err() != nil {
+		return 1
+	}
+	return 0
+}
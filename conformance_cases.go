@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// msg is a complete message in a single frame
+func msg(op opCode, data []byte) testFrame {
+	return testFrame{fin: true, op: op, data: data}
+}
+
+// frag is a fragment of a message that isn't the last
+func frag(op opCode, data []byte) testFrame {
+	return testFrame{op: op, data: data}
+}
+
+func closeFrame(code status, reason string) testFrame {
+	return msg(connclose, append([]byte{byte(code >> 8), byte(code)}, reason...))
+}
+
+func chunked(f testFrame, chunk int) testFrame {
+	f.chunk = chunk
+	return f
+}
+
+// fragments splits 'data' into a message of 'size' byte fragments
+func fragments(op opCode, data []byte, size int) []testFrame {
+	var frames []testFrame
+	for len(data) > size {
+		frames = append(frames, frag(op, data[:size]))
+		data, op = data[size:], continuation
+	}
+	return append(frames, msg(op, data))
+}
+
+// payloadOf returns 'n' bytes of 'c'
+func payloadOf(c byte, n int) []byte {
+	return bytes.Repeat([]byte{c}, n)
+}
+
+// validUTF8 and invalidUTF8 are text payloads checked by the utf-8 cases
+var validUTF8 = []struct {
+	description string
+	data        string
+}{
+	{"U+0000", "\x00"},
+	{"U+007F, the last 1 byte code point", "\x7f"},
+	{"U+0080, the first 2 byte code point", "\xc2\x80"},
+	{"U+07FF, the last 2 byte code point", "\xdf\xbf"},
+	{"U+0800, the first 3 byte code point", "\xe0\xa0\x80"},
+	{"U+FFFF, the last 3 byte code point", "\xef\xbf\xbf"},
+	{"U+10000, the first 4 byte code point", "\xf0\x90\x80\x80"},
+	{"U+10FFFF, the last code point", "\xf4\x8f\xbf\xbf"},
+	{"a byte order mark", "\xef\xbb\xbfHello"},
+}
+
+var invalidUTF8 = []struct {
+	description string
+	data        string
+}{
+	{"a surrogate", "\xce\xba\xe1\xbd\xb9\xcf\x83\xce\xbc\xce\xb5\xed\xa0\x80edited"},
+	{"an overlong 2 byte encoding", "\xc0\xaf"},
+	{"an overlong 3 byte encoding", "\xe0\x80\xaf"},
+	{"a code point above U+10FFFF", "\xf4\x90\x80\x80"},
+	{"a lone continuation byte", "\x80"},
+	{"a truncated sequence", "\xce\xba\xe1\xbd\xb9\xcf\x83\xce\xbc\xce"},
+	{"the byte 0xfe", "\xfe"},
+	{"the byte 0xff", "\xff"},
+	{"a 5 byte sequence", "\xf8\x88\x80\x80\x80"},
+}
+
+// conformanceCases returns every case, numbered after the Autobahn
+// testsuite's. When 'maxMessageSize' is set, bigger messages are expected to
+// be refused rather than echoed.
+func conformanceCases(maxMessageSize int) []conformanceCase {
+	var cases []conformanceCase
+	add := func(id, category, description string, tc conformanceCase) {
+		tc.id, tc.category, tc.description = id, category, description
+		cases = append(cases, tc)
+	}
+	// echo expects the message, or pong for a ping, made up of 'frames' back
+	echo := func(frames ...testFrame) conformanceCase {
+		var data []byte
+		for _, f := range frames {
+			data = append(data, f.data...)
+		}
+		op := frames[0].op
+		if op == ping {
+			op = pong
+		}
+		return conformanceCase{frames: frames, expect: []message{{op, data}}}
+	}
+	fits := func(n int) bool {
+		return maxMessageSize <= 0 || n <= maxMessageSize
+	}
+
+	// 1 Framing
+	for i, op := range []opCode{text, binary} {
+		c := byte('*')
+		if op == binary {
+			c = 0xfe
+		}
+		for j, n := range []int{0, 125, 126, 127, 128, 65535, 65536} {
+			add(fmt.Sprintf("1.%d.%d", i+1, j+1), "framing", fmt.Sprintf("%s message with a %d byte payload", op, n), echo(msg(op, payloadOf(c, n))))
+		}
+		add(fmt.Sprintf("1.%d.8", i+1), "framing", fmt.Sprintf("%s message with a 65536 byte payload written in 997 byte chunks", op),
+			echo(chunked(msg(op, payloadOf(c, 65536)), 997)))
+	}
+
+	// 2 Pings and pongs
+	binaryPing := []byte{0x00, 0xff, 0xfe, 0xfd, 0xfc, 0xfb, 0x00, 0xff}
+	add("2.1", "ping/pong", "ping without a payload", echo(msg(ping, nil)))
+	add("2.2", "ping/pong", "ping with a text payload", echo(msg(ping, []byte("Hello, world!"))))
+	add("2.3", "ping/pong", "ping with a binary payload", echo(msg(ping, binaryPing)))
+	add("2.4", "ping/pong", "ping with a 125 byte payload", echo(msg(ping, payloadOf(0xfe, 125))))
+	add("2.5", "ping/pong", "ping with a 126 byte payload", conformanceCase{frames: []testFrame{msg(ping, payloadOf(0xfe, 126))}, fail: true})
+	add("2.6", "ping/pong", "ping with a 125 byte payload written a byte at a time", echo(chunked(msg(ping, payloadOf(0xfe, 125)), 1)))
+	add("2.7", "ping/pong", "unsolicited pong without a payload", conformanceCase{frames: []testFrame{msg(pong, nil)}})
+	add("2.8", "ping/pong", "unsolicited pong with a payload", conformanceCase{frames: []testFrame{msg(pong, []byte("unsolicited pong payload"))}})
+	add("2.9", "ping/pong", "unsolicited pong followed by a ping", conformanceCase{
+		frames: []testFrame{msg(pong, []byte("unsolicited pong payload")), msg(ping, []byte("ping payload"))},
+		expect: []message{{pong, []byte("ping payload")}},
+	})
+	for i, chunk := range []int{0, 1} {
+		tc := conformanceCase{}
+		for j := 0; j < 10; j++ {
+			data := []byte(fmt.Sprintf("payload-%d", j))
+			tc.frames = append(tc.frames, chunked(msg(ping, data), chunk))
+			tc.expect = append(tc.expect, message{pong, data})
+		}
+		description := "ten pings"
+		if chunk > 0 {
+			description += " written a byte at a time"
+		}
+		add(fmt.Sprintf("2.%d", 10+i), "ping/pong", description, tc)
+	}
+
+	// 3 Reserved bits
+	hello := []byte("Hello, world!")
+	add("3.1", "reserved bits", "text message with RSV = 1", conformanceCase{frames: []testFrame{{fin: true, rsv: 1, op: text, data: hello}}, fail: true})
+	for i, rsv := range []byte{2, 3, 4} {
+		f := testFrame{fin: true, rsv: rsv, op: text, data: hello}
+		description := fmt.Sprintf("text message with RSV = %d between valid messages", rsv)
+		if rsv == 4 {
+			f.chunk = 1
+			description += ", written a byte at a time"
+		}
+		add(fmt.Sprintf("3.%d", i+2), "reserved bits", description, conformanceCase{
+			frames: []testFrame{msg(text, hello), f, msg(ping, hello)},
+			expect: []message{{text, hello}},
+			fail:   true,
+		})
+	}
+	add("3.5", "reserved bits", "binary message with RSV = 5", conformanceCase{frames: []testFrame{{fin: true, rsv: 5, op: binary, data: binaryPing}}, fail: true})
+	add("3.6", "reserved bits", "ping with RSV = 6", conformanceCase{frames: []testFrame{{fin: true, rsv: 6, op: ping, data: hello}}, fail: true})
+	add("3.7", "reserved bits", "close with RSV = 7", conformanceCase{frames: []testFrame{{fin: true, rsv: 7, op: connclose, data: closePayload(statusNormal, "")}}, fail: true})
+
+	// 4 Op codes
+	for i, ops := range [][]opCode{{3, 4, 5, 6, 7}, {11, 12, 13, 14, 15}} {
+		kind := "data"
+		if i == 1 {
+			kind = "control"
+		}
+		for j, op := range ops {
+			add(fmt.Sprintf("4.%d.%d", i+1, j+1), "opcodes", fmt.Sprintf("reserved %s op code %d between valid messages", kind, op), conformanceCase{
+				frames: []testFrame{msg(text, hello), msg(op, []byte("reserved")), msg(ping, hello)},
+				expect: []message{{text, hello}},
+				fail:   true,
+			})
+		}
+	}
+
+	// 5 Fragmentation
+	fragment1, fragment2 := []byte("fragment1"), []byte("fragment2")
+	add("5.1", "fragmentation", "ping in two fragments", conformanceCase{frames: []testFrame{frag(ping, fragment1), msg(continuation, fragment2)}, fail: true})
+	add("5.2", "fragmentation", "pong in two fragments", conformanceCase{frames: []testFrame{frag(pong, fragment1), msg(continuation, fragment2)}, fail: true})
+	add("5.3", "fragmentation", "text message in two fragments", echo(frag(text, fragment1), msg(continuation, fragment2)))
+	add("5.4", "fragmentation", "text message in two fragments written a byte at a time", echo(chunked(frag(text, fragment1), 1), chunked(msg(continuation, fragment2), 1)))
+	add("5.5", "fragmentation", "text message in two fragments with a ping between them", conformanceCase{
+		frames: []testFrame{frag(text, fragment1), msg(ping, []byte("ping")), msg(continuation, fragment2)},
+		expect: []message{{pong, []byte("ping")}, {text, []byte("fragment1fragment2")}},
+	})
+	add("5.6", "fragmentation", "text message in two fragments with a pong between them", conformanceCase{
+		frames: []testFrame{frag(text, fragment1), msg(pong, []byte("pong")), msg(continuation, fragment2)},
+		expect: []message{{text, []byte("fragment1fragment2")}},
+	})
+	tc := conformanceCase{}
+	for i := 0; i < 5; i++ {
+		op, fin := continuation, i == 4
+		if i == 0 {
+			op = text
+		}
+		tc.frames = append(tc.frames, testFrame{fin: fin, op: op, data: []byte(fmt.Sprintf("fragment%d", i+1))})
+		if !fin {
+			data := []byte(fmt.Sprintf("ping%d", i+1))
+			tc.frames = append(tc.frames, msg(ping, data))
+			tc.expect = append(tc.expect, message{pong, data})
+		}
+	}
+	tc.expect = append(tc.expect, message{text, []byte("fragment1fragment2fragment3fragment4fragment5")})
+	add("5.7", "fragmentation", "text message in five fragments with pings between them", tc)
+	add("5.8", "fragmentation", "continuation frame without a message, not final", conformanceCase{frames: []testFrame{frag(continuation, fragment1)}, fail: true})
+	add("5.9", "fragmentation", "continuation frame without a message, final", conformanceCase{frames: []testFrame{msg(continuation, fragment1)}, fail: true})
+	add("5.10", "fragmentation", "continuation frame after a complete message", conformanceCase{
+		frames: []testFrame{msg(text, fragment1), msg(continuation, fragment2)},
+		expect: []message{{text, fragment1}},
+		fail:   true,
+	})
+	add("5.11", "fragmentation", "new text message before a fragmented one is finished", conformanceCase{frames: []testFrame{frag(text, fragment1), msg(text, fragment2)}, fail: true})
+	add("5.12", "fragmentation", "binary message in two fragments, the first empty", echo(frag(binary, nil), msg(continuation, binaryPing)))
+	add("5.13", "fragmentation", "text message in three empty fragments", echo(frag(text, nil), frag(continuation, nil), msg(continuation, nil)))
+	add("5.14", "fragmentation", "fragmented text message followed by a fragmented binary message", conformanceCase{
+		frames: []testFrame{frag(text, fragment1), msg(continuation, fragment2), frag(binary, binaryPing), msg(continuation, binaryPing)},
+		expect: []message{{text, []byte("fragment1fragment2")}, {binary, append(binaryPing[:len(binaryPing):len(binaryPing)], binaryPing...)}},
+	})
+
+	// 6 UTF-8
+	kosme := []byte("\xce\xba\xe1\xbd\xb9\xcf\x83\xce\xbc\xce\xb5")
+	add("6.1.1", "utf-8", "empty text message", echo(msg(text, nil)))
+	add("6.1.2", "utf-8", "text message in three empty fragments", echo(frag(text, nil), frag(continuation, nil), msg(continuation, nil)))
+	add("6.2.1", "utf-8", "valid multi byte text", echo(msg(text, []byte("Hello-µ@ßöäüàá-UTF-8!!"))))
+	add("6.2.2", "utf-8", "valid text fragmented in the middle of a code point", echo(frag(text, kosme[:4]), msg(continuation, kosme[4:])))
+	add("6.2.3", "utf-8", "valid text in one byte fragments", echo(fragments(text, kosme, 1)...))
+	for i, v := range validUTF8 {
+		add(fmt.Sprintf("6.3.%d", i+1), "utf-8", "valid text with "+v.description, echo(msg(text, []byte(v.data))))
+	}
+	for i, v := range invalidUTF8 {
+		add(fmt.Sprintf("6.4.%d", i+1), "utf-8", "invalid text with "+v.description, conformanceCase{
+			frames: []testFrame{msg(text, []byte(v.data))},
+			fail:   true,
+			codes:  []status{statusInvalidData},
+		})
+	}
+	add("6.5.1", "utf-8", "invalid text in the first fragment", conformanceCase{
+		frames:   []testFrame{frag(text, []byte(invalidUTF8[0].data)), msg(continuation, []byte("more"))},
+		fail:     true,
+		codes:    []status{statusInvalidData},
+		failFast: 1,
+	})
+	add("6.5.2", "utf-8", "invalid code point split across fragments", conformanceCase{
+		frames:   []testFrame{frag(text, append(kosme[:len(kosme):len(kosme)], 0xf4)), frag(continuation, []byte{0x90, 0x80, 0x80}), msg(continuation, []byte("more"))},
+		fail:     true,
+		codes:    []status{statusInvalidData},
+		failFast: 2,
+	})
+	add("6.5.3", "utf-8", "invalid text in one byte fragments", conformanceCase{
+		frames:   fragments(text, []byte("\xce\xba\xe1\xbd\xb9\xcf\x83\xce\xbc\xce\xb5\xed\xa0\x80edited"), 1),
+		fail:     true,
+		codes:    []status{statusInvalidData},
+		failFast: 13,
+	})
+
+	// 7 Close handling
+	add("7.1.1", "close", "text message followed by a close", echo(msg(text, hello)))
+	add("7.1.2", "close", "two close frames", conformanceCase{frames: []testFrame{closeFrame(statusNormal, ""), closeFrame(statusNormal, "")}})
+	add("7.1.3", "close", "ping after a close", conformanceCase{frames: []testFrame{closeFrame(statusNormal, ""), msg(ping, hello)}})
+	add("7.1.4", "close", "text message after a close", conformanceCase{frames: []testFrame{closeFrame(statusNormal, ""), msg(text, hello)}})
+	add("7.1.5", "close", "close between the fragments of a message", conformanceCase{frames: []testFrame{frag(text, fragment1), closeFrame(statusNormal, ""), msg(continuation, fragment2)}})
+	if fits(256 << 10) {
+		add("7.1.6", "close", "large text message followed by a close", echo(msg(text, payloadOf('*', 256<<10))))
+	}
+	add("7.3.1", "close", "close without a payload", conformanceCase{frames: []testFrame{msg(connclose, nil)}, codes: []status{statusNormal, statusNoStatus}})
+	add("7.3.2", "close", "close with a 1 byte payload", conformanceCase{frames: []testFrame{msg(connclose, []byte{0x03})}, fail: true})
+	add("7.3.3", "close", "close with a status and no reason", conformanceCase{frames: []testFrame{closeFrame(statusNormal, "")}})
+	add("7.3.4", "close", "close with a status and reason", conformanceCase{frames: []testFrame{closeFrame(statusNormal, "Hello World!")}})
+	add("7.3.5", "close", "close with a 123 byte reason", conformanceCase{frames: []testFrame{closeFrame(statusNormal, string(payloadOf('*', 123)))}})
+	add("7.3.6", "close", "close with a 124 byte reason", conformanceCase{frames: []testFrame{closeFrame(statusNormal, string(payloadOf('*', 124)))}, fail: true})
+	add("7.5.1", "close", "close with an invalid UTF-8 reason", conformanceCase{
+		frames: []testFrame{closeFrame(statusNormal, invalidUTF8[0].data)},
+		fail:   true,
+		codes:  []status{statusProtoErr, statusInvalidData},
+	})
+	for i, code := range []status{1000, 1001, 1002, 1003, 1007, 1008, 1009, 1010, 1011, 3000, 3999, 4000, 4999} {
+		add(fmt.Sprintf("7.7.%d", i+1), "close", fmt.Sprintf("close with valid status %d", code), conformanceCase{
+			frames: []testFrame{closeFrame(code, "")},
+			codes:  []status{statusNormal, code},
+		})
+	}
+	for i, code := range []status{0, 999, 1004, 1005, 1006, 1015, 1016, 1100, 2000, 2999} {
+		add(fmt.Sprintf("7.9.%d", i+1), "close", fmt.Sprintf("close with invalid status %d", code), conformanceCase{
+			frames: []testFrame{closeFrame(code, "")},
+			fail:   true,
+		})
+	}
+
+	// 9 Limits
+	for i, op := range []opCode{text, binary} {
+		c := byte('*')
+		if op == binary {
+			c = 0xfe
+		}
+		for j, n := range []int{64 << 10, 256 << 10, 1 << 20} {
+			if fits(n) {
+				add(fmt.Sprintf("9.%d.%d", i+1, j+1), "limits", fmt.Sprintf("%d KiB %s message", n>>10, op), echo(msg(op, payloadOf(c, n))))
+			}
+		}
+	}
+	if fits(1 << 20) {
+		for i, size := range []int{256, 4 << 10, 64 << 10} {
+			add(fmt.Sprintf("9.3.%d", i+1), "limits", fmt.Sprintf("1 MiB text message in %d byte fragments", size), echo(fragments(text, payloadOf('*', 1<<20), size)...))
+		}
+		for i, chunk := range []int{1 << 10, 64 << 10} {
+			add(fmt.Sprintf("9.4.%d", i+1), "limits", fmt.Sprintf("1 MiB binary message written in %d byte chunks", chunk), echo(chunked(msg(binary, payloadOf(0xfe, 1<<20)), chunk)))
+		}
+	}
+	if maxMessageSize > 0 {
+		add("9.5.1", "limits", "binary message one byte over the limit", conformanceCase{
+			frames: []testFrame{msg(binary, payloadOf(0xfe, maxMessageSize+1))},
+			fail:   true,
+			codes:  []status{statusTooBig},
+		})
+		add("9.5.2", "limits", "fragmented binary message growing over the limit", conformanceCase{
+			frames: fragments(binary, payloadOf(0xfe, maxMessageSize+(64<<10)), 64<<10),
+			fail:   true,
+			codes:  []status{statusTooBig},
+		})
+	}
+
+	return cases
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConformance(t *testing.T) {
+	s := &server{maxMessageSize: 1 << 20, crashOnPanic: true}
+	l := startServer(t, s)
+	url := "ws://" + l.Addr().String() + "/"
+
+	opts := &conformanceOptions{timeout: 10 * time.Second, failFastWait: 100 * time.Millisecond}
+	report := runConformance(context.Background(), url, conformanceCases(1<<20), opts)
+
+	for _, c := range report.Cases {
+		switch c.Outcome {
+		case outcomeFail:
+			t.Errorf("%s %s: %s", c.ID, c.Description, c.Reason)
+		case outcomeNonStrict:
+			t.Logf("%s %s is non-strict: %s", c.ID, c.Description, c.Reason)
+		}
+	}
+	if len(report.Cases) == 0 || report.Passed+report.NonStrict+report.Failed != len(report.Cases) {
+		t.Errorf("expected every case to be counted, got %+v", report)
+	}
+
+	var b bytes.Buffer
+	if err := report.writeJSON(&b); err != nil {
+		t.Fatal(err)
+	}
+	var decoded conformanceReport
+	if err := json.Unmarshal(b.Bytes(), &decoded); err != nil || len(decoded.Cases) != len(report.Cases) {
+		t.Errorf("expected the JSON report to hold every case, got %d %v", len(decoded.Cases), err)
+	}
+
+	b.Reset()
+	if err := report.writeHTML(&b); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(b.String(), `<td>7.9.1</td>`) {
+		t.Errorf("expected the HTML report to list the cases")
+	}
+}
+
+func TestConformanceFailures(t *testing.T) {
+	// A server that never answers fails every echo
+	s := &server{handler: discardHandler}
+	l := startServer(t, s)
+
+	opts := &conformanceOptions{timeout: 5 * time.Second, failFastWait: 100 * time.Millisecond}
+	report := runConformance(context.Background(), "ws://"+l.Addr().String()+"/", selectCases(conformanceCases(0), "1.1.2,2.7"), opts)
+
+	if len(report.Cases) != 2 {
+		t.Fatalf("expected 2 cases to be selected, got %d", len(report.Cases))
+	}
+	if c := report.Cases[0]; c.Outcome != outcomeFail || !strings.Contains(c.Reason, "expected 1 message(s) back, got 0") {
+		t.Errorf("expected the echo to fail, got %s %q", c.Outcome, c.Reason)
+	}
+	if c := report.Cases[1]; c.Outcome != outcomePass {
+		t.Errorf("expected an unsolicited pong to pass, got %s %q", c.Outcome, c.Reason)
+	}
+}
+
+// startHostileServer upgrades every connection and sends it frames with the
+// given headers, and no payload
+func startHostileServer(t *testing.T, headers ...header) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				r := bufio.NewReader(c)
+				req, err := readRequest(r, c)
+				if err != nil {
+					return
+				}
+				if _, err := upgradeRequest(context.Background(), c, req, nil); err != nil {
+					return
+				}
+				w := bufio.NewWriter(c)
+				for _, h := range headers {
+					h.write(w)
+				}
+				w.Flush()
+				io.Copy(io.Discard, r)
+			}()
+		}
+	}()
+	return "ws://" + l.Addr().String() + "/"
+}
+
+// oversizedHeaders each break another rule as well as claiming more than can
+// be allocated
+var oversizedHeaders = map[string]header{
+	"rsv":      {isFin: true, rsv: 1, op: text, length: 1 << 62},
+	"reserved": {isFin: true, op: 3, length: 1 << 62},
+	"control":  {op: ping, length: 1 << 62},
+}
+
+func TestOversizedFrames(t *testing.T) {
+	for name, h := range oversizedHeaders {
+		url := startHostileServer(t, h)
+
+		opts := &conformanceOptions{timeout: 2 * time.Second, failFastWait: 100 * time.Millisecond}
+		report := runConformance(context.Background(), url, selectCases(conformanceCases(0), "1.1.1"), opts)
+		if len(report.Cases) != 1 || report.Cases[0].Outcome != outcomeFail || !strings.Contains(report.Cases[0].Reason, "byte frame") {
+			t.Errorf("%s: expected the case to fail on the frame's size, got %+v", name, report.Cases)
+		}
+	}
+}
+
+func TestSelectCases(t *testing.T) {
+	cases := conformanceCases(0)
+	for only, want := range map[string]int{"": len(cases), "2.1": 1, "6.4": len(invalidUTF8), "6.4.,7.9": len(invalidUTF8) + 10, "8": 0} {
+		if got := len(selectCases(cases, only)); got != want {
+			t.Errorf("expected %q to select %d case(s), got %d", only, want, got)
+		}
+	}
+}
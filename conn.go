@@ -3,11 +3,24 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"math"
 	"net"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
 )
 
 type state uint8
@@ -41,96 +54,236 @@ type conn struct {
 	r         *bufio.Reader
 	state     state
     lastOp    *opCode
+    // req is the upgrade request the connection was opened with
+    req       *request
+    // subprotocol is the protocol agreed during the upgrade, if any
+    subprotocol string
+    handler   handler
+    // limits rate limits the connection, nil leaves it unlimited
+    limits    *connLimiter
+
+    // wh is the header used for writing, wmu serialises writes so that
+    // pings can be sent while the connection is being read. mmu serialises
+    // data messages, it's held across all of a message's frames so they
+    // aren't interleaved with another's, while wmu is only held per frame.
+    wh        *header
+    wmu       sync.Mutex
+    mmu       sync.Mutex
+    // done is closed when 'handle' returns
+    done      chan struct{}
+
+    // readTimeout and writeTimeout bound reading a frame and writing a
+    // message, zero disables them. They're durations stored atomically so
+    // they can be changed while the connection is in use.
+    readTimeout  atomic.Int64
+    writeTimeout atomic.Int64
+
+    // id uniquely identifies the connection in logs
+    id        uint64
+    log       *slog.Logger
+    // logPayloads includes payload content in debug logs, it's off by
+    // default as payloads may hold user data
+    logPayloads bool
+
+    pingMu    sync.Mutex
+    pingSent  time.Time
+    pingData  [8]byte
+
+    // opened is when the connection was upgraded
+    opened    time.Time
+    stats     connStats
+    // sendq holds messages queued by 'enqueue' until 'sendLoop' writes them
+    sendq     chan queuedMessage
+    // closeSent is set once a close frame has been sent, by either the
+    // reading goroutine or 'closeWith'
+    closeSent atomic.Bool
+    // closeDeadline is when 'closeWith' gives up on the peer answering, as
+    // unix nanoseconds, read deadlines are capped at it once it's set
+    closeDeadline atomic.Int64
+    // rdmu stops a read deadline worked out before 'closeWith' replacing
+    // the one it sets
+    rdmu      sync.Mutex
+
+    // ctx is cancelled when 'handle' returns, handlers can use it for calls
+    // that should stop when the connection closes
+    ctx       context.Context
+    cancel    context.CancelFunc
+    // client is set on connections we dialled, whose frames must be masked
+    client    bool
+    // incoming holds messages for 'readMessage' on dialled connections
+    incoming  chan queuedMessage
+    // onPong is called from the reading goroutine with each pong's payload
+    onPong    func(data []byte)
+
+    // peerClose is what the peer sent in its close frame
+    peerClose *CloseError
+    // err is why the connection ended, it's set before 'done' is closed
+    err       error
+    // crashOnPanic lets a panic while handling the connection take down the
+    // process instead of only closing the connection, so tests see it
+    crashOnPanic bool
 }
 
-func newConn(socket net.Conn) *conn {
+// connStats count a connection's traffic, they're atomic so they can be
+// read while the connection is in use
+type connStats struct {
+    messagesIn  atomic.Uint64
+    messagesOut atomic.Uint64
+    bytesIn     atomic.Uint64
+    bytesOut    atomic.Uint64
+    // rtt is the round trip time of the last answered ping
+    rtt         atomic.Int64
+}
+
+type queuedMessage struct {
+    op   opCode
+    data []byte
+}
+
+// sendQueueSize is how many messages can be queued for a connection before
+// more are dropped
+const sendQueueSize = 64
+
+// closeTimeout is how long to wait for the peer to answer a close frame sent
+// by 'closeWith'
+const closeTimeout = 5 * time.Second
+
+// newConn creates a connection reading from 'r', which may hold data that was
+// buffered while reading the upgrade request. A nil 'r' reads from 'socket'.
+// The connection's context is derived from 'ctx', cancelling it closes the
+// connection as going away.
+func newConn(ctx context.Context, socket net.Conn, r *bufio.Reader) *conn {
     var c conn = conn{}
     c.socket = socket
+    c.ctx, c.cancel = context.WithCancel(ctx)
     c.h = &header{}
-    c.r = bufio.NewReader(c.socket)
+    c.wh = &header{}
+    c.done = make(chan struct{})
+    c.r = r
+    if c.r == nil {
+        c.r = bufio.NewReader(c.socket)
+    }
     c.w = bufio.NewWriter(c.socket)
     c.p = newPayload()
     c.state = open
     c.lastOp = nil
+    c.handler = echoHandler
+    c.opened = time.Now()
+    c.sendq = make(chan queuedMessage, sendQueueSize)
+    c.id = newConnID()
+    c.log = slog.Default().With("conn_id", c.id, "remote_addr", socket.RemoteAddr().String())
 
     return &c
 }
 
-func (c *conn) handle() error {
+// handle reads from the connection until it closes, passing each message to
+// the handler. It returns why the connection ended, a *CloseError when it
+// closed normally.
+func (c *conn) handle() (err error) {
+	defer close(c.done)
+	defer c.cancel()
+	defer func() {
+		c.err = err
+	}()
+	defer c.recoverPanic(&err)
+
+	// Say we're going away if the context is cancelled while we're open,
+	// unless we cancelled it on the way out
+	stop := context.AfterFunc(c.ctx, func() {
+		select {
+		case <-c.done:
+		default:
+			c.closeWith(context.Background(), statusGoingAway, "")
+		}
+	})
+	defer stop()
+
 	for c.state == open {
+        c.setReadDeadline()
+
         // Read the header
 		if err := c.h.read(c.r); err != nil {
 			if err == io.EOF {
-				log.Printf("failed to read header, client disconnected\n")
+				c.log.Debug("failed to read header, client disconnected")
 				break
 			}
-			log.Printf("failed to read header: %v\n", err)
+			c.log.Info("failed to read header", "err", err)
 			break
 		}
 
         // If they're sending a fragmented frame and the op code is not
         // a contuation, we must fail the connection
-        if c.lastOp != nil && c.h.op != continuation {
-            if err := c.sendClose(statusProtoErr, false); err != nil {
-                return err
-            }
-            return nil
+        if c.lastOp != nil && c.h.op.isData() {
+            return c.fail(&ProtocolError{Kind: KindExpectedContinuation})
+        }
+        if c.lastOp == nil && c.h.op == continuation {
+            return c.fail(&ProtocolError{Kind: KindUnexpectedContinuation})
         }
 
         // Cannot have an RSV bit set, nor can the op-code be reserved
-		if c.h.rsv != 0x00 || c.h.op.isReserved() {
-			if err := c.sendClose(statusProtoErr, false); err != nil {
-				return err
-			}
-			return nil
+		if c.h.rsv != 0x00 {
+			return c.fail(&ProtocolError{Kind: KindReservedBits})
+		}
+		if c.h.op.isReserved() {
+			return c.fail(&ProtocolError{Kind: KindReservedOpcode})
 		}
 
+        // A control frame's payload may not exceed 125 bytes, nor may it be
+        // fragmented
+        if c.h.op.isControl() && c.h.length > 125 {
+            return c.fail(&ProtocolError{Kind: KindControlTooLong})
+        }
+        if c.h.op.isControl() && !c.h.isFin {
+            return c.fail(&ProtocolError{Kind: KindFragmentedControl})
+        }
+
+        // Clients must mask every frame and servers must not
+        if !c.client && !c.h.isMasked {
+            return c.fail(&ProtocolError{Kind: KindUnmaskedFrame})
+        }
+        if c.client && c.h.isMasked {
+            return c.fail(&ProtocolError{Kind: KindMaskedFrame})
+        }
+
         // The incoming length cannot be bigger than we have room for in the buffer
-		if int(c.h.length) > c.p.capacity() {
-			if err := c.sendClose(statusTooBig, false); err != nil {
-				return err
-			}
-			return nil
+		if c.h.length > uint64(c.p.capacity()) {
+			return c.fail(ErrMessageTooBig)
 		}
 
-		log.Printf("client frame isFin=%t, rsv=%08b fType=%08b (%s), isMasked=%t, payloadLen=%d, header.size()=%d\n", c.h.isFin, c.h.rsv, c.h.op, c.h.op, c.h.isMasked, c.h.length, c.h.size())
+		c.log.Debug("client frame", "fin", c.h.isFin, "rsv", c.h.rsv, "op", c.h.op, "masked", c.h.isMasked, "length", c.h.length, "header_size", c.h.size())
+
+		metrics.frames.with("in", c.h.op.String()).inc()
+		metrics.bytes.with("in", c.h.op.String()).add(c.h.length)
 
 		n, err := c.p.read(c.r, int(c.h.length))
 		if err != nil {
-			if err == io.EOF {
-				return nil
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
 			}
 			return err
 		}
 
-        log.Printf("payload after read frames=%d, last=%v\n", len(c.p.frames), c.p.last)
+        c.log.Debug("payload after read", "frames", len(c.p.frames), "payload", payloadValue{c.p.last.data, c.logPayloads})
 
 		if n != int(c.h.length) {
-			panic(fmt.Sprintf("have payload length of %d but only could only read %d byte(s)\n", c.h.length, n))
+			return fmt.Errorf("frame has a payload of %d byte(s) but only %d could be read", c.h.length, n)
 		}
 
         // If the last read frame is masked, unmask it
 		if c.h.isMasked {
-			for i := 0; i < int(c.h.length); i++ {
-				c.p.last.data[i] ^= c.h.mask[i%4]
-			}
+			unmask(c.p.last.data, c.h.mask)
 		}
 
 		if c.h.op.isControl() {
 			if err := c.handleControlFrame(); err != nil {
-				log.Printf("failed to handle control frame: %v\n", err)
-				if err := c.sendClose(statusProtoErr, true); err != nil {
-					return err
-				}
-				return nil
+				c.log.Info("failed to handle control frame", "err", err)
+				return c.fail(err)
 			}
 
-            // If we were in the middle of handling a fragmented payload when 
-            // the control frame came in, we need to pop the last frame from 
-            // payload in order to continue reading correctly.
-            if c.lastOp != nil {
-                c.p.pop() 
-            }
+            // The control frame isn't part of any message, so pop it from the
+            // payload. If we were in the middle of handling a fragmented payload
+            // when it came in, this leaves the fragments read so far in place.
+            c.p.pop()
 
 			continue
 		}
@@ -142,7 +295,7 @@ func (c *conn) handle() error {
             if c.lastOp == nil {
                 c.lastOp = &op
             }
-            log.Printf("received non-fin frame, continuing with read\n")
+            c.log.Debug("received non-fin frame, continuing with read")
             continue
 
         } else {
@@ -150,13 +303,41 @@ func (c *conn) handle() error {
                 c.h.op = *c.lastOp
             }
             c.lastOp = nil
-            log.Printf("fragmented read complete, payload=%v, op=%s\n", c.p.combine(), c.h.op)
+            c.log.Debug("fragmented read complete", "op", c.h.op, "length", c.p.length(), "payload", payloadValue{c.p.combine(), c.logPayloads})
         }
 
-        // Echo back the data
-        if err := c.send(false); err != nil {
-            log.Printf("failed to send echo: %v\n", err)
-            break
+        if c.h.op == text && !utf8.Valid(c.p.combine()) {
+            return c.fail(&ProtocolError{Kind: KindInvalidUTF8})
+        }
+
+        metrics.messageSize.with("in").observe(float64(c.p.length()))
+        c.stats.messagesIn.Add(1)
+        c.stats.bytesIn.Add(uint64(c.p.length()))
+
+        if c.limits != nil {
+            wait, ok := c.limits.received(time.Now(), c.p.length())
+            switch {
+            case !ok && c.limits.policy == limitClose:
+                metrics.rateLimited.with("in", "closed").inc()
+                c.log.Info("closing connection for exceeding its rate limit")
+                c.p.reset()
+                return c.fail(errRateLimited)
+            case !ok:
+                metrics.rateLimited.with("in", "dropped").inc()
+                c.log.Debug("dropped message over the rate limit", "length", c.p.length())
+                c.p.reset()
+                continue
+            case wait > 0:
+                // Not reading while we wait fills the socket's receive
+                // buffer, pushing back on the peer
+                metrics.rateLimited.with("in", "delayed").inc()
+                sleepContext(c.ctx, wait)
+            }
+        }
+
+        if err := c.handler(c, c.h.op, c.p.combine()); err != nil {
+            c.log.Warn("failed to handle message", "err", err)
+            return fmt.Errorf("handler: %w", err)
         }
 
         c.p.reset()
@@ -191,24 +372,84 @@ func (c *conn) handle() error {
         break
     }
 
-	return nil
+	return c.closeError()
 }
 
-func (c *conn) handleControlFrame() error {
-    // Control frame MUST NOT be fragmented
-    if !c.h.isFin {
-        return c.sendClose(statusProtoErr, false)
-    }
+// recoverPanic stops a panic in the handler, or in reading the connection,
+// from killing every other connection with it. The connection is closed with
+// statusUnexpected and 'err' is set to the panic.
+func (c *conn) recoverPanic(err *error) {
+	if c.crashOnPanic {
+		return
+	}
+	v := recover()
+	if v == nil {
+		return
+	}
+
+	metrics.panics.with("conn").inc()
+	c.log.Error("recovered from panic", "panic", v, "stack", string(debug.Stack()))
+
+	if e := c.sendClose(statusUnexpected, false); e != nil {
+		c.log.Debug("failed to send close", "err", e)
+	}
+	*err = fmt.Errorf("panic: %v", v)
+}
+
+// fail closes the connection because the peer broke the rules, with the
+// status matching 'err'. It returns 'err'.
+func (c *conn) fail(err error) error {
+	if status, ok := closeStatus(err); ok {
+		if err := c.sendClose(status, false); err != nil {
+			c.log.Debug("failed to send close", "err", err)
+		}
+	}
+	return err
+}
+
+// closeError describes how the connection closed once reading has stopped
+func (c *conn) closeError() *CloseError {
+	if c.peerClose == nil {
+		return &CloseError{Code: statusAbnormal}
+	}
+	e := *c.peerClose
+	e.Clean = c.closeSent.Load()
+	return &e
+}
 
+func (c *conn) handleControlFrame() error {
 	switch c.h.op {
 	case ping:
 		c.h.op = pong
 	case pong:
-		c.h.op = ping
+		// Pongs are either a response to our keep-alive ping or unsolicited,
+		// neither need a response
+		c.receivedPong(c.p.last.data)
+		if c.onPong != nil {
+			c.onPong(c.p.last.data)
+		}
+		return nil
 	case connclose:
+		var data []byte
+		if c.p.last != nil {
+			data = c.p.last.data
+		}
+		pc, err := parseClosePayload(data)
+		if err != nil {
+			metrics.closeCodes.with("in", "invalid").inc()
+			return err
+		}
+		code := "none"
+		if pc.Code != statusNoStatus {
+			code = strconv.Itoa(int(pc.Code))
+		}
+		metrics.closeCodes.with("in", code).inc()
+		c.peerClose = pc
+
 		// If we're 'closing' and we've recevied a close frame, we know it's from the peer,
-		// responding to our initiated close handshake.
-		if c.state == closing {
+		// responding to our initiated close handshake. The same goes for a close
+		// sent by 'closeWith', which doesn't change the state.
+		if c.state == closing || (c.state == open && c.closeSent.Load()) {
 			c.state = closed
 			return nil
 		}
@@ -228,7 +469,10 @@ func (c *conn) handleControlFrame() error {
 }
 
 func (c *conn) sendClose(status status, text bool) error {
-	c.h.op = connclose
+	reason := ""
+	if text {
+		reason = status.String()
+	}
 
 	// If the connection was open and we're now sending a close it means
 	// we've started the close handshake, else the peer has started the close
@@ -239,119 +483,487 @@ func (c *conn) sendClose(status status, text bool) error {
 		c.state = closed
 	}
 
-    f, err := c.p.reserve(2)
-    if err != nil {
-        return err
-    }
+	// 'closeWith' may have already sent one
+	if c.closeSent.Swap(true) {
+		return nil
+	}
 
-	b := bytes.NewBuffer(f.data)
-	b.Reset()
+	metrics.closeCodes.with("out", strconv.Itoa(int(status))).inc()
 
-	for i := 16 - 8; i >= 0; i -= 8 {
-		if err := b.WriteByte(byte(status >> i)); err != nil {
-			return err
-		}
+	// The close is sent even if we're closing because the context was
+	// cancelled
+	return c.writeFrames(context.WithoutCancel(c.ctx), connclose, closePayload(status, reason))
+}
+
+// closeWith starts the close handshake with 'code' and 'reason', it's safe to
+// call from any goroutine. The reading goroutine finishes the handshake when
+// the peer answers, or gives up after closeTimeout.
+func (c *conn) closeWith(ctx context.Context, code status, reason string) error {
+	if c.closeSent.Swap(true) {
+		return fmt.Errorf("connection %d is already closing", c.id)
 	}
 
-    // TODO: Disabling text for now
-	//if text {
-	//	if _, err := b.WriteString(status.String()); err != nil {
-	//		return err
-	//	}
-	//}
+	metrics.closeCodes.with("out", strconv.Itoa(int(code))).inc()
+	if err := c.writeFrames(ctx, connclose, closePayload(code, reason)); err != nil {
+		return err
+	}
 
-	c.h.length = uint64(b.Len())
+	c.closeDeadline.Store(time.Now().Add(closeTimeout).UnixNano())
+	c.setReadDeadline()
+	return nil
+}
 
-	if err := c.send(true); err != nil {
-        return err
-    }
+// setReadDeadline bounds the next read by 'readDeadline'
+func (c *conn) setReadDeadline() {
+	c.rdmu.Lock()
+	defer c.rdmu.Unlock()
+	c.socket.SetReadDeadline(c.readDeadline())
+}
+
+// readDeadline bounds the next read by the read timeout, or by the close
+// deadline if that's sooner. It's zero when neither applies.
+func (c *conn) readDeadline() time.Time {
+	var deadline time.Time
+	if d := time.Duration(c.readTimeout.Load()); d > 0 {
+		deadline = time.Now().Add(d)
+	}
+	if cd := c.closeDeadline.Load(); cd != 0 {
+		if dl := time.Unix(0, cd); deadline.IsZero() || dl.Before(deadline) {
+			deadline = dl
+		}
+	}
+	return deadline
+}
+
+// parseClosePayload decodes a close frame's payload
+func parseClosePayload(data []byte) (*CloseError, error) {
+	switch {
+	case len(data) == 0:
+		return &CloseError{Code: statusNoStatus}, nil
+	case len(data) == 1:
+		return nil, &ProtocolError{Kind: KindInvalidClosePayload}
+	}
 
-    //c.state = closed
-    return nil
+	code := status(data[0])<<8 | status(data[1])
+	if !validCloseCode(code) {
+		return nil, &ProtocolError{Kind: KindInvalidCloseCode}
+	}
+	if !utf8.Valid(data[2:]) {
+		return nil, &ProtocolError{Kind: KindInvalidUTF8}
+	}
+	return &CloseError{Code: code, Reason: string(data[2:])}, nil
+}
+
+// closePayload encodes a close frame's payload, 'reason' is cut short to fit
+// in a control frame without splitting a UTF-8 sequence
+func closePayload(code status, reason string) []byte {
+	b := []byte{byte(code >> 8), byte(code)}
+	for _, r := range reason {
+		if len(b)+utf8.RuneLen(r) > 125 {
+			break
+		}
+		b = utf8.AppendRune(b, r)
+	}
+	return b
 }
 
 // send will write the combined frames currently in payload or just the last frame
 func (c *conn) send(last bool) error {
-	// TODO: We're assuming here that we're always the server and thus we never mask
-	c.h.isFin = false
-	c.h.isMasked = false
+    payloadToSend := c.p.combine()
+    if last {
+        if c.p.last == nil {
+            if c.h.length > 0 {
+                return fmt.Errorf("last frame write was requested but last frame is nil")
+            }
+            payloadToSend = nil
+        } else {
+            payloadToSend = c.p.last.data
+        }
+    }
+
+    return c.writeFrames(c.ctx, c.h.op, payloadToSend)
+}
+
+// writeMessage sends 'data' to the peer as a message of type 'op', giving up
+// when 'ctx' is done
+func (c *conn) writeMessage(ctx context.Context, op opCode, data []byte) error {
+	return c.writeFrames(ctx, op, data)
+}
 
+// writeFrames writes 'payloadToSend' as a message of type 'op', splitting it
+// in to as many frames as the write buffer requires. It's safe to call from
+// multiple goroutines. Cancelling 'ctx' part way through a message leaves the
+// connection unusable, as the peer can't tell where the next frame starts.
+func (c *conn) writeFrames(ctx context.Context, op opCode, payloadToSend []byte) error {
 	// A control frame's payload may not exceed 125 bytes
-	if c.h.op.isControl() && c.h.length > 125 {
-		return c.sendClose(statusProtoErr, true)
+	if op.isControl() && len(payloadToSend) > 125 {
+		return fmt.Errorf("control frame payload of %d byte(s) exceeds 125 bytes", len(payloadToSend))
+	}
+	if err := ctx.Err(); err != nil {
+		return err
 	}
 
-	// Control frames must always be sent in 1 frame
-	if c.h.op.isControl() {
-		c.h.isFin = true
+	// Control frames can go out between the frames of a message, so they
+	// don't wait behind one that's being shaped
+	if !op.isControl() {
+		c.mmu.Lock()
+		defer c.mmu.Unlock()
 	}
 
-	// If there's no payload, we still need to repsond with empty
-	if c.h.length == 0 {
-		c.h.isFin = true
-		if err := c.h.write(c.w); err != nil {
-			return err
-		}
+	// Fail a write that's blocked when the context is cancelled
+	stop := context.AfterFunc(ctx, func() {
+		c.socket.SetWriteDeadline(aLongTimeAgo)
+	})
+	defer stop()
 
-		if err := c.w.Flush(); err != nil {
-			return err
-		}
+	if err := c.writeMessageFrames(ctx, op, payloadToSend); err != nil {
+		return contextErr(ctx, err)
+	}
+	return nil
+}
 
-		return nil
+// setWriteDeadline bounds the next write by the write timeout or 'ctx's
+// deadline, whichever is sooner
+func (c *conn) setWriteDeadline(ctx context.Context) {
+	var deadline time.Time
+	if d := time.Duration(c.writeTimeout.Load()); d > 0 {
+		deadline = time.Now().Add(d)
+	}
+	if dl, ok := ctx.Deadline(); ok && (deadline.IsZero() || dl.Before(deadline)) {
+		deadline = dl
 	}
+	c.socket.SetWriteDeadline(deadline)
+}
 
-    if last && c.p.last == nil {
-        return fmt.Errorf("last frame write was requested but last frame is nil")
-    }
+// writeMessageFrames does the work of 'writeFrames', the caller must hold mmu
+// for data messages
+func (c *conn) writeMessageFrames(ctx context.Context, op opCode, payloadToSend []byte) error {
+	if !op.isControl() {
+		metrics.messageSize.with("out").observe(float64(len(payloadToSend)))
+		c.stats.messagesOut.Add(1)
+		c.stats.bytesOut.Add(uint64(len(payloadToSend)))
+	}
 
-    payloadToSend := c.p.combine()
-    if last {
-        payloadToSend = c.p.last.data
-    } 
+	// If there's no payload, we still need to repsond with empty, and
+	// control frames must always be sent in 1 frame
+	if len(payloadToSend) == 0 || op.isControl() {
+		return c.writeFrame(ctx, op, true, payloadToSend)
+	}
 
-    log.Printf("payload=%v, len=%d\n", payloadToSend, len(payloadToSend))
+    c.log.Debug("sending payload", "length", len(payloadToSend), "payload", payloadValue{payloadToSend, c.logPayloads})
 
+	// Leave room for the largest header the message's frames need
+	h := header{length: uint64(len(payloadToSend)), isMasked: c.client}
 	frame := 0
 	payloadBytesToWrite := uint64(len(payloadToSend))
-	maxPayloadBytesPerFrame := uint64(c.w.Size()) - c.h.size()
+	maxPayloadBytesPerFrame := uint64(c.w.Size()) - h.size()
 	payloadByteOffset := 0
 
-	log.Printf("starting to write frames payloadLen=%d, capacity=%d, maxPayloadBytesPerFrame=%d\n", payloadBytesToWrite, c.w.Size(), maxPayloadBytesPerFrame)
+	c.log.Debug("starting to write frames", "length", payloadBytesToWrite, "capacity", c.w.Size(), "max_frame_payload", maxPayloadBytesPerFrame)
 
 	for payloadBytesToWrite > 0 {
 		totalPayloadBytesThisFrame := uint64(math.Min(float64(payloadBytesToWrite), float64(maxPayloadBytesPerFrame)))
-		c.h.length = totalPayloadBytesThisFrame
 
 		// If we're not on the first frame, we must set the 'continuation' op code
+		frameOp := op
 		if payloadByteOffset > 0 {
-			c.h.op = continuation
+			frameOp = continuation
 		}
 
 		// If we're on the last frame, set 'fin'
-		if payloadBytesToWrite < maxPayloadBytesPerFrame {
-			c.h.isFin = true
+		fin := payloadBytesToWrite <= maxPayloadBytesPerFrame
+
+		// Shape each frame rather than the whole message so large messages
+		// are sent at an even rate. The wait is outside wmu so control
+		// frames aren't held up by it.
+		if c.limits != nil {
+			if wait := c.limits.sending(time.Now(), int(totalPayloadBytesThisFrame)); wait > 0 {
+				metrics.rateLimited.with("out", "delayed").inc()
+				if err := sleepContext(ctx, wait); err != nil {
+					return err
+				}
+			}
 		}
 
-		if err := c.h.write(c.w); err != nil {
+		framePayload := payloadToSend[payloadByteOffset : payloadByteOffset+int(totalPayloadBytesThisFrame)]
+		if err := c.writeFrame(ctx, frameOp, fin, framePayload); err != nil {
 			return err
 		}
 
-		n, err := c.w.Write(payloadToSend[payloadByteOffset : payloadByteOffset+int(totalPayloadBytesThisFrame)])
-		if err != nil {
-			return err
+		payloadBytesToWrite -= totalPayloadBytesThisFrame
+		payloadByteOffset += int(totalPayloadBytesThisFrame)
+
+		c.log.Debug("sent frame", "frame", frame+1, "length", totalPayloadBytesThisFrame, "fin", fin, "op", frameOp)
+
+		frame++
+	}
+
+	return nil
+}
+
+// writeFrame writes and flushes a single frame, holding wmu while it does
+func (c *conn) writeFrame(ctx context.Context, op opCode, fin bool, data []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	c.setWriteDeadline(ctx)
+
+	c.wh.op = op
+	c.wh.isFin = fin
+	c.wh.isMasked = c.client
+	c.wh.length = uint64(len(data))
+
+	// Clients mask every frame with a fresh key
+	if c.client {
+		if c.wh.mask == nil {
+			c.wh.mask = make([]byte, 4)
 		}
+		rand.Read(c.wh.mask)
+		masked := make([]byte, len(data))
+		for i := range data {
+			masked[i] = data[i] ^ c.wh.mask[i%4]
+		}
+		data = masked
+	}
 
-		payloadBytesToWrite -= uint64(n)
-		payloadByteOffset += n
+	metrics.frames.with("out", op.String()).inc()
+	metrics.bytes.with("out", op.String()).add(c.wh.length)
 
-		log.Printf("sending frame #%d of %d byte(s), header.length=%d, isFin=%t, finRsvOp=%08b (%s)\n", frame+1, n, c.h.length, c.h.isFin, c.h.op, c.h.op)
+	if err := c.wh.write(c.w); err != nil {
+		return err
+	}
+	if _, err := c.w.Write(data); err != nil {
+		return err
+	}
+	return c.w.Flush()
+}
 
-		if err := c.w.Flush(); err != nil {
-			return err
+// setTimeouts changes the read and write timeouts, taking effect from the next
+// frame read or message written
+func (c *conn) setTimeouts(read, write time.Duration) {
+	c.readTimeout.Store(int64(read))
+	c.writeTimeout.Store(int64(write))
+
+	// A read that's already waiting has its deadline set from the old
+	// timeout, so move it
+	c.setReadDeadline()
+}
+
+// tlsState returns the TLS connection state of the peer, or nil when the
+// connection isn't using TLS
+func (c *conn) tlsState() *tls.ConnectionState {
+	tc, ok := c.socket.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	state := tc.ConnectionState()
+	return &state
+}
+
+// peerCertificates returns the verified certificate chains presented by the
+// peer, the first certificate of each chain is the peer's own
+func (c *conn) peerCertificates() [][]*x509.Certificate {
+	state := c.tlsState()
+	if state == nil {
+		return nil
+	}
+	return state.VerifiedChains
+}
+
+// peerSubject returns the subject of the peer's verified certificate
+func (c *conn) peerSubject() (pkix.Name, bool) {
+	chains := c.peerCertificates()
+	if len(chains) == 0 {
+		return pkix.Name{}, false
+	}
+	return chains[0][0].Subject, true
+}
+
+// remoteAddr returns the client's address. Behind a proxy this is the
+// address it forwarded for rather than the proxy's own.
+func (c *conn) remoteAddr() net.Addr {
+	if c.req != nil && c.req.clientAddr != nil {
+		return c.req.clientAddr
+	}
+	return c.socket.RemoteAddr()
+}
+
+// identity returns who the peer was authenticated as during the upgrade
+func (c *conn) identity() *identity {
+	if c.req == nil {
+		return nil
+	}
+	return c.req.identity
+}
+
+// param returns the named path parameter of the route the connection matched
+func (c *conn) param(name string) string {
+	if c.req == nil {
+		return ""
+	}
+	return c.req.params[name]
+}
+
+// query returns the first value of the named query parameter of the upgrade
+// request
+func (c *conn) query(name string) string {
+	if c.req == nil {
+		return ""
+	}
+	return c.req.query.Get(name)
+}
+
+// ping sends a ping carrying the time it was sent, the round trip time is
+// recorded when the matching pong arrives
+func (c *conn) ping() error {
+	now := time.Now()
+
+	c.pingMu.Lock()
+	c.pingSent = now
+	for i := range c.pingData {
+		c.pingData[i] = byte(now.UnixNano() >> (56 - 8*i))
+	}
+	data := c.pingData
+	c.pingMu.Unlock()
+
+	return c.writeFrames(c.ctx, ping, data[:])
+}
+
+// receivedPong records the round trip time if 'data' answers our last ping
+func (c *conn) receivedPong(data []byte) {
+	c.pingMu.Lock()
+	defer c.pingMu.Unlock()
+
+	if c.pingSent.IsZero() || !bytes.Equal(data, c.pingData[:]) {
+		return
+	}
+
+	rtt := time.Since(c.pingSent)
+	metrics.pingRTT.with().observe(rtt.Seconds())
+	c.stats.rtt.Store(int64(rtt))
+	c.pingSent = time.Time{}
+}
+
+// keepAlive pings the peer every 'interval' until the connection is done
+func (c *conn) keepAlive(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-t.C:
+			if err := c.ping(); err != nil {
+				c.log.Info("failed to send keep-alive ping", "err", err)
+				return
+			}
 		}
+	}
+}
 
-		frame++
+// enqueue queues a message to be sent by 'sendLoop' without waiting for it,
+// it reports false and drops the message when the queue is full
+func (c *conn) enqueue(op opCode, data []byte) bool {
+	select {
+	case c.sendq <- queuedMessage{op, data}:
+		return true
+	default:
+		metrics.sendQueueDrops.with().inc()
+		return false
 	}
+}
 
-	return nil
+// sendLoop writes queued messages until the connection is done
+func (c *conn) sendLoop() {
+	for {
+		select {
+		case <-c.done:
+			return
+		case m := <-c.sendq:
+			if err := c.writeMessage(c.ctx, m.op, m.data); err != nil {
+				c.log.Info("failed to send queued message", "err", err)
+				return
+			}
+		}
+	}
+}
+
+// context returns the connection's context, which is cancelled once the
+// connection has closed
+func (c *conn) context() context.Context {
+	return c.ctx
+}
+
+// deliver is the handler of dialled connections, it passes each message on
+// to 'readMessage'
+func deliver(c *conn, op opCode, data []byte) error {
+	// The data is only valid until we return
+	m := queuedMessage{op, bytes.Clone(data)}
+	select {
+	case c.incoming <- m:
+		return nil
+	case <-c.ctx.Done():
+		return c.ctx.Err()
+	}
+}
+
+// readMessage returns the next message received on a dialled connection,
+// giving up when 'ctx' is done
+func (c *conn) readMessage(ctx context.Context) (opCode, []byte, error) {
+	if c.incoming == nil {
+		return 0, nil, fmt.Errorf("connection %d is served by a handler", c.id)
+	}
+
+	// Prefer a message that's already arrived over reporting the close
+	select {
+	case m := <-c.incoming:
+		return m.op, m.data, nil
+	default:
+	}
+
+	select {
+	case m := <-c.incoming:
+		return m.op, m.data, nil
+	case <-c.done:
+		return 0, nil, c.err
+	case <-ctx.Done():
+		return 0, nil, ctx.Err()
+	}
+}
+
+// unmask xors 'data' in place with a frame's 4 byte 'mask'
+func unmask(data, mask []byte) {
+	for i := range data {
+		data[i] ^= mask[i%4]
+	}
+}
+
+// aLongTimeAgo is a deadline in the past, setting it fails blocked reads and
+// writes straight away
+var aLongTimeAgo = time.Unix(1, 0)
+
+// sleepContext sleeps for 'd' or until 'ctx' is done
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// contextErr returns the context's error in place of 'err' when the context
+// is what caused it, including when a deadline taken from the context passed
+func contextErr(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if dl, ok := ctx.Deadline(); ok && errors.Is(err, os.ErrDeadlineExceeded) && !time.Now().Before(dl) {
+		return context.DeadlineExceeded
+	}
+	return err
 }
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCloseDeadline(t *testing.T) {
+	client, srv := net.Pipe()
+	defer client.Close()
+
+	c := newConn(context.Background(), srv, nil)
+	c.readTimeout.Store(int64(time.Hour))
+	if dl := c.readDeadline(); time.Until(dl) < 59*time.Minute {
+		t.Errorf("expected the read timeout before closing, got %v", time.Until(dl))
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		err := c.handle()
+		srv.Close()
+		done <- err
+	}()
+	go func() {
+		// Drain the echoes and our close, which are never answered
+		r := bufio.NewReader(client)
+		for {
+			if _, _, err := readFrame(r); err != nil {
+				return
+			}
+		}
+	}()
+
+	if err := c.closeWith(context.Background(), statusNormal, ""); err != nil {
+		t.Fatal(err)
+	}
+	if dl := c.readDeadline(); time.Until(dl) > closeTimeout {
+		t.Errorf("expected the close deadline to cap reads, got %v", time.Until(dl))
+	}
+	c.setTimeouts(0, 0)
+	if dl := c.readDeadline(); dl.IsZero() {
+		t.Errorf("expected the close deadline to remain without a read timeout")
+	}
+
+	// Bring the close deadline in rather than waiting for closeTimeout, then
+	// keep sending frames and reload the timeouts while the close is waiting
+	c.closeDeadline.Store(time.Now().Add(200 * time.Millisecond).UnixNano())
+	c.setTimeouts(time.Hour, 0)
+	timeout := time.After(5 * time.Second)
+	for i := 0; ; i++ {
+		select {
+		case <-done:
+			return
+		case <-timeout:
+			t.Fatal("expected the connection to give up once the close deadline passed")
+		case <-time.After(20 * time.Millisecond):
+			writeFrame(client, true, text, []byte("still here"))
+			if i == 5 {
+				c.setTimeouts(time.Hour, 0)
+			}
+		}
+	}
+}
+
+// benchSizes are message sizes either side of the write buffer and the
+// length encodings
+var benchSizes = []int{16, 125, 1 << 10, 4 << 10, 64 << 10, 1 << 20}
+
+// sizeName names a benchmark after a size in bytes
+func sizeName(n int) string {
+	switch {
+	case n >= 1<<20 && n%(1<<20) == 0:
+		return fmt.Sprintf("%dMiB", n>>20)
+	case n >= 1<<10 && n%(1<<10) == 0:
+		return fmt.Sprintf("%dKiB", n>>10)
+	}
+	return fmt.Sprintf("%dB", n)
+}
+
+func BenchmarkUnmask(b *testing.B) {
+	mask := []byte{0x12, 0x34, 0x56, 0x78}
+	for _, size := range benchSizes {
+		b.Run(sizeName(size), func(b *testing.B) {
+			data := make([]byte, size)
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				unmask(data, mask)
+			}
+		})
+	}
+}
+
+// discardConn is a connection whose writes always succeed without going
+// anywhere
+type discardConn struct {
+	net.Conn
+}
+
+func (discardConn) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func BenchmarkSend(b *testing.B) {
+	for _, client := range []bool{false, true} {
+		side := "server"
+		if client {
+			side = "client"
+		}
+		for _, size := range benchSizes {
+			b.Run(side+"/"+sizeName(size), func(b *testing.B) {
+				p1, p2 := net.Pipe()
+				defer p1.Close()
+				defer p2.Close()
+
+				c := newConn(context.Background(), discardConn{p1}, nil)
+				defer c.cancel()
+				c.client = client
+				c.p = newPayloadSize(size)
+				if _, err := c.p.reserve(size); err != nil {
+					b.Fatal(err)
+				}
+				c.h.op = binary
+				c.h.length = uint64(size)
+
+				b.SetBytes(int64(size))
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if err := c.send(true); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// connectHelp lists the commands understood by a session, any other line is
+// sent as a text message
+const connectHelp = `commands:
+  --text TEXT          send TEXT, for text starting with --
+  --binary HEX         send the hex encoded bytes as a binary message
+  --file PATH          send the file as a binary message
+  --ping [PAYLOAD]     send a ping, the pong is printed with the round trip time
+  --close [CODE [REASON]]
+                       start the close handshake, CODE defaults to 1000
+  --help               show this help`
+
+// maxLineSize is the longest line read from stdin
+const maxLineSize = 16 << 20
+
+// session is an interactive connection, lines are read in and sent, and
+// whatever the server sends is printed with the time it arrived
+type session struct {
+	c *conn
+
+	mu       sync.Mutex
+	out      io.Writer
+	pingSent time.Time
+	pingData []byte
+}
+
+// printf writes a timestamped line, it's safe to call from any goroutine
+func (s *session) printf(format string, args ...any) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fmt.Fprintf(s.out, "%s %s\n", time.Now().Format("15:04:05.000"), fmt.Sprintf(format, args...))
+}
+
+// run sends the lines read from 'in' until the connection closes, starting
+// the close handshake when 'in' ends or 'ctx' is done. It returns the exit
+// status.
+func (s *session) run(ctx context.Context, in io.Reader) int {
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		sc := bufio.NewScanner(in)
+		sc.Buffer(make([]byte, 64<<10), maxLineSize)
+		for sc.Scan() {
+			select {
+			case lines <- sc.Text():
+			case <-s.c.context().Done():
+				return
+			}
+		}
+	}()
+
+	received := make(chan error, 1)
+	go func() {
+		for {
+			op, data, err := s.c.readMessage(context.Background())
+			if err != nil {
+				received <- err
+				return
+			}
+			s.printMessage(op, data)
+		}
+	}()
+
+	done := ctx.Done()
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				lines = nil
+				s.close(statusNormal, "")
+				continue
+			}
+			if err := s.command(ctx, line); err != nil {
+				s.printf("! %v", err)
+			}
+		case <-done:
+			done = nil
+			lines = nil
+			s.close(statusNormal, "")
+		case err := <-received:
+			return s.closed(err)
+		}
+	}
+}
+
+// close starts the close handshake unless it's already started
+func (s *session) close(code status, reason string) {
+	if s.c.closeSent.Load() {
+		return
+	}
+	if err := s.c.closeWith(context.Background(), code, reason); err != nil {
+		s.printf("! %v", err)
+	}
+}
+
+// closed reports why the connection ended
+func (s *session) closed(err error) int {
+	var ce *CloseError
+	if !errors.As(err, &ce) {
+		s.printf("connection failed: %v", err)
+		return 1
+	}
+	if ce.Reason != "" {
+		s.printf("closed with %d (%s): %s", ce.Code, ce.Code, ce.Reason)
+	} else {
+		s.printf("closed with %d (%s)", ce.Code, ce.Code)
+	}
+	return 0
+}
+
+// command sends 'line' as a text message, or runs it if it's a command
+func (s *session) command(ctx context.Context, line string) error {
+	if !strings.HasPrefix(line, "--") {
+		return s.c.writeMessage(ctx, text, []byte(line))
+	}
+
+	name, arg, _ := strings.Cut(line[2:], " ")
+	switch name {
+	case "text":
+		return s.c.writeMessage(ctx, text, []byte(arg))
+	case "binary":
+		data, err := hex.DecodeString(strings.ReplaceAll(arg, " ", ""))
+		if err != nil {
+			return fmt.Errorf("invalid hex: %w", err)
+		}
+		return s.c.writeMessage(ctx, binary, data)
+	case "file":
+		data, err := os.ReadFile(arg)
+		if err != nil {
+			return err
+		}
+		return s.c.writeMessage(ctx, binary, data)
+	case "ping":
+		data := []byte(arg)
+		if len(data) > 125 {
+			return fmt.Errorf("ping payload is %d bytes, control frames are limited to 125", len(data))
+		}
+		s.mu.Lock()
+		s.pingSent = time.Now()
+		s.pingData = data
+		s.mu.Unlock()
+		return s.c.writeFrames(ctx, ping, data)
+	case "close":
+		code, reason, err := parseCloseCommand(arg)
+		if err != nil {
+			return err
+		}
+		if s.c.closeSent.Load() {
+			return errors.New("already closing")
+		}
+		return s.c.closeWith(ctx, code, reason)
+	case "help":
+		s.mu.Lock()
+		fmt.Fprintln(s.out, connectHelp)
+		s.mu.Unlock()
+		return nil
+	}
+	return fmt.Errorf("unknown command --%s, try --help", name)
+}
+
+// parseCloseCommand parses the "[CODE [REASON]]" argument of --close
+func parseCloseCommand(arg string) (status, string, error) {
+	arg = strings.TrimSpace(arg)
+	if arg == "" {
+		return statusNormal, "", nil
+	}
+
+	codeText, reason, _ := strings.Cut(arg, " ")
+	n, err := strconv.ParseUint(codeText, 10, 16)
+	if err != nil || !validCloseCode(status(n)) {
+		return 0, "", fmt.Errorf("%s isn't a close code that can be sent", codeText)
+	}
+	if len(reason) > 123 {
+		return 0, "", fmt.Errorf("close reason is %d bytes, it's limited to 123", len(reason))
+	}
+	return status(n), strings.TrimSpace(reason), nil
+}
+
+// printMessage prints a received message, binary messages as hex
+func (s *session) printMessage(op opCode, data []byte) {
+	if op == text {
+		s.printf("< %s", data)
+		return
+	}
+	s.printf("< binary (%d bytes) %s", len(data), hex.EncodeToString(data))
+}
+
+// pong prints a received pong, with the round trip time if it answers our
+// last ping
+func (s *session) pong(data []byte) {
+	s.mu.Lock()
+	var rtt time.Duration
+	if !s.pingSent.IsZero() && bytes.Equal(data, s.pingData) {
+		rtt = time.Since(s.pingSent)
+		s.pingSent = time.Time{}
+	}
+	s.mu.Unlock()
+
+	if rtt == 0 {
+		s.printf("< pong %q (unsolicited)", data)
+		return
+	}
+	s.printf("< pong %q (%s)", data, rtt.Round(time.Microsecond))
+}
+
+// headerFlag is a repeatable flag adding "Name: value" headers
+type headerFlag http.Header
+
+func (h headerFlag) String() string {
+	return ""
+}
+
+func (h headerFlag) Set(v string) error {
+	name, value, ok := strings.Cut(v, ":")
+	if name = strings.TrimSpace(name); !ok || name == "" {
+		return fmt.Errorf(`expected "Name: value", got %q`, v)
+	}
+	http.Header(h).Add(name, strings.TrimSpace(value))
+	return nil
+}
+
+// clientTLSConfig builds the TLS config for wss:// URLs from the connect
+// flags, it's nil when none are given
+func clientTLSConfig(insecure bool, caFile, certFile, keyFile, serverName string) (*tls.Config, error) {
+	if !insecure && caFile == "" && certFile == "" && keyFile == "" && serverName == "" {
+		return nil, nil
+	}
+
+	cfg := &tls.Config{InsecureSkipVerify: insecure, ServerName: serverName}
+	if caFile != "" {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return nil, errors.New("a client certificate needs both -cert and -key")
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load key pair: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// connectCommand connects to a server and sends it the lines read from
+// stdin, printing whatever it sends back
+func connectCommand(args []string) int {
+	fs := flag.NewFlagSet("connect", flag.ContinueOnError)
+	header := http.Header{}
+	fs.Var(headerFlag(header), "H", `header to send with the upgrade request, as "Name: value" (can be repeated)`)
+	var subprotocols stringList
+	fs.Var(&subprotocols, "subprotocols", "comma separated subprotocols to offer, in order of preference")
+	insecure := fs.Bool("insecure", false, "don't verify the server's certificate for wss:// URLs")
+	caFile := fs.String("ca", "", "PEM bundle of CAs to verify the server's certificate with (default the system's)")
+	certFile := fs.String("cert", "", "client certificate to present, with -key")
+	keyFile := fs.String("key", "", "private key of the client certificate")
+	serverName := fs.String("server-name", "", "name to verify the server's certificate against (default the URL's host)")
+	maxMessageSize := fs.Int("max-message-size", 0, "largest message to accept (default the payload size)")
+	timeout := fs.Duration("timeout", 10*time.Second, "time to connect and upgrade")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: ws connect [flags] ws://host:port/path\n\nlines read from stdin are sent as text messages, or run if they're commands")
+		fs.PrintDefaults()
+		fmt.Fprintln(fs.Output(), "\n"+connectHelp)
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	tlsConfig, err := clientTLSConfig(*insecure, *caFile, *certFile, *keyFile, *serverName)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	s := &session{out: os.Stdout}
+	opts := &dialOptions{
+		tlsConfig:      tlsConfig,
+		header:         header,
+		subprotocols:   subprotocols,
+		maxMessageSize: *maxMessageSize,
+		onPong:         s.pong,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	dialCtx, cancel := context.WithTimeout(ctx, *timeout)
+	c, _, err := dial(dialCtx, fs.Arg(0), opts)
+	cancel()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "failed to connect:", err)
+		return 1
+	}
+	s.c = c
+
+	if c.subprotocol != "" {
+		s.printf("connected to %s with subprotocol %s", fs.Arg(0), c.subprotocol)
+	} else {
+		s.printf("connected to %s", fs.Arg(0))
+	}
+	return s.run(ctx, os.Stdin)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSession(t *testing.T) {
+	l := startServer(t, &server{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var out syncBuffer
+	s := &session{out: &out}
+	c, _, err := dial(ctx, "ws://"+l.Addr().String()+"/", &dialOptions{onPong: s.pong})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.c = c
+
+	in := strings.Join([]string{
+		"hello",
+		"--text --not a command",
+		"--binary 00 ff",
+		"--ping abc",
+		"--binary xyz",
+		"--close 1005",
+		"--nope",
+		"--close 1000 bye",
+	}, "\n")
+	if code := s.run(ctx, strings.NewReader(in)); code != 0 {
+		t.Errorf("expected a clean close to exit with 0, got %d", code)
+	}
+
+	got := out.String()
+	for _, want := range []string{
+		"< hello\n",
+		"< --not a command\n",
+		"< binary (2 bytes) 00ff\n",
+		`< pong "abc" (`,
+		"! invalid hex",
+		"! 1005 isn't a close code that can be sent",
+		"! unknown command --nope",
+		"closed with 1000 (normal)\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("expected output to contain %q, got:\n%s", want, got)
+		}
+	}
+}
+
+func TestHeaderFlag(t *testing.T) {
+	h := http.Header{}
+	f := headerFlag(h)
+	if err := f.Set("Origin: http://example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Set("X-Empty:"); err != nil {
+		t.Fatal(err)
+	}
+	if h.Get("Origin") != "http://example.com" || len(h["X-Empty"]) != 1 {
+		t.Errorf("expected the headers to be added, got %v", h)
+	}
+	for _, v := range []string{"no colon", ": value"} {
+		if err := f.Set(v); err == nil {
+			t.Errorf("expected %q to be rejected", v)
+		}
+	}
+}
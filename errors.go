@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// CloseError is how a connection ended once it has closed
+type CloseError struct {
+	// Code is the status the peer sent in its close frame, statusNoStatus
+	// when it sent none and statusAbnormal when there was no close frame
+	Code status
+	// Reason is the text the peer sent with its close frame
+	Reason string
+	// Clean is set when both sides sent close frames
+	Clean bool
+}
+
+func (e *CloseError) Error() string {
+	if e.Reason != "" {
+		return fmt.Sprintf("connection closed with %d (%s): %s", e.Code, e.Code, e.Reason)
+	}
+	return fmt.Sprintf("connection closed with %d (%s)", e.Code, e.Code)
+}
+
+// ProtocolErrorKind is the rule of RFC 6455 the peer broke
+type ProtocolErrorKind uint8
+
+const (
+	// KindUnexpectedContinuation is a continuation frame with no message
+	// to continue
+	KindUnexpectedContinuation = ProtocolErrorKind(iota + 1)
+	// KindExpectedContinuation is a new data frame while a fragmented
+	// message is incomplete
+	KindExpectedContinuation
+	KindReservedBits
+	KindReservedOpcode
+	// KindControlTooLong is a control frame with more than 125 bytes
+	KindControlTooLong
+	KindFragmentedControl
+	// KindUnmaskedFrame is a frame from a client without a mask, and
+	// KindMaskedFrame one from a server with one
+	KindUnmaskedFrame
+	KindMaskedFrame
+	// KindInvalidClosePayload is a close frame with a single byte
+	KindInvalidClosePayload
+	KindInvalidCloseCode
+	// KindInvalidUTF8 is a text message or close reason that isn't UTF-8
+	KindInvalidUTF8
+)
+
+func (k ProtocolErrorKind) String() string {
+	switch k {
+	case KindUnexpectedContinuation:
+		return "continuation frame without a message to continue"
+	case KindExpectedContinuation:
+		return "new message before the fragmented message was finished"
+	case KindReservedBits:
+		return "reserved bits set"
+	case KindReservedOpcode:
+		return "reserved op code"
+	case KindControlTooLong:
+		return "control frame payload over 125 bytes"
+	case KindFragmentedControl:
+		return "fragmented control frame"
+	case KindUnmaskedFrame:
+		return "unmasked client frame"
+	case KindMaskedFrame:
+		return "masked server frame"
+	case KindInvalidClosePayload:
+		return "invalid close frame payload"
+	case KindInvalidCloseCode:
+		return "invalid close code"
+	case KindInvalidUTF8:
+		return "invalid UTF-8"
+	}
+	return "unknown"
+}
+
+// ProtocolError is returned when the peer breaks the protocol, the
+// connection is closed with statusProtoErr, or statusInvalidData for
+// KindInvalidUTF8
+type ProtocolError struct {
+	Kind ProtocolErrorKind
+}
+
+func (e *ProtocolError) Error() string {
+	return "protocol error: " + e.Kind.String()
+}
+
+// ErrMessageTooBig is returned when the peer sends a message larger than the
+// connection accepts, the connection is closed with statusTooBig
+var ErrMessageTooBig = errors.New("message too big")
+
+// errRateLimited is returned when a connection with the limitClose policy
+// goes over its rate limit, it's closed with statusViolation
+var errRateLimited = errors.New("rate limit exceeded")
+
+// ErrHandshake is returned when an upgrade fails, Status is the HTTP status
+// of the response
+type ErrHandshake struct {
+	Status int
+	Err    error
+}
+
+func (e *ErrHandshake) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("handshake failed with %d: %v", e.Status, e.Err)
+	}
+	return fmt.Sprintf("handshake failed with %d", e.Status)
+}
+
+func (e *ErrHandshake) Unwrap() error {
+	return e.Err
+}
+
+// handshakeError creates an *ErrHandshake for a response of 'status'
+func handshakeError(status int, format string, args ...any) error {
+	return &ErrHandshake{Status: status, Err: fmt.Errorf(format, args...)}
+}
+
+// closeStatus returns the status to close the connection with because of
+// 'err', and whether 'err' is one the peer should be told about at all
+func closeStatus(err error) (status, bool) {
+	var pe *ProtocolError
+	switch {
+	case errors.As(err, &pe):
+		if pe.Kind == KindInvalidUTF8 {
+			return statusInvalidData, true
+		}
+		return statusProtoErr, true
+	case errors.Is(err, ErrMessageTooBig):
+		return statusTooBig, true
+	case errors.Is(err, errRateLimited):
+		return statusViolation, true
+	}
+	return 0, false
+}
+
+// validCloseCode reports whether 'code' may be sent in a close frame
+func validCloseCode(code status) bool {
+	switch {
+	case code >= statusNormal && code <= statusUnacceptable:
+		return true
+	case code >= statusInvalidData && code <= 1014:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseClosePayload(t *testing.T) {
+	cases := []struct {
+		data []byte
+		code status
+		kind ProtocolErrorKind
+	}{
+		{nil, statusNoStatus, 0},
+		{[]byte{0x03, 0xe8}, statusNormal, 0},
+		{append([]byte{0x0f, 0xa0}, "bye"...), 4000, 0},
+		{[]byte{0x03}, 0, KindInvalidClosePayload},
+		{[]byte{0x03, 0xed}, 0, KindInvalidCloseCode},
+		{[]byte{0x03, 0xee}, 0, KindInvalidCloseCode},
+		{[]byte{0x13, 0x88}, 0, KindInvalidCloseCode},
+		{[]byte{0x03, 0xe8, 0xff}, 0, KindInvalidUTF8},
+	}
+
+	for _, tc := range cases {
+		ce, err := parseClosePayload(tc.data)
+		var pe *ProtocolError
+		switch {
+		case tc.kind != 0:
+			if !errors.As(err, &pe) || pe.Kind != tc.kind {
+				t.Errorf("%v: expected %s, got %v", tc.data, tc.kind, err)
+			}
+		case err != nil:
+			t.Errorf("%v: unexpected error %v", tc.data, err)
+		case ce.Code != tc.code:
+			t.Errorf("%v: expected %d, got %d", tc.data, tc.code, ce.Code)
+		}
+	}
+}
+
+func TestValidCloseCode(t *testing.T) {
+	for code, valid := range map[status]bool{
+		999: false, 1000: true, 1003: true, 1004: false, 1005: false, 1006: false,
+		1007: true, 1011: true, 1014: true, 1015: false, 2999: false, 3000: true, 4999: true, 5000: false,
+	} {
+		if validCloseCode(code) != valid {
+			t.Errorf("expected validCloseCode(%d) to be %v", code, valid)
+		}
+	}
+}
+
+func TestProtocolViolations(t *testing.T) {
+	mask := []byte{0x12, 0x34, 0x56, 0x78}
+	cases := []struct {
+		name string
+		raw  []byte
+		kind ProtocolErrorKind
+		code status
+	}{
+		{"unmasked", []byte{0x81, 0x02, 'h', 'i'}, KindUnmaskedFrame, statusProtoErr},
+		{"reserved bits", append([]byte{0xc1, 0x80}, mask...), KindReservedBits, statusProtoErr},
+		{"reserved op", append([]byte{0x83, 0x80}, mask...), KindReservedOpcode, statusProtoErr},
+		{"continuation", append([]byte{0x80, 0x80}, mask...), KindUnexpectedContinuation, statusProtoErr},
+		{"fragmented ping", append([]byte{0x09, 0x80}, mask...), KindFragmentedControl, statusProtoErr},
+		{"invalid utf8", append(append([]byte{0x81, 0x81}, mask...), 0xff^0x12), KindInvalidUTF8, statusInvalidData},
+		{"too big", append([]byte{0x82, 0xfe, 0x01, 0x00}, mask...), 0, statusTooBig},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			client, srv := net.Pipe()
+			defer client.Close()
+
+			c := newConn(context.Background(), srv, nil)
+			c.p = newPayloadSize(128)
+			errs := make(chan error, 1)
+			go func() { errs <- c.handle() }()
+
+			go client.Write(tc.raw)
+
+			h, data, err := readFrame(bufio.NewReader(client))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if h.op != connclose || len(data) < 2 || status(data[0])<<8|status(data[1]) != tc.code {
+				t.Errorf("expected close with %d, got %s %v", tc.code, h.op, data)
+			}
+			client.Close()
+
+			select {
+			case err := <-errs:
+				var pe *ProtocolError
+				switch {
+				case tc.kind == 0:
+					if !errors.Is(err, ErrMessageTooBig) {
+						t.Errorf("expected ErrMessageTooBig, got %v", err)
+					}
+				case !errors.As(err, &pe) || pe.Kind != tc.kind:
+					t.Errorf("expected %s, got %v", tc.kind, err)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("expected handle to return")
+			}
+		})
+	}
+}
+
+func TestHandshakeErrors(t *testing.T) {
+	s := &server{}
+	s.upgrade.router = &router{}
+	l := startServer(t, s)
+
+	_, _, err := dial(context.Background(), "ws://"+l.Addr().String()+"/missing", nil)
+	var he *ErrHandshake
+	if !errors.As(err, &he) || he.Status != 404 {
+		t.Errorf("expected a handshake error with 404 from dial, got %v", err)
+	}
+
+	client, srv := net.Pipe()
+	defer client.Close()
+	go func() {
+		client.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Version: 13\r\n\r\n"))
+		readUpgradeResponse(bufio.NewReader(client))
+	}()
+	_, err = upgrade(context.Background(), srv, bufio.NewReader(srv), &upgradeOptions{})
+	if !errors.As(err, &he) || he.Status != 400 {
+		t.Errorf("expected a handshake error with 400 from upgrade, got %v", err)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// maskedFrame encodes a single frame masked as a client would send it
+func maskedFrame(fin bool, op opCode, data []byte) []byte {
+	var b bytes.Buffer
+	writeFrame(&b, fin, op, data)
+	return b.Bytes()
+}
+
+func FuzzHeader(f *testing.F) {
+	f.Add([]byte{0x81, 0x05})
+	f.Add([]byte{0x82, 0xfe, 0x01, 0x00, 0x12, 0x34, 0x56, 0x78})
+	f.Add([]byte{0x02, 0x7f, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00})
+	f.Add([]byte{0xf9, 0xff, 0x80, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x02, 0x03, 0x04})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		h := &header{}
+		if err := h.read(bufio.NewReader(bytes.NewReader(b))); err != nil {
+			return
+		}
+
+		var buf bytes.Buffer
+		w := bufio.NewWriter(&buf)
+		if err := h.write(w); err != nil {
+			t.Fatal(err)
+		}
+		w.Flush()
+		if uint64(buf.Len()) != h.size() {
+			t.Errorf("expected to write %d byte(s), wrote %d", h.size(), buf.Len())
+		}
+
+		got := &header{}
+		if err := got.read(bufio.NewReader(&buf)); err != nil {
+			t.Fatalf("failed to read back %+v: %v", h, err)
+		}
+		if got.isFin != h.isFin || got.rsv != h.rsv || got.op != h.op || got.length != h.length ||
+			got.isMasked != h.isMasked || !bytes.Equal(got.mask, h.mask) {
+			t.Errorf("expected %+v after a round trip, got %+v", h, got)
+		}
+	})
+}
+
+func FuzzConnHandle(f *testing.F) {
+	f.Add(maskedFrame(true, text, []byte("hello")))
+	f.Add(append(maskedFrame(false, binary, []byte("frag")), maskedFrame(true, continuation, []byte("ment"))...))
+	f.Add(append(maskedFrame(false, text, []byte("a")), append(maskedFrame(true, ping, nil), maskedFrame(true, continuation, []byte("b"))...)...))
+	f.Add(maskedFrame(true, connclose, []byte{0x03, 0xe8, 'b', 'y', 'e'}))
+	f.Add(maskedFrame(true, text, []byte{0xce, 0xba, 0xe1, 0xbd, 0xb9, 0xcf, 0x83, 0xce, 0xbc, 0xce, 0xb5}))
+	f.Add(maskedFrame(true, text, []byte{0xf4, 0x90, 0x80, 0x80}))
+	f.Add(maskedFrame(true, connclose, []byte{0x03}))
+	f.Add(maskedFrame(true, ping, bytes.Repeat([]byte{'x'}, 126)))
+	f.Add(maskedFrame(true, continuation, []byte("orphan")))
+	f.Add([]byte{0x81, 0x02, 'h', 'i'})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		client, srv := net.Pipe()
+		defer srv.Close()
+		go io.Copy(io.Discard, client)
+
+		// A pipe write only returns once every byte has been read, so closing
+		// after it ends the connection once the input is in
+		go func() {
+			client.Write(b)
+			client.Close()
+		}()
+
+		c := newConn(context.Background(), srv, nil)
+		c.p = newPayloadSize(1 << 16)
+		c.crashOnPanic = true
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			c.handle()
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected handle to return once the input was read")
+		}
+	})
+}
+
+func FuzzUpgrade(f *testing.F) {
+	var req bytes.Buffer
+	writeUpgradeRequest(&req, "/chat?room=1", "Sec-WebSocket-Protocol: other, chat", "Origin: http://localhost")
+	f.Add(req.Bytes())
+	f.Add([]byte("GET / HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n"))
+	f.Add([]byte("GET / HTTP/1.1\r\nHost: localhost\r\nSec-WebSocket-Key: \x00\xff\r\nContent-Length: -1\r\n\r\n"))
+	f.Add([]byte("GET http://evil/%zz HTTP/1.1\r\nHost: evil\r\nOrigin: null\r\n\r\n"))
+	f.Add([]byte("GET / HTTP/1.1\r\n" + string(bytes.Repeat([]byte("X: y\r\n"), 100)) + "\r\n"))
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		client, srv := net.Pipe()
+		defer client.Close()
+
+		responses := make(chan []byte, 1)
+		go func() {
+			res, _ := io.ReadAll(client)
+			responses <- res
+		}()
+
+		opts := &upgradeOptions{subprotocols: []string{"chat"}}
+		_, err := upgrade(context.Background(), srv, bufio.NewReader(bytes.NewReader(b)), opts)
+		srv.Close()
+		res := <-responses
+
+		if len(res) == 0 {
+			if err == nil {
+				t.Fatal("expected a response when the upgrade succeeded")
+			}
+			return
+		}
+		hr, rerr := http.ReadResponse(bufio.NewReader(bytes.NewReader(res)), nil)
+		if rerr != nil {
+			t.Fatalf("failed to read response %q: %v", res, rerr)
+		}
+
+		var he *ErrHandshake
+		switch {
+		case err == nil && hr.StatusCode != http.StatusSwitchingProtocols:
+			t.Errorf("expected 101 for a successful upgrade, got %d", hr.StatusCode)
+		case errors.As(err, &he) && he.Status != hr.StatusCode:
+			t.Errorf("expected the handshake error's status %d to match the response %d", he.Status, hr.StatusCode)
+		}
+	})
+}
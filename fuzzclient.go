@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+)
+
+// probe is a malformed sequence of frames sent to see how a server reacts
+type probe struct {
+	name        string
+	description string
+	frames      []testFrame
+}
+
+// reaction is what a server did with a probe
+type reaction string
+
+const (
+	// reactionClosed is a close frame, reactionDropped a TCP close without
+	// one and reactionOpen no reaction at all
+	reactionClosed        reaction = "closed"
+	reactionDropped       reaction = "dropped"
+	reactionOpen          reaction = "open"
+	reactionConnectFailed reaction = "connect_failed"
+)
+
+type probeResult struct {
+	Probe       string   `json:"probe"`
+	Description string   `json:"description"`
+	Reaction    reaction `json:"reaction"`
+	// Code is the status of the server's close frame
+	Code status `json:"code,omitempty"`
+	// Messages counts the data messages and pongs the server sent back
+	Messages  int    `json:"messages"`
+	Violation string `json:"violation,omitempty"`
+	Error     string `json:"error,omitempty"`
+	// Elapsed is how long the server took to react once the probe was sent,
+	// in milliseconds
+	Elapsed float64 `json:"elapsed_ms"`
+}
+
+func (r probeResult) String() string {
+	var s string
+	switch r.Reaction {
+	case reactionClosed:
+		s = fmt.Sprintf("closed with %d (%s) after %.1fms", r.Code, r.Code, r.Elapsed)
+	case reactionDropped:
+		s = fmt.Sprintf("dropped the connection after %.1fms", r.Elapsed)
+	case reactionOpen:
+		s = "kept the connection open"
+	default:
+		s = "failed to connect: " + r.Error
+	}
+	if r.Messages > 0 {
+		s += fmt.Sprintf(", sent %d message(s) back", r.Messages)
+	}
+	if r.Violation != "" {
+		s += ", " + r.Violation
+	}
+	return s
+}
+
+// String describes the frame compactly enough to reproduce it
+func (f testFrame) String() string {
+	s := f.op.String()
+	if f.op.isReserved() {
+		s = fmt.Sprintf("op %d", f.op)
+	}
+	if f.fin {
+		s += " fin"
+	}
+	if f.rsv != 0 {
+		s += fmt.Sprintf(" rsv=%d", f.rsv)
+	}
+	if f.unmasked {
+		s += " unmasked"
+	}
+	if f.length > 0 {
+		s += fmt.Sprintf(" claiming %d bytes", f.length)
+	}
+	return s + fmt.Sprintf(" %d bytes", len(f.data))
+}
+
+// probes are the malformed sequences sent by default
+func probes() []probe {
+	kosme := []byte("\xce\xba\xe1\xbd\xb9\xcf\x83\xce\xbc\xce\xb5")
+	hello := []byte("Hello, world!")
+	rsv := func(op opCode, rsv byte) []testFrame {
+		return []testFrame{{fin: true, rsv: rsv, op: op, data: hello}}
+	}
+	closeWith := func(code status) []testFrame {
+		return []testFrame{closeFrame(code, "")}
+	}
+
+	return []probe{
+		{"rsv1-text", "text message with RSV = 1", rsv(text, 1)},
+		{"rsv2-binary", "binary message with RSV = 2", rsv(binary, 2)},
+		{"rsv4-ping", "ping with RSV = 4", rsv(ping, 4)},
+		{"rsv7-close", "close with every RSV bit set", []testFrame{{fin: true, rsv: 7, op: connclose, data: closePayload(statusNormal, "")}}},
+		{"reserved-op-3", "frame with reserved data op code 3", []testFrame{msg(3, hello)}},
+		{"reserved-op-11", "frame with reserved control op code 11", []testFrame{msg(11, hello)}},
+		{"ping-126", "ping with a 126 byte payload", []testFrame{msg(ping, payloadOf('*', 126))}},
+		{"pong-65536", "pong with a 65536 byte payload", []testFrame{msg(pong, payloadOf('*', 65536))}},
+		{"close-126", "close with a 126 byte payload", []testFrame{closeFrame(statusNormal, string(payloadOf('*', 124)))}},
+		{"fragmented-ping", "ping split in two fragments", []testFrame{frag(ping, hello), msg(continuation, hello)}},
+		{"invalid-utf8", "text message with a surrogate", []testFrame{msg(text, append(kosme[:len(kosme):len(kosme)], 0xed, 0xa0, 0x80))}},
+		{"invalid-utf8-fragments", "code point above U+10FFFF split across fragments", []testFrame{frag(text, []byte{0xf4}), msg(continuation, []byte{0x90, 0x80, 0x80})}},
+		{"invalid-utf8-close-reason", "close with an invalid UTF-8 reason", []testFrame{closeFrame(statusNormal, "\xc0\xaf")}},
+		{"interleaved-text", "new text message inside a fragmented one", []testFrame{frag(text, hello), msg(text, hello), msg(continuation, hello)}},
+		{"interleaved-binary", "binary message inside a fragmented text message", []testFrame{frag(text, hello), msg(binary, hello), msg(continuation, hello)}},
+		{"orphan-continuation", "continuation frame without a message", []testFrame{msg(continuation, hello)}},
+		{"close-1-byte", "close with a 1 byte payload", []testFrame{msg(connclose, []byte{0x03})}},
+		{"close-code-0", "close with status 0", closeWith(0)},
+		{"close-code-999", "close with status 999", closeWith(999)},
+		{"close-code-1005", "close with status 1005, which is never sent", closeWith(statusNoStatus)},
+		{"close-code-1006", "close with status 1006, which is never sent", closeWith(statusAbnormal)},
+		{"close-code-2999", "close with status 2999", closeWith(2999)},
+		{"close-code-5000", "close with status 5000", closeWith(5000)},
+		{"unmasked-text", "unmasked text message", []testFrame{{fin: true, op: text, data: hello, unmasked: true}}},
+		{"unmasked-close", "unmasked close", []testFrame{{fin: true, op: connclose, data: closePayload(statusNormal, ""), unmasked: true}}},
+		{"length-high-bit", "binary frame claiming a 64 bit length with the high bit set", []testFrame{{fin: true, op: binary, length: 1 << 63}}},
+		{"length-overstated", "binary frame claiming 1000 bytes but sending 10", []testFrame{{fin: true, op: binary, data: payloadOf(0xfe, 10), length: 1000}}},
+	}
+}
+
+// randomProbe returns a probe of a few random frames, each likely to break a
+// rule or two. The same 'r' state always gives the same probe.
+func randomProbe(r *rand.Rand, n int) probe {
+	frames := make([]testFrame, 1+r.IntN(4))
+	descriptions := make([]string, len(frames))
+	for i := range frames {
+		f := testFrame{fin: r.IntN(4) != 0, op: opCode(r.IntN(16))}
+		if r.IntN(6) == 0 {
+			f.rsv = byte(1 + r.IntN(7))
+		}
+		f.unmasked = r.IntN(10) == 0
+
+		size := r.IntN(130)
+		if r.IntN(10) == 0 {
+			size = r.IntN(70000)
+		}
+		f.data = make([]byte, size)
+		switch r.IntN(3) {
+		case 0:
+			for j := range f.data {
+				f.data[j] = byte(r.UintN(256))
+			}
+		default:
+			// Bytes of ASCII and multi-byte code points, which are valid
+			// UTF-8 often enough to get past the check to whatever's next
+			for j := range f.data {
+				f.data[j] = "abc\xce\xba\xe1\xbd\xb9"[r.IntN(8)]
+			}
+		}
+		if f.op == connclose && size >= 2 {
+			code := status(r.UintN(5000))
+			f.data[0], f.data[1] = byte(code>>8), byte(code)
+		}
+
+		frames[i] = f
+		descriptions[i] = f.String()
+	}
+	return probe{name: fmt.Sprintf("random-%d", n), description: strings.Join(descriptions, ", "), frames: frames}
+}
+
+// runProbe sends 'p' to the server at 'rawURL' and waits up to 'timeout' for
+// it to react
+func runProbe(ctx context.Context, rawURL string, p probe, opts *dialOptions, timeout time.Duration) probeResult {
+	res := probeResult{Probe: p.name, Description: p.description}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout+conformanceCloseWait)
+	defer cancel()
+
+	c, r, _, err := dialRaw(ctx, rawURL, opts)
+	if err != nil {
+		res.Reaction, res.Error = reactionConnectFailed, err.Error()
+		return res
+	}
+	defer c.Close()
+
+	stop := context.AfterFunc(ctx, func() {
+		c.SetDeadline(aLongTimeAgo)
+	})
+	defer stop()
+
+	cc := newCaseConn(c, r)
+	go cc.readLoop()
+
+	for _, f := range p.frames {
+		if cc.isClosed() {
+			break
+		}
+		if err := cc.send(f); err != nil {
+			break
+		}
+	}
+
+	cc.awaitReaction(ctx, timeout, &res)
+	cc.finishClose(ctx)
+	return res
+}
+
+// awaitReaction waits up to 'timeout' for the peer to react to what was just
+// sent and records what it did in 'res'
+func (cc *caseConn) awaitReaction(ctx context.Context, timeout time.Duration, res *probeResult) {
+	sent := time.Now()
+	t := time.NewTimer(timeout)
+	select {
+	case <-cc.closed:
+	case <-cc.eof:
+	case <-t.C:
+	case <-ctx.Done():
+	}
+	t.Stop()
+	res.Elapsed = float64(time.Since(sent).Microseconds()) / 1000
+
+	cc.mu.Lock()
+	res.Messages, res.Violation, res.Code = len(cc.messages), cc.violation, cc.closeCode
+	cc.mu.Unlock()
+
+	switch {
+	case cc.isClosed():
+		res.Reaction = reactionClosed
+	case cc.isEOF():
+		res.Reaction = reactionDropped
+	default:
+		res.Reaction, res.Elapsed = reactionOpen, 0
+	}
+}
+
+// fuzzClientCommand sends malformed frames to a server and reports how it
+// reacts to each, exiting with 1 if it stops accepting connections
+func fuzzClientCommand(args []string) int {
+	fs := flag.NewFlagSet("fuzzclient", flag.ContinueOnError)
+	only := fs.String("probes", "", "comma separated probes to send (default all)")
+	random := fs.Int("random", 0, "number of random probes to send after the others")
+	seed := fs.Uint64("seed", 0, "seed for the random probes, the same seed sends the same probes (default the time)")
+	timeout := fs.Duration("timeout", 2*time.Second, "time the server has to react to each probe")
+	jsonFile := fs.String("json", "", "write the results as JSON to this file")
+	insecure := fs.Bool("insecure", false, "don't verify the server's certificate for wss:// URLs")
+	list := fs.Bool("list", false, "list the probes and exit")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: ws fuzzclient [flags] ws://host:port/path")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	selected := probes()
+	if *only != "" {
+		names := strings.Split(*only, ",")
+		selected = selected[:0]
+		for _, p := range probes() {
+			for _, name := range names {
+				if strings.TrimSpace(name) == p.name {
+					selected = append(selected, p)
+				}
+			}
+		}
+	}
+	if *list {
+		for _, p := range selected {
+			fmt.Printf("%-26s %s\n", p.name, p.description)
+		}
+		return 0
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	if *random > 0 {
+		if *seed == 0 {
+			*seed = uint64(time.Now().UnixNano())
+		}
+		fmt.Printf("random probes use -seed %d\n", *seed)
+		r := rand.New(rand.NewPCG(*seed, *seed))
+		for i := 0; i < *random; i++ {
+			selected = append(selected, randomProbe(r, i+1))
+		}
+	}
+
+	opts := &dialOptions{}
+	if *insecure {
+		opts.tlsConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	var results []probeResult
+	failed := 0
+	for _, p := range selected {
+		if ctx.Err() != nil {
+			break
+		}
+		res := runProbe(ctx, fs.Arg(0), p, opts, *timeout)
+		if res.Reaction == reactionConnectFailed {
+			failed++
+		}
+		results = append(results, res)
+		fmt.Printf("%-26s %s\n", res.Probe, res)
+	}
+
+	if *jsonFile != "" {
+		err := writeReportFile(*jsonFile, func(w io.Writer) error {
+			e := json.NewEncoder(w)
+			e.SetIndent("", "  ")
+			return e.Encode(results)
+		})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+
+	if failed > 0 {
+		fmt.Printf("\nfailed to connect for %d of %d probe(s), the server may have crashed\n", failed, len(results))
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"math/rand/v2"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProbes(t *testing.T) {
+	s := &server{crashOnPanic: true}
+	l := startServer(t, s)
+	url := "ws://" + l.Addr().String() + "/"
+
+	codes := map[string]status{
+		"invalid-utf8":              statusInvalidData,
+		"invalid-utf8-fragments":    statusInvalidData,
+		"invalid-utf8-close-reason": statusInvalidData,
+		"length-high-bit":           statusTooBig,
+	}
+	for _, p := range probes() {
+		res := runProbe(context.Background(), url, p, nil, 200*time.Millisecond)
+
+		// The server waits for the rest of the frame, which never comes
+		if p.name == "length-overstated" {
+			if res.Reaction != reactionOpen {
+				t.Errorf("%s: expected the connection to be left open, got %s", p.name, res)
+			}
+			continue
+		}
+
+		want, ok := codes[p.name]
+		if !ok {
+			want = statusProtoErr
+		}
+		if res.Reaction != reactionClosed || res.Code != want || res.Violation != "" {
+			t.Errorf("%s: expected a close with %d, got %s", p.name, want, res)
+		}
+	}
+}
+
+func TestProbeOversizedFrames(t *testing.T) {
+	for name, h := range oversizedHeaders {
+		url := startHostileServer(t, h)
+
+		res := runProbe(context.Background(), url, probes()[0], nil, 200*time.Millisecond)
+		if !strings.Contains(res.Violation, "byte frame") {
+			t.Errorf("%s: expected the probe to report the frame's size, got %s", name, res)
+		}
+	}
+}
+
+func TestRandomProbe(t *testing.T) {
+	a, b := rand.New(rand.NewPCG(1, 1)), rand.New(rand.NewPCG(1, 1))
+	for i := 0; i < 20; i++ {
+		pa, pb := randomProbe(a, i), randomProbe(b, i)
+		if !reflect.DeepEqual(pa, pb) {
+			t.Fatalf("expected the same seed to give the same probes, got %q and %q", pa.description, pb.description)
+		}
+		if len(pa.frames) == 0 || pa.description == "" {
+			t.Errorf("expected a described probe, got %+v", pa)
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// fuzzEnd is how a fuzz case ends once its frames are sent
+type fuzzEnd uint8
+
+const (
+	// endClose starts the close handshake
+	endClose = fuzzEnd(iota)
+	// endWait leaves the client to react, for cases that already closed or
+	// should be failed by the client
+	endWait
+	// endHalfClose closes our side of the TCP connection, leaving the
+	// client's open
+	endHalfClose
+	// endDrop closes the TCP connection without a close frame
+	endDrop
+)
+
+// fuzzCase is a sequence of frames sent to a client to see how it copes
+type fuzzCase struct {
+	description string
+	frames      []testFrame
+	// pause is slept between frames
+	pause time.Duration
+	end   fuzzEnd
+}
+
+// unmasked returns 'frames' as a server sends them
+func unmasked(frames ...testFrame) []testFrame {
+	for i := range frames {
+		frames[i].unmasked = true
+	}
+	return frames
+}
+
+// fuzzCases are served at /case/N, numbered from 1. New cases go on the end
+// so the numbers stay put.
+func fuzzCases() []fuzzCase {
+	hello := []byte("Hello, world!")
+	kosme := []byte("\xce\xba\xe1\xbd\xb9\xcf\x83\xce\xbc\xce\xb5")
+	surrogate := append(kosme[:len(kosme):len(kosme)], 0xed, 0xa0, 0x80)
+
+	return []fuzzCase{
+		{description: "text message", frames: unmasked(msg(text, hello))},
+		{description: "binary message", frames: unmasked(msg(binary, []byte{0x00, 0xff, 0xfe, 0xfd}))},
+		{description: "empty text message", frames: unmasked(msg(text, nil))},
+		{description: "text messages of 125, 126, 65535 and 65536 bytes, across the length encodings", frames: unmasked(
+			msg(text, payloadOf('*', 125)), msg(text, payloadOf('*', 126)), msg(text, payloadOf('*', 65535)), msg(text, payloadOf('*', 65536)))},
+		{description: "text message in three fragments", frames: unmasked(frag(text, []byte("frag")), frag(continuation, []byte("men")), msg(continuation, []byte("ted")))},
+		{description: "text message in two fragments with a ping between them", frames: unmasked(frag(text, []byte("frag")), msg(ping, []byte("ping")), msg(continuation, []byte("mented")))},
+		{description: "ping, which the client should answer", frames: unmasked(msg(ping, hello))},
+		{description: "ping with a 125 byte payload", frames: unmasked(msg(ping, payloadOf('*', 125)))},
+		{description: "unsolicited pong, which the client should ignore", frames: unmasked(msg(pong, hello))},
+		{description: "text message in one byte fragments", frames: unmasked(fragments(text, kosme, 1)...)},
+		{description: "text message written a byte at a time", frames: unmasked(chunked(msg(text, hello), 1))},
+		{description: "text message written a byte every 100ms", frames: unmasked(fragments(text, hello, 1)...), pause: 100 * time.Millisecond},
+		{description: "masked text message, which the client should fail with 1002", frames: []testFrame{msg(text, hello)}, end: endWait},
+		{description: "ping in two fragments, which the client should fail with 1002", frames: unmasked(frag(ping, hello), msg(continuation, hello)), end: endWait},
+		{description: "ping with a 126 byte payload, which the client should fail with 1002", frames: unmasked(msg(ping, payloadOf('*', 126))), end: endWait},
+		{description: "binary frame with a 64 bit length with the high bit set", frames: unmasked(testFrame{fin: true, op: binary, length: 1 << 63}), end: endWait},
+		{description: "text message with RSV = 1, which the client should fail with 1002", frames: unmasked(testFrame{fin: true, rsv: 1, op: text, data: hello}), end: endWait},
+		{description: "frame with reserved op code 3, which the client should fail with 1002", frames: unmasked(msg(3, hello)), end: endWait},
+		{description: "frame with reserved op code 11, which the client should fail with 1002", frames: unmasked(msg(11, hello)), end: endWait},
+		{description: "continuation frame without a message, which the client should fail with 1002", frames: unmasked(msg(continuation, hello)), end: endWait},
+		{description: "new text message inside a fragmented one, which the client should fail with 1002", frames: unmasked(frag(text, hello), msg(text, hello)), end: endWait},
+		{description: "text message with invalid UTF-8, which the client should fail with 1007", frames: unmasked(msg(text, surrogate)), end: endWait},
+		{description: "invalid UTF-8 split across fragments, which the client should fail with 1007", frames: unmasked(frag(text, []byte{0xf4}), msg(continuation, []byte{0x90, 0x80, 0x80})), end: endWait},
+		{description: "close with status 1005, which is never sent", frames: unmasked(closeFrame(statusNoStatus, "")), end: endWait},
+		{description: "close with a 1 byte payload", frames: unmasked(msg(connclose, []byte{0x03})), end: endWait},
+		{description: "close with an invalid UTF-8 reason", frames: unmasked(closeFrame(statusNormal, "\xc0\xaf")), end: endWait},
+		{description: "close with status 1000 and a reason", frames: unmasked(closeFrame(statusNormal, "goodbye")), end: endWait},
+		{description: "close with status 1001, going away", frames: unmasked(closeFrame(statusGoingAway, "restarting")), end: endWait},
+		{description: "text message then our side of the TCP connection closed", frames: unmasked(msg(text, hello)), end: endHalfClose},
+		{description: "frame header cut short, then the connection dropped", frames: unmasked(testFrame{fin: true, op: binary, data: payloadOf(0xfe, 300), truncate: 3}), end: endDrop},
+		{description: "frame claiming 100 bytes with 10 sent, then the connection dropped", frames: unmasked(testFrame{fin: true, op: binary, data: payloadOf(0xfe, 10), length: 100}), end: endDrop},
+		{description: "text message then the connection dropped without a close frame", frames: unmasked(msg(text, hello)), end: endDrop},
+		{description: "close followed by a text message, which the client should ignore", frames: unmasked(closeFrame(statusNormal, ""), msg(text, hello)), end: endWait},
+		{description: "1000 small text messages", frames: unmasked(manyMessages(1000)...)},
+		{description: "1 MiB binary message", frames: unmasked(msg(binary, payloadOf(0xfe, 1<<20)))},
+	}
+}
+
+func manyMessages(n int) []testFrame {
+	frames := make([]testFrame, n)
+	for i := range frames {
+		frames[i] = msg(text, []byte(strconv.Itoa(i)))
+	}
+	return frames
+}
+
+// fuzzServer upgrades connections to /case/N and sends them fuzz case N,
+// logging how each client reacts
+type fuzzServer struct {
+	cases []fuzzCase
+	// timeout is how long clients have to react to a case
+	timeout time.Duration
+	log     *slog.Logger
+}
+
+// serve accepts connections from 'l' until it's closed or 'ctx' is done
+func (s *fuzzServer) serve(ctx context.Context, l net.Listener) error {
+	stop := context.AfterFunc(ctx, func() {
+		l.Close()
+	})
+	defer stop()
+
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		go s.handle(ctx, c)
+	}
+}
+
+func (s *fuzzServer) handle(ctx context.Context, c net.Conn) {
+	defer c.Close()
+	log := s.log.With("remote_addr", c.RemoteAddr().String())
+
+	r := bufio.NewReader(c)
+	c.SetReadDeadline(time.Now().Add(10 * time.Second))
+	req, err := readRequest(r, c)
+	if err != nil {
+		return
+	}
+	c.SetReadDeadline(time.Time{})
+
+	// Anything else lists the cases, so they can be found from a browser
+	if !req.isUpgrade() {
+		serveHTTP(c, req, http.HandlerFunc(s.list))
+		return
+	}
+
+	n, ok := s.caseNumber(req.path)
+	if !ok {
+		sendHttpResponse(c, http.StatusNotFound, nil)
+		return
+	}
+	if _, err := upgradeRequest(ctx, c, req, nil); err != nil {
+		log.Info("failed to upgrade client", "err", err)
+		return
+	}
+
+	tc := s.cases[n-1]
+	log = log.With("case", n)
+	log.Info("running case", "description", tc.description)
+
+	res := s.run(ctx, c, r, tc)
+	log.Info("case finished", "reaction", res.Reaction, "code", int(res.Code), "messages", res.Messages, "violation", res.Violation, "elapsed_ms", res.Elapsed)
+}
+
+// caseNumber parses the case number from a /case/N path
+func (s *fuzzServer) caseNumber(path string) (int, bool) {
+	n, err := strconv.Atoi(strings.TrimPrefix(path, "/case/"))
+	if err != nil || !strings.HasPrefix(path, "/case/") || n < 1 || n > len(s.cases) {
+		return 0, false
+	}
+	return n, true
+}
+
+func (s *fuzzServer) list(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for i, tc := range s.cases {
+		fmt.Fprintf(w, "/case/%d\t%s\n", i+1, tc.description)
+	}
+}
+
+// run sends 'tc' to the client and waits for it to react
+func (s *fuzzServer) run(ctx context.Context, c net.Conn, r *bufio.Reader, tc fuzzCase) probeResult {
+	var res probeResult
+
+	ctx, cancel := context.WithTimeout(ctx, s.timeout+conformanceCloseWait)
+	defer cancel()
+	stop := context.AfterFunc(ctx, func() {
+		c.SetDeadline(aLongTimeAgo)
+	})
+	defer stop()
+
+	cc := newCaseConn(c, r)
+	cc.server = true
+	go cc.readLoop()
+
+	for i, f := range tc.frames {
+		if i > 0 && tc.pause > 0 {
+			sleepContext(ctx, tc.pause)
+		}
+		if cc.isClosed() {
+			break
+		}
+		if err := cc.send(f); err != nil {
+			break
+		}
+	}
+
+	switch tc.end {
+	case endClose:
+		if !cc.isClosed() {
+			cc.send(testFrame{fin: true, op: connclose, data: closePayload(statusNormal, ""), unmasked: true})
+		}
+	case endHalfClose:
+		if hc, ok := c.(interface{ CloseWrite() error }); ok {
+			hc.CloseWrite()
+		}
+	case endDrop:
+		c.Close()
+		res.Reaction = reactionDropped
+		return res
+	}
+
+	cc.awaitReaction(ctx, s.timeout, &res)
+	cc.finishClose(ctx)
+	return res
+}
+
+// fuzzServerCommand serves the fuzz cases until interrupted
+func fuzzServerCommand(args []string) int {
+	fs := flag.NewFlagSet("fuzzserver", flag.ContinueOnError)
+	addr := fs.String("listen", "127.0.0.1:9001", "address to listen on")
+	timeout := fs.Duration("timeout", 5*time.Second, "time clients have to react to a case")
+	list := fs.Bool("list", false, "list the cases and exit")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: ws fuzzserver [flags]\n\nconnect to ws://ADDR/case/N to be sent case N")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	s := &fuzzServer{cases: fuzzCases(), timeout: *timeout, log: slog.Default()}
+	if *list {
+		for i, tc := range s.cases {
+			fmt.Printf("/case/%d\t%s\n", i+1, tc.description)
+		}
+		return 0
+	}
+
+	l, err := net.Listen("tcp", *addr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	s.log.Info("serving fuzz cases", "addr", l.Addr().String(), "cases", len(s.cases))
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if err := s.serve(ctx, l); err != nil && !errors.Is(err, context.Canceled) {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startFuzzServer serves the fuzz cases on a loopback listener until the
+// test ends, logging to 'out'
+func startFuzzServer(t *testing.T, out io.Writer) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	s := &fuzzServer{cases: fuzzCases(), timeout: time.Second, log: slog.New(slog.NewTextHandler(out, nil))}
+	go s.serve(ctx, l)
+	return l.Addr().String()
+}
+
+// fuzzCaseURL returns the URL of the case described by 'description'
+func fuzzCaseURL(t *testing.T, addr, description string) string {
+	t.Helper()
+	for i, tc := range fuzzCases() {
+		if tc.description == description {
+			return "ws://" + addr + "/case/" + strconv.Itoa(i+1)
+		}
+	}
+	t.Fatalf("no case %q", description)
+	return ""
+}
+
+func TestFuzzServer(t *testing.T) {
+	var out syncBuffer
+	addr := startFuzzServer(t, &out)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	c, _, err := dial(ctx, fuzzCaseURL(t, addr, "text message in one byte fragments"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if op, data, err := c.readMessage(ctx); err != nil || op != text || string(data) != "\xce\xba\xe1\xbd\xb9\xcf\x83\xce\xbc\xce\xb5" {
+		t.Errorf("expected the fragments as one text message, got %s %q %v", op, data, err)
+	}
+	_, _, err = c.readMessage(ctx)
+	var ce *CloseError
+	if !errors.As(err, &ce) || ce.Code != statusNormal {
+		t.Errorf("expected the server to close with %d, got %v", statusNormal, err)
+	}
+
+	c, _, err = dial(ctx, fuzzCaseURL(t, addr, "masked text message, which the client should fail with 1002"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = c.readMessage(ctx)
+	var pe *ProtocolError
+	if !errors.As(err, &pe) || pe.Kind != KindMaskedFrame {
+		t.Errorf("expected the masked frame to fail the connection, got %v", err)
+	}
+
+	// The server logs how the client reacted
+	for !strings.Contains(out.String(), "reaction=closed code=1002") {
+		select {
+		case <-ctx.Done():
+			t.Fatalf("expected the client's close to be logged, got %s", out.String())
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func TestFuzzServerPaths(t *testing.T) {
+	addr := startFuzzServer(t, io.Discard)
+
+	for _, path := range []string{"/case/0", "/case/x", "/case/" + strconv.Itoa(len(fuzzCases())+1), "/other"} {
+		_, _, err := dial(context.Background(), "ws://"+addr+path, nil)
+		var he *ErrHandshake
+		if !errors.As(err, &he) || he.Status != http.StatusNotFound {
+			t.Errorf("%s: expected 404, got %v", path, err)
+		}
+	}
+
+	res, err := http.Get("http://" + addr + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	b, _ := io.ReadAll(res.Body)
+	if !strings.HasPrefix(string(b), "/case/1\ttext message\n") {
+		t.Errorf("expected the cases to be listed, got %q", b)
+	}
+}
+
+func TestFuzzServerOversizedFrame(t *testing.T) {
+	var out syncBuffer
+	addr := startFuzzServer(t, &out)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// A naive echo client sending back the 64 bit length case, unmasked
+	c, _, _, err := dialRaw(ctx, fuzzCaseURL(t, addr, "binary frame with a 64 bit length with the high bit set"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Write(testFrame{fin: true, op: binary, length: 1 << 63, unmasked: true}.encode()); err != nil {
+		t.Fatal(err)
+	}
+
+	for !strings.Contains(out.String(), "byte frame") {
+		select {
+		case <-ctx.Done():
+			t.Fatalf("expected the frame's size to be logged as a violation, got %s", out.String())
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	// The server is still up for the next client
+	next, _, err := dial(ctx, fuzzCaseURL(t, addr, "text message"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, data, err := next.readMessage(ctx); err != nil || string(data) != "Hello, world!" {
+		t.Errorf("expected the next case to be served, got %q %v", data, err)
+	}
+}
@@ -46,7 +46,8 @@ func (h *header) write(w *bufio.Writer) error {
 	if h.isFin {
 		finResOp |= byte(mFin)
 	}
-	finResOp |= byte(h.op)
+	finResOp |= (h.rsv << 4) & mRsv
+	finResOp |= byte(h.op) & mOp
 
 	if err := w.WriteByte(finResOp); err != nil {
 		return err
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"testing"
+)
+
+// benchHeaders cover each of the length encodings
+var benchHeaders = []struct {
+	name string
+	h    header
+}{
+	{"7bit", header{isFin: true, op: text, length: 125, isMasked: true, mask: []byte{1, 2, 3, 4}}},
+	{"16bit", header{isFin: true, op: binary, length: 65535, isMasked: true, mask: []byte{1, 2, 3, 4}}},
+	{"64bit", header{isFin: true, op: binary, length: 1 << 20}},
+}
+
+func BenchmarkHeaderRead(b *testing.B) {
+	for _, bh := range benchHeaders {
+		b.Run(bh.name, func(b *testing.B) {
+			var buf bytes.Buffer
+			w := bufio.NewWriter(&buf)
+			if err := bh.h.write(w); err != nil {
+				b.Fatal(err)
+			}
+			if err := w.Flush(); err != nil {
+				b.Fatal(err)
+			}
+
+			src := bytes.NewReader(buf.Bytes())
+			r := bufio.NewReader(src)
+			var h header
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				src.Reset(buf.Bytes())
+				r.Reset(src)
+				if err := h.read(r); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkHeaderWrite(b *testing.B) {
+	for _, bh := range benchHeaders {
+		b.Run(bh.name, func(b *testing.B) {
+			w := bufio.NewWriter(io.Discard)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := bh.h.write(w); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
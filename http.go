@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// httpIdleTimeout is how long a kept-alive HTTP connection may wait for its
+// next request
+const httpIdleTimeout = 60 * time.Second
+
+//go:embed index.html
+var staticFiles embed.FS
+
+// newHTTPHandler serves the demo page and a health check, and the metrics
+// too if 'publicMetrics' is set. They're otherwise only on the admin API.
+func newHTTPHandler(publicMetrics bool) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/", http.FileServerFS(staticFiles))
+	if publicMetrics {
+		mux.Handle("/metrics", metrics)
+	}
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte("ok\n"))
+	})
+	return mux
+}
+
+// responseBuffer is an http.ResponseWriter that holds the whole response so
+// it can be sent with a Content-Length, which keep-alive requires
+type responseBuffer struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *responseBuffer) Header() http.Header {
+	return b.header
+}
+
+func (b *responseBuffer) Write(p []byte) (int, error) {
+	if b.status == 0 {
+		b.WriteHeader(http.StatusOK)
+	}
+	return b.body.Write(p)
+}
+
+func (b *responseBuffer) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+// serveHTTP answers 'req' with 'h' and reports whether the connection may be
+// used for another request
+func serveHTTP(w io.Writer, req *request, h http.Handler) (bool, error) {
+	rb := &responseBuffer{header: http.Header{}}
+	h.ServeHTTP(rb, req.hr)
+	if rb.status == 0 {
+		rb.status = http.StatusOK
+	}
+
+	// Whatever the handler didn't read of the body must be skipped to get to
+	// the next request
+	if _, err := io.Copy(io.Discard, req.hr.Body); err != nil {
+		return false, err
+	}
+	req.hr.Body.Close()
+
+	keepAlive := !req.hr.Close
+
+	res := &http.Response{
+		Status:        strconv.Itoa(rb.status) + " " + http.StatusText(rb.status),
+		StatusCode:    rb.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        rb.header,
+		ContentLength: int64(rb.body.Len()),
+		Body:          io.NopCloser(&rb.body),
+		Close:         !keepAlive,
+		Request:       req.hr,
+	}
+
+	if err := res.Write(w); err != nil {
+		return false, err
+	}
+
+	return keepAlive, nil
+}
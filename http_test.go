@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestServeHTTPKeepAlive(t *testing.T) {
+	s := &server{http: newHTTPHandler(false)}
+	l, err := s.listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go s.serve(context.Background(), l)
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	r := bufio.NewReader(c)
+
+	get := func(path string) *http.Response {
+		t.Helper()
+		fmt.Fprintf(c, "GET %s HTTP/1.1\r\nHost: localhost\r\n\r\n", path)
+		res, err := http.ReadResponse(r, nil)
+		if err != nil {
+			t.Fatalf("GET %s: %v", path, err)
+		}
+		return res
+	}
+
+	res := get("/healthz")
+	body, _ := io.ReadAll(res.Body)
+	if res.StatusCode != 200 || string(body) != "ok\n" {
+		t.Errorf("expected healthy response, got %d %q", res.StatusCode, body)
+	}
+
+	// The same connection is reused for the next request
+	res = get("/")
+	body, _ = io.ReadAll(res.Body)
+	if res.StatusCode != 200 || !strings.Contains(string(body), "WS Demo") {
+		t.Errorf("expected demo page, got %d", res.StatusCode)
+	}
+
+	res = get("/missing")
+	io.ReadAll(res.Body)
+	if res.StatusCode != 404 {
+		t.Errorf("expected 404, got %d", res.StatusCode)
+	}
+
+	// The metrics are only on the admin API unless made public
+	res = get("/metrics")
+	io.ReadAll(res.Body)
+	if res.StatusCode != 404 {
+		t.Errorf("expected metrics not to be public, got %d", res.StatusCode)
+	}
+
+	// Then upgraded
+	if err := writeUpgradeRequest(c, "/"); err != nil {
+		t.Fatal(err)
+	}
+	res, err = readUpgradeResponse(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != 101 {
+		t.Errorf("expected upgrade after plain requests, got %d", res.StatusCode)
+	}
+}
+
+func TestServeHTTPConnectionClose(t *testing.T) {
+	client, srv := net.Pipe()
+	defer client.Close()
+
+	go func() {
+		r := bufio.NewReader(srv)
+		req, err := readRequest(r, srv)
+		if err != nil {
+			return
+		}
+		keepAlive, _ := serveHTTP(srv, req, newHTTPHandler(false))
+		if !keepAlive {
+			srv.Close()
+		}
+	}()
+
+	fmt.Fprintf(client, "GET /healthz HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+	res, err := http.ReadResponse(bufio.NewReader(client), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Close {
+		t.Errorf("expected the response to close the connection")
+	}
+}
+
+func TestPublicMetrics(t *testing.T) {
+	rec := httptest.NewRecorder()
+	newHTTPHandler(true).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if rec.Code != 200 || !strings.Contains(rec.Body.String(), "# TYPE") {
+		t.Errorf("expected the metrics, got %d %q", rec.Code, rec.Body.String())
+	}
+}
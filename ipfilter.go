@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// ipFilter decides which addresses may connect at all. Denied networks are
+// always refused, and when there are allowed networks everyone outside them
+// is refused too. The zero value allows everyone.
+type ipFilter struct {
+	mu    sync.RWMutex
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+// allowed reports whether 'ip' may connect, and if not which list refused it
+func (f *ipFilter) allowed(ip netip.Addr) (bool, string) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if containsAddr(f.deny, ip) {
+		return false, "deny"
+	}
+	if len(f.allow) > 0 && !containsAddr(f.allow, ip) {
+		return false, "allow"
+	}
+	return true, ""
+}
+
+// setLists replaces both lists, connections that are already open are kept
+func (f *ipFilter) setLists(allow, deny []netip.Prefix) {
+	f.mu.Lock()
+	f.allow, f.deny = allow, deny
+	f.mu.Unlock()
+}
+
+// lists returns copies of the allow and deny lists
+func (f *ipFilter) lists() (allow, deny []netip.Prefix) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return slices.Clone(f.allow), slices.Clone(f.deny)
+}
+
+// add adds 'p' to the deny list when 'deny' is set, otherwise the allow list.
+// It reports whether the list changed.
+func (f *ipFilter) add(deny bool, p netip.Prefix) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	list := &f.allow
+	if deny {
+		list = &f.deny
+	}
+	if slices.Contains(*list, p) {
+		return false
+	}
+	*list = append(slices.Clip(*list), p)
+	return true
+}
+
+// remove removes 'p' from the deny list when 'deny' is set, otherwise the
+// allow list. It reports whether the list changed.
+func (f *ipFilter) remove(deny bool, p netip.Prefix) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	list := &f.allow
+	if deny {
+		list = &f.deny
+	}
+	i := slices.Index(*list, p)
+	if i < 0 {
+		return false
+	}
+	*list = slices.Delete(slices.Clone(*list), i, i+1)
+	return true
+}
+
+func containsAddr(prefixes []netip.Prefix, ip netip.Addr) bool {
+	for _, p := range prefixes {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePrefix parses a CIDR network, a bare address is a network of just that
+// address. IPv4-mapped IPv6 networks are unmapped to match how addresses are
+// compared.
+func parsePrefix(s string) (netip.Prefix, error) {
+	s = strings.TrimSpace(s)
+	if !strings.Contains(s, "/") {
+		ip, err := netip.ParseAddr(s)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid address or network %q", s)
+		}
+		ip = ip.Unmap()
+		return netip.PrefixFrom(ip, ip.BitLen()), nil
+	}
+
+	p, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid address or network %q", s)
+	}
+	if ip := p.Addr(); ip.Is4In6() {
+		if p.Bits() < 96 {
+			return netip.Prefix{}, fmt.Errorf("invalid IPv4-mapped network %q", s)
+		}
+		p = netip.PrefixFrom(ip.Unmap(), p.Bits()-96)
+	}
+	return p.Masked(), nil
+}
+
+// parsePrefixes parses each of 's' with parsePrefix
+func parsePrefixes(s []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(s))
+	for _, v := range s {
+		p, err := parsePrefix(v)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, p)
+	}
+	return prefixes, nil
+}
+
+func prefixStrings(prefixes []netip.Prefix) []string {
+	s := make([]string, len(prefixes))
+	for i, p := range prefixes {
+		s[i] = p.String()
+	}
+	return s
+}
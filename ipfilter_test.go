@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestIPFilter(t *testing.T) {
+	var f ipFilter
+	if ok, _ := f.allowed(netip.MustParseAddr("192.0.2.1")); !ok {
+		t.Errorf("expected an empty filter to allow everyone")
+	}
+
+	allow, err := parsePrefixes([]string{"192.0.2.0/24", "2001:db8::/32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deny, err := parsePrefixes([]string{"192.0.2.128/25", "::ffff:192.0.2.7"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.setLists(allow, deny)
+
+	for _, test := range []struct {
+		ip   string
+		ok   bool
+		list string
+	}{
+		{"192.0.2.1", true, ""},
+		{"2001:db8::1", true, ""},
+		{"192.0.2.200", false, "deny"},
+		{"192.0.2.7", false, "deny"},
+		{"198.51.100.1", false, "allow"},
+		{"2001:db9::1", false, "allow"},
+	} {
+		ok, list := f.allowed(netip.MustParseAddr(test.ip))
+		if ok != test.ok || list != test.list {
+			t.Errorf("%s: expected %t %q, got %t %q", test.ip, test.ok, test.list, ok, list)
+		}
+	}
+
+	p := netip.MustParsePrefix("192.0.2.1/32")
+	if !f.add(true, p) || f.add(true, p) {
+		t.Errorf("expected a network to be added once")
+	}
+	if ok, _ := f.allowed(p.Addr()); ok {
+		t.Errorf("expected an added network to be denied")
+	}
+	if !f.remove(true, p) || f.remove(true, p) {
+		t.Errorf("expected a network to be removed once")
+	}
+	if ok, _ := f.allowed(p.Addr()); !ok {
+		t.Errorf("expected a removed network to be allowed again")
+	}
+}
+
+func TestParsePrefix(t *testing.T) {
+	for in, want := range map[string]string{
+		"10.1.2.3":            "10.1.2.3/32",
+		"10.1.2.3/8":          "10.0.0.0/8",
+		"2001:db8::1":         "2001:db8::1/128",
+		"::ffff:10.0.0.0/104": "10.0.0.0/8",
+	} {
+		p, err := parsePrefix(in)
+		if err != nil {
+			t.Errorf("%s: %v", in, err)
+			continue
+		}
+		if p.String() != want {
+			t.Errorf("%s: expected %s, got %s", in, want, p)
+		}
+	}
+
+	for _, bad := range []string{"", "10.0.0.0/33", "example.com", "::ffff:10.0.0.0/64"} {
+		if _, err := parsePrefix(bad); err == nil {
+			t.Errorf("expected %q to be invalid", bad)
+		}
+	}
+}
+
+func TestServerIPFilter(t *testing.T) {
+	s := &server{}
+	s.filter.setLists(nil, []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")})
+	l, err := s.listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go s.serve(context.Background(), l)
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// The connection is closed without anything being read or written
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := c.Read(make([]byte, 1)); err == nil || n != 0 {
+		t.Errorf("expected a denied connection to be closed, read %d byte(s): %v", n, err)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync/atomic"
+)
+
+// lastConnID is the ID of the most recently accepted connection
+var lastConnID atomic.Uint64
+
+// newConnID returns an ID that's unique to the connection for the lifetime of
+// the process
+func newConnID() uint64 {
+	return lastConnID.Add(1)
+}
+
+// payloadValue logs frame payloads lazily, only showing their content when
+// 'show' is set since they may contain user data
+type payloadValue struct {
+	data []byte
+	show bool
+}
+
+func (p payloadValue) LogValue() slog.Value {
+	if !p.show {
+		return slog.StringValue(fmt.Sprintf("[%d byte(s) redacted]", len(p.data)))
+	}
+	return slog.StringValue(fmt.Sprintf("%q", p.data))
+}
+
+// parseLogLevel parses "debug", "info", "warn" or "error"
+func parseLogLevel(s string) (slog.Level, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(s)); err != nil {
+		return l, fmt.Errorf("unknown log level %q", s)
+	}
+	return l, nil
+}
+
+// newLogger creates a logger writing to 'w' in 'format', either "text" or
+// "json", at 'level' and above
+func newLogger(w io.Writer, format string, level slog.Leveler) (*slog.Logger, error) {
+	opts := &slog.HandlerOptions{Level: level}
+	switch strings.ToLower(format) {
+	case "", "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	}
+	return nil, fmt.Errorf("unknown log format %q", format)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// syncBuffer is a bytes.Buffer that can be logged to from several goroutines
+type syncBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.String()
+}
+
+func TestConnLogging(t *testing.T) {
+	for _, show := range []bool{false, true} {
+		var out syncBuffer
+		logger, err := newLogger(&out, "text", slog.LevelDebug)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		client, srv := net.Pipe()
+		c := newConn(context.Background(), srv, nil)
+		c.log = logger.With("conn_id", c.id)
+		c.logPayloads = show
+		go c.handle()
+
+		if err := writeFrame(client, true, text, []byte("s3cret")); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := readFrame(bufio.NewReader(client)); err != nil {
+			t.Fatal(err)
+		}
+		client.Close()
+		<-c.done
+
+		logs := out.String()
+		for _, line := range strings.Split(strings.TrimSpace(logs), "\n") {
+			if !strings.Contains(line, "conn_id=") {
+				t.Errorf("expected every record to carry the connection id: %s", line)
+			}
+		}
+		if strings.Contains(logs, "s3cret") != show {
+			t.Errorf("logPayloads=%t but payload presence in logs was %t:\n%s", show, !show, logs)
+		}
+	}
+}
+
+func TestNewLogger(t *testing.T) {
+	var out bytes.Buffer
+	logger, err := newLogger(&out, "json", slog.LevelWarn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Info("hidden")
+	logger.Warn("shown")
+	if strings.Contains(out.String(), "hidden") || !strings.Contains(out.String(), `"msg":"shown"`) {
+		t.Errorf("unexpected output: %s", out.String())
+	}
+
+	if _, err := newLogger(&out, "xml", slog.LevelInfo); err == nil {
+		t.Errorf("expected unknown format to be rejected")
+	}
+	if _, err := parseLogLevel("loud"); err == nil {
+		t.Errorf("expected unknown level to be rejected")
+	}
+}
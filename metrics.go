@@ -0,0 +1,310 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// metric is anything that can be written in the Prometheus text format
+type metric interface {
+	writeTo(w io.Writer) error
+}
+
+// registry holds every metric exposed by the server, in the order they were
+// registered
+type registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+func (r *registry) register(m metric) {
+	r.mu.Lock()
+	r.metrics = append(r.metrics, m)
+	r.mu.Unlock()
+}
+
+// writeTo writes every metric in the Prometheus text exposition format
+func (r *registry) writeTo(w io.Writer) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, m := range r.metrics {
+		if err := m.writeTo(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ServeHTTP exposes the registry, so it can be mounted on any HTTP handler
+func (r *registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.writeTo(w)
+}
+
+type desc struct {
+	name   string
+	help   string
+	labels []string
+}
+
+func (d *desc) writeHeader(w io.Writer, typ string) error {
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.name, d.help, d.name, typ)
+	return err
+}
+
+// labelString formats label pairs as {a="x",b="y"}, 'extra' is appended as is
+func (d *desc) labelString(values []string, extra string) string {
+	pairs := make([]string, 0, len(values)+1)
+	for i, v := range values {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", d.labels[i], v))
+	}
+	if extra != "" {
+		pairs = append(pairs, extra)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// vec holds one child per combination of label values
+type vec[T any] struct {
+	desc
+	mu       sync.Mutex
+	children map[string]*T
+	values   map[string][]string
+	newChild func() *T
+}
+
+func (v *vec[T]) with(values ...string) *T {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metric %s expects %d label(s), got %d", v.name, len(v.labels), len(values)))
+	}
+
+	key := strings.Join(values, "\xff")
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	child, ok := v.children[key]
+	if !ok {
+		child = v.newChild()
+		v.children[key] = child
+		v.values[key] = values
+	}
+	return child
+}
+
+// each calls 'f' for every child, sorted by label values so the output is stable
+func (v *vec[T]) each(f func(values []string, child *T) error) error {
+	v.mu.Lock()
+	keys := make([]string, 0, len(v.children))
+	for k := range v.children {
+		keys = append(keys, k)
+	}
+	v.mu.Unlock()
+
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		v.mu.Lock()
+		child, values := v.children[k], v.values[k]
+		v.mu.Unlock()
+
+		if err := f(values, child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newVec[T any](name, help string, labels []string, newChild func() *T) *vec[T] {
+	return &vec[T]{
+		desc:     desc{name, help, labels},
+		children: make(map[string]*T),
+		values:   make(map[string][]string),
+		newChild: newChild,
+	}
+}
+
+type counter struct {
+	v atomic.Uint64
+}
+
+func (c *counter) inc() {
+	c.v.Add(1)
+}
+
+func (c *counter) add(n uint64) {
+	c.v.Add(n)
+}
+
+type counterVec struct {
+	*vec[counter]
+}
+
+func newCounterVec(r *registry, name, help string, labels ...string) *counterVec {
+	v := &counterVec{newVec(name, help, labels, func() *counter { return &counter{} })}
+	r.register(v)
+	return v
+}
+
+func (v *counterVec) writeTo(w io.Writer) error {
+	if err := v.writeHeader(w, "counter"); err != nil {
+		return err
+	}
+	return v.each(func(values []string, c *counter) error {
+		_, err := fmt.Fprintf(w, "%s%s %d\n", v.name, v.labelString(values, ""), c.v.Load())
+		return err
+	})
+}
+
+type gauge struct {
+	desc
+	v atomic.Int64
+}
+
+func newGauge(r *registry, name, help string) *gauge {
+	g := &gauge{desc: desc{name: name, help: help}}
+	r.register(g)
+	return g
+}
+
+func (g *gauge) inc() {
+	g.v.Add(1)
+}
+
+func (g *gauge) dec() {
+	g.v.Add(-1)
+}
+
+func (g *gauge) writeTo(w io.Writer) error {
+	if err := g.writeHeader(w, "gauge"); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "%s %d\n", g.name, g.v.Load())
+	return err
+}
+
+type histogram struct {
+	// buckets are the upper bounds, +Inf is implied
+	buckets []float64
+	mu      sync.Mutex
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func (h *histogram) observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, b := range h.buckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+type histogramVec struct {
+	*vec[histogram]
+}
+
+func newHistogramVec(r *registry, name, help string, buckets []float64, labels ...string) *histogramVec {
+	v := &histogramVec{newVec(name, help, labels, func() *histogram {
+		return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+	})}
+	r.register(v)
+	return v
+}
+
+func (v *histogramVec) writeTo(w io.Writer) error {
+	if err := v.writeHeader(w, "histogram"); err != nil {
+		return err
+	}
+	return v.each(func(values []string, h *histogram) error {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+
+		for i, b := range h.buckets {
+			le := fmt.Sprintf("le=%q", strconv.FormatFloat(b, 'g', -1, 64))
+			if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, v.labelString(values, le), h.counts[i]); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, v.labelString(values, `le="+Inf"`), h.count); err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "%s_sum%s %s\n", v.name, v.labelString(values, ""), strconv.FormatFloat(h.sum, 'g', -1, 64)); err != nil {
+			return err
+		}
+		_, err := fmt.Fprintf(w, "%s_count%s %d\n", v.name, v.labelString(values, ""), h.count)
+		return err
+	})
+}
+
+// exponentialBuckets returns 'count' buckets starting at 'start', each
+// 'factor' times the previous
+func exponentialBuckets(start, factor float64, count int) []float64 {
+	buckets := make([]float64, count)
+	for i := range buckets {
+		buckets[i] = start * math.Pow(factor, float64(i))
+	}
+	return buckets
+}
+
+// serverMetrics are the metrics recorded by the server
+type serverMetrics struct {
+	registry
+
+	activeConns    *gauge
+	handshakes     *counterVec
+	frames         *counterVec
+	bytes          *counterVec
+	messageSize    *histogramVec
+	closeCodes     *counterVec
+	pingRTT        *histogramVec
+	sendQueueDrops *counterVec
+	rateLimited    *counterVec
+	filtered       *counterVec
+	panics         *counterVec
+}
+
+func newServerMetrics() *serverMetrics {
+	m := &serverMetrics{}
+	m.activeConns = newGauge(&m.registry, "fws_active_connections", "Number of open WebSocket connections.")
+	m.handshakes = newCounterVec(&m.registry, "fws_handshakes_total", "Upgrade requests by result and rejection reason.", "result", "reason")
+	m.frames = newCounterVec(&m.registry, "fws_frames_total", "Frames by direction and op code.", "direction", "opcode")
+	m.bytes = newCounterVec(&m.registry, "fws_payload_bytes_total", "Frame payload bytes by direction and op code.", "direction", "opcode")
+	m.messageSize = newHistogramVec(&m.registry, "fws_message_size_bytes", "Size of complete data messages by direction.", exponentialBuckets(64, 4, 8), "direction")
+	m.closeCodes = newCounterVec(&m.registry, "fws_close_codes_total", "Close frames by direction and status code.", "direction", "code")
+	m.pingRTT = newHistogramVec(&m.registry, "fws_ping_rtt_seconds", "Round trip time of server sent pings.", exponentialBuckets(0.001, 2, 12))
+	m.sendQueueDrops = newCounterVec(&m.registry, "fws_send_queue_drops_total", "Messages dropped because a connection's send queue was full.")
+	m.rateLimited = newCounterVec(&m.registry, "fws_rate_limited_total", "Messages and frames held back by connection rate limits, by direction and action.", "direction", "action")
+	m.filtered = newCounterVec(&m.registry, "fws_filtered_connections_total", "Connections refused by the IP filter, by the list that refused them.", "list")
+	m.panics = newCounterVec(&m.registry, "fws_panics_total", "Panics recovered while serving a connection, by whether it had been upgraded.", "stage")
+	return m
+}
+
+// metrics is shared by every server in the process, as a Prometheus scrape
+// would see it
+var metrics = newServerMetrics()
+
+// handshakeAccepted and handshakeRejected record the result of an upgrade
+func (m *serverMetrics) handshakeAccepted() {
+	m.handshakes.with("accepted", "").inc()
+}
+
+func (m *serverMetrics) handshakeRejected(reason string) {
+	m.handshakes.with("rejected", reason).inc()
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRegistryFormat(t *testing.T) {
+	var r registry
+	c := newCounterVec(&r, "test_total", "A counter.", "op")
+	g := newGauge(&r, "test_open", "A gauge.")
+	h := newHistogramVec(&r, "test_seconds", "A histogram.", []float64{0.1, 1})
+
+	c.with("text").add(3)
+	c.with("binary").inc()
+	g.inc()
+	g.inc()
+	g.dec()
+	h.with().observe(0.05)
+	h.with().observe(0.5)
+	h.with().observe(5)
+
+	var b bytes.Buffer
+	if err := r.writeTo(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `# HELP test_total A counter.
+# TYPE test_total counter
+test_total{op="binary"} 1
+test_total{op="text"} 3
+# HELP test_open A gauge.
+# TYPE test_open gauge
+test_open 1
+# HELP test_seconds A histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{le="0.1"} 1
+test_seconds_bucket{le="1"} 2
+test_seconds_bucket{le="+Inf"} 3
+test_seconds_sum 5.55
+test_seconds_count 3
+`
+	if b.String() != expected {
+		t.Errorf("unexpected output:\n%s\nexpected:\n%s", b.String(), expected)
+	}
+}
+
+func TestPingPong(t *testing.T) {
+	client, srv := net.Pipe()
+	defer client.Close()
+
+	c := newConn(context.Background(), srv, nil)
+	go c.handle()
+	go c.keepAlive(10 * time.Millisecond)
+
+	r := bufio.NewReader(client)
+	h, data, err := readFrame(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.op != ping || len(data) != 8 {
+		t.Fatalf("expected ping with timestamp, got %s of %d byte(s)", h.op, len(data))
+	}
+
+	before := metricCount(t, "fws_ping_rtt_seconds_count")
+	if err := writeFrame(client, true, pong, data); err != nil {
+		t.Fatal(err)
+	}
+
+	// The pong mustn't end up in the next echoed message
+	if err := writeFrame(client, true, text, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		h, data, err = readFrame(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h.op != ping {
+			break
+		}
+	}
+	if h.op != text || string(data) != "hello" {
+		t.Errorf("expected echo of hello, got %s %q", h.op, data)
+	}
+
+	if after := metricCount(t, "fws_ping_rtt_seconds_count"); after != before+1 {
+		t.Errorf("expected the round trip to be recorded, count went from %d to %d", before, after)
+	}
+}
+
+// metricCount returns the value of the first sample named 'name'
+func metricCount(t *testing.T, name string) int {
+	t.Helper()
+
+	var b bytes.Buffer
+	metrics.writeTo(&b)
+	for _, line := range strings.Split(b.String(), "\n") {
+		if v, ok := strings.CutPrefix(line, name+" "); ok {
+			n, _ := strconv.Atoi(v)
+			return n
+		}
+	}
+	return 0
+}
@@ -49,3 +49,7 @@ func (o opCode) isReserved() bool {
 	}
 	return false
 }
+
+func (o opCode) isData() bool {
+	return o == text || o == binary
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+)
+
+// originPolicy decides which web pages may open a connection. Browsers always
+// send an Origin header, so checking it stops other sites from opening a
+// socket with the user's cookies. The zero value only allows same-origin
+// requests.
+type originPolicy struct {
+	// allowed lists origins that may connect in addition to the request's own
+	// host, such as "https://example.com". The scheme may be left out to allow
+	// any, and the host may start with "*." to allow every subdomain.
+	allowed []string
+	// check, when set, is used instead of the same-origin and allowlist checks
+	check func(r *request, origin *url.URL) bool
+	// allowAny disables origin checking
+	allowAny bool
+}
+
+// allow reports whether 'r' passes the policy
+func (p *originPolicy) allow(r *request) bool {
+	if p.allowAny {
+		return true
+	}
+
+	o := r.header.Get("Origin")
+	if o == "" {
+		// Non-browser clients don't send an Origin and can't be abused to
+		// act on behalf of a user
+		return p.check == nil || p.check(r, nil)
+	}
+
+	origin, err := url.Parse(o)
+	if err != nil || origin.Host == "" {
+		return false
+	}
+
+	if p.check != nil {
+		return p.check(r, origin)
+	}
+
+	if strings.EqualFold(origin.Host, r.host) {
+		return true
+	}
+
+	for _, pattern := range p.allowed {
+		if matchOrigin(pattern, origin) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchOrigin reports whether 'origin' matches an allowlist entry
+func matchOrigin(pattern string, origin *url.URL) bool {
+	scheme, host, ok := strings.Cut(pattern, "://")
+	if !ok {
+		scheme, host = "", pattern
+	}
+
+	if scheme != "" && !strings.EqualFold(scheme, origin.Scheme) {
+		return false
+	}
+
+	if suffix, ok := strings.CutPrefix(host, "*."); ok {
+		// The wildcard only covers subdomains, not the domain itself
+		return len(origin.Host) > len(suffix)+1 &&
+			strings.HasSuffix(strings.ToLower(origin.Host), "."+strings.ToLower(suffix))
+	}
+
+	return strings.EqualFold(host, origin.Host)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestOriginPolicy(t *testing.T) {
+	policy := &originPolicy{allowed: []string{"https://app.example.com", "*.trusted.dev"}}
+
+	tests := []struct {
+		origin string
+		allow  bool
+	}{
+		{"", true},
+		{"http://localhost:3000", true},
+		{"https://app.example.com", true},
+		{"http://app.example.com", false},
+		{"https://a.trusted.dev", true},
+		{"http://a.b.trusted.dev", true},
+		{"https://trusted.dev", false},
+		{"https://eviltrusted.dev", false},
+		{"https://evil.com", false},
+		{"null", false},
+	}
+
+	for _, test := range tests {
+		r := &request{host: "localhost:3000", header: http.Header{}}
+		if test.origin != "" {
+			r.header.Set("Origin", test.origin)
+		}
+		if got := policy.allow(r); got != test.allow {
+			t.Errorf("origin %q: expected allow=%t, got %t", test.origin, test.allow, got)
+		}
+	}
+}
+
+func TestOriginPolicyCheck(t *testing.T) {
+	policy := &originPolicy{check: func(r *request, origin *url.URL) bool {
+		return origin != nil && origin.Hostname() == "partner.io"
+	}}
+
+	r := &request{host: "localhost", header: http.Header{"Origin": {"https://partner.io"}}}
+	if !policy.allow(r) {
+		t.Errorf("expected custom check to allow partner.io")
+	}
+
+	r = &request{host: "localhost", header: http.Header{"Origin": {"http://localhost"}}}
+	if policy.allow(r) {
+		t.Errorf("expected custom check to replace the same-origin check")
+	}
+}
+
+func TestUpgradeOrigin(t *testing.T) {
+	res, _ := upgradeOverPipe(t, &upgradeOptions{}, "/", "Origin: https://evil.com")
+	if res.StatusCode != 403 {
+		t.Errorf("expected cross-site upgrade to be rejected with 403, got %d", res.StatusCode)
+	}
+
+	res, _ = upgradeOverPipe(t, &upgradeOptions{}, "/", "Origin: http://localhost")
+	if res.StatusCode != 101 {
+		t.Errorf("expected same-origin upgrade to be accepted, got %d", res.StatusCode)
+	}
+}
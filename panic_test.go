@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// panicHandler panics on "boom" and echoes everything else
+func panicHandler(c *conn, op opCode, data []byte) error {
+	if string(data) == "boom" {
+		panic("boom")
+	}
+	return echoHandler(c, op, data)
+}
+
+func TestRecoverPanic(t *testing.T) {
+	s := &server{handler: panicHandler}
+	l := startServer(t, s)
+	url := "ws://" + l.Addr().String() + "/"
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	before := metrics.panics.with("conn").v.Load()
+
+	c, _, err := dial(ctx, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.writeMessage(ctx, text, []byte("boom")); err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = c.readMessage(ctx)
+	var ce *CloseError
+	if !errors.As(err, &ce) || ce.Code != statusUnexpected {
+		t.Errorf("expected a close with %d, got %v", statusUnexpected, err)
+	}
+	if n := metrics.panics.with("conn").v.Load(); n != before+1 {
+		t.Errorf("expected the panic to be counted, got %d more", n-before)
+	}
+
+	// Other connections carry on as if nothing happened
+	c, _, err = dial(ctx, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.writeMessage(ctx, text, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, data, err := c.readMessage(ctx); err != nil || string(data) != "hello" {
+		t.Errorf("expected echo of hello, got %q %v", data, err)
+	}
+}
+
+func TestCrashOnPanic(t *testing.T) {
+	client, srv := net.Pipe()
+	defer client.Close()
+
+	c := newConn(context.Background(), srv, nil)
+	c.handler = panicHandler
+	c.crashOnPanic = true
+
+	panicked := make(chan any, 1)
+	go func() {
+		defer func() { panicked <- recover() }()
+		c.handle()
+	}()
+	go writeFrame(client, true, text, []byte("boom"))
+
+	select {
+	case v := <-panicked:
+		if v != "boom" {
+			t.Errorf("expected the panic to be left alone, got %v", v)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected handle to panic")
+	}
+}
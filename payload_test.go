@@ -4,16 +4,17 @@ import (
     "testing"
     "bufio"
     "bytes"
+    "fmt"
 )
 
 func TestPayloadRead(t *testing.T) {
-    var data []byte = []byte{ 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16 }
+    var data []byte = []byte{ 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20, 21, 22, 23, 24, 25 }
     var r *bufio.Reader = bufio.NewReader(bytes.NewBuffer(data))
 
-    payload := newPayload(r)
-    
+    payload := newPayloadSize(64)
+
     // Read 1
-    if _, err := payload.read(5); err != nil {
+    if _, err := payload.read(r, 5); err != nil {
         t.Errorf("failed to read 1st payload: %v", err)
     }
     t.Logf("frames 1: %v", payload.last)
@@ -23,30 +24,83 @@ func TestPayloadRead(t *testing.T) {
     }
 
     if payload.last == nil {
-        t.Errorf("successful read but payload.last == nil")
+        t.Fatalf("successful read but payload.last == nil")
     }
 
     // Read 2
-    if _, err := payload.read(5); err != nil {
+    if _, err := payload.read(r, 5); err != nil {
         t.Errorf("failed to read 2nd payload: %v", err)
     }
     t.Logf("frames 2: %v", payload.last)
 
     // Combined
-    t.Logf("combined %v\n", payload.combine())
-    
-    // Read 3
-    if n, err := payload.read(10); err != nil {
+    if combined := payload.combine(); !bytes.Equal(combined, data[:10]) {
+        t.Errorf("expected combined payload %v, got %v", data[:10], combined)
+    }
+
+    // Read 3, a control frame in the middle of the message
+    if n, err := payload.read(r, 10); err != nil {
         t.Errorf("err=%v, n=%d\n", err, n)
     }
     t.Logf("frames 3: %v", payload.last)
 
     payload.pop()
 
+    if payload.length() != 10 {
+        t.Errorf("expected length 10 after pop, got %d", payload.length())
+    }
 
-    if _, err := payload.read(5); err != nil {
-        t.Errorf("failed to read 3rd payload: %v", err)
+    if _, err := payload.read(r, 5); err != nil {
+        t.Errorf("failed to read 4th payload: %v", err)
     }
 
     t.Logf("frames 4: %v", payload.last)
+
+    want := append(append([]byte{}, data[:10]...), data[20:]...)
+    if combined := payload.combine(); !bytes.Equal(combined, want) {
+        t.Errorf("expected combined payload %v, got %v", want, combined)
+    }
+
+    if _, err := payload.read(r, 64); err == nil {
+        t.Errorf("expected a read beyond capacity to fail")
+    }
+}
+
+func BenchmarkPayloadReserve(b *testing.B) {
+    for _, size := range []int{125, 4 << 10, 64 << 10} {
+        b.Run(sizeName(size), func(b *testing.B) {
+            p := newPayloadSize(1 << 20)
+            b.ReportAllocs()
+            b.ResetTimer()
+            for i := 0; i < b.N; i++ {
+                // Start again once the buffer is full, as a new message would
+                if size > p.capacity() {
+                    p.reset()
+                }
+                if _, err := p.reserve(size); err != nil {
+                    b.Fatal(err)
+                }
+            }
+        })
+    }
+}
+
+func BenchmarkPayloadCombine(b *testing.B) {
+    for _, frames := range []int{1, 16, 256} {
+        b.Run(fmt.Sprintf("%dframes", frames), func(b *testing.B) {
+            p := newPayloadSize(1 << 20)
+            for i := 0; i < frames; i++ {
+                if _, err := p.reserve(1024); err != nil {
+                    b.Fatal(err)
+                }
+            }
+            b.ReportAllocs()
+            b.ResetTimer()
+            for i := 0; i < b.N; i++ {
+                if len(p.combine()) != frames * 1024 {
+                    b.Fatal("combined payload is the wrong length")
+                }
+            }
+        })
+    }
 }
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyHeaderTimeout bounds reading the PROXY protocol header
+const proxyHeaderTimeout = 5 * time.Second
+
+// proxyV2Signature starts every version 2 PROXY protocol header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyListener accepts connections that start with a PROXY protocol header,
+// as sent by HAProxy and most load balancers
+type proxyListener struct {
+	net.Listener
+}
+
+// Accept doesn't wait for the header so a slow client can't hold up the
+// listener, it's read by the first Read or RemoteAddr
+func (l proxyListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: c}, nil
+}
+
+// proxyConn reports the client address given by its PROXY protocol header as
+// its remote address
+type proxyConn struct {
+	net.Conn
+	once   sync.Once
+	r      *bufio.Reader
+	remote net.Addr
+	err    error
+}
+
+// init reads the header, the first call does the work and the rest return
+// its result
+func (c *proxyConn) init() error {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		c.r = bufio.NewReader(c.Conn)
+		c.remote, c.err = readProxyHeader(c.r)
+		c.Conn.SetReadDeadline(time.Time{})
+	})
+	return c.err
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	if err := c.init(); err != nil {
+		return 0, err
+	}
+	// Anything read past the header is still buffered
+	if c.r.Buffered() > 0 {
+		return c.r.Read(b)
+	}
+	return c.Conn.Read(b)
+}
+
+// RemoteAddr returns the client's address from the header, or the peer's
+// address when the header doesn't have one such as for health checks
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if c.init() == nil && c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// asProxyConn returns the proxyConn underneath 'c', or nil when it isn't one
+func asProxyConn(c net.Conn) *proxyConn {
+	if tc, ok := c.(*tls.Conn); ok {
+		c = tc.NetConn()
+	}
+	pc, _ := c.(*proxyConn)
+	return pc
+}
+
+// readProxyHeader reads a version 1 or 2 PROXY protocol header and returns
+// the source address it gives, which is nil when it gives none
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	switch b[0] {
+	case 'P':
+		return readProxyHeaderV1(r)
+	case '\r':
+		return readProxyHeaderV2(r)
+	}
+	return nil, errors.New("missing PROXY protocol header")
+}
+
+// readProxyHeaderV1 reads a human readable header such as
+// "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, error) {
+	// A header is at most 107 bytes, including the CRLF
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("PROXY protocol header too long or not terminated by CRLF")
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if fields[0] != "PROXY" || len(fields) < 2 {
+		return nil, fmt.Errorf("invalid PROXY protocol header %q", line)
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("invalid PROXY protocol header %q", line)
+	}
+
+	ip, err := netip.ParseAddr(fields[2])
+	if err != nil || ip.Is4() != (fields[1] == "TCP4") {
+		return nil, fmt.Errorf("invalid source address in PROXY protocol header %q", line)
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid source port in PROXY protocol header %q", line)
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, uint16(port))), nil
+}
+
+// readProxyHeaderV2 reads a binary header
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, error) {
+	var h [16]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(h[:12], proxyV2Signature) {
+		return nil, errors.New("invalid PROXY protocol v2 signature")
+	}
+	if h[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version %d", h[12]>>4)
+	}
+
+	data := make([]byte, int(h[14])<<8|int(h[15]))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+
+	// LOCAL connections are the proxy's own, such as health checks
+	switch cmd := h[12] & 0x0f; cmd {
+	case 0x0:
+		return nil, nil
+	case 0x1:
+	default:
+		return nil, fmt.Errorf("unsupported PROXY protocol v2 command %d", cmd)
+	}
+
+	// Only TCP over IPv4 and IPv6 carry an address we can use, any TLVs
+	// after the addresses are ignored
+	var ip netip.Addr
+	var port []byte
+	switch h[13] {
+	case 0x11:
+		if len(data) < 12 {
+			return nil, errors.New("PROXY protocol v2 address block too short")
+		}
+		ip = netip.AddrFrom4([4]byte(data[0:4]))
+		port = data[8:10]
+	case 0x21:
+		if len(data) < 36 {
+			return nil, errors.New("PROXY protocol v2 address block too short")
+		}
+		ip = netip.AddrFrom16([16]byte(data[0:16]))
+		port = data[32:34]
+	default:
+		return nil, nil
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip.Unmap(), uint16(port[0])<<8|uint16(port[1]))), nil
+}
+
+// forwardedClient returns the client's address from the Forwarded or
+// X-Forwarded-For header of a request sent by a trusted proxy. The addresses
+// are walked back from the nearest proxy, and the first that isn't one of
+// 'trusted' is the client.
+func forwardedClient(h http.Header, trusted []netip.Prefix) (netip.Addr, bool) {
+	var hops []string
+	if values := h.Values("Forwarded"); len(values) > 0 {
+		for _, v := range values {
+			for _, elem := range strings.Split(v, ",") {
+				hops = append(hops, forwardedFor(elem))
+			}
+		}
+	} else {
+		for _, v := range h.Values("X-Forwarded-For") {
+			for _, hop := range strings.Split(v, ",") {
+				hops = append(hops, strings.TrimSpace(hop))
+			}
+		}
+	}
+
+	var client netip.Addr
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip, ok := parseForwardedAddr(hops[i])
+		if !ok {
+			// An obfuscated or unknown hop can't be trusted to have told the
+			// truth about those before it
+			return client, client.IsValid()
+		}
+		client = ip
+		if !containsAddr(trusted, ip) {
+			break
+		}
+	}
+	return client, client.IsValid()
+}
+
+// forwardedFor returns the for= parameter of a Forwarded header element
+func forwardedFor(elem string) string {
+	for _, pair := range strings.Split(elem, ";") {
+		k, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if ok && strings.EqualFold(k, "for") {
+			return strings.Trim(v, `"`)
+		}
+	}
+	return ""
+}
+
+// parseForwardedAddr parses an address with an optional port, IPv6 addresses
+// with a port are in brackets
+func parseForwardedAddr(s string) (netip.Addr, bool) {
+	if ap, err := netip.ParseAddrPort(s); err == nil {
+		return ap.Addr().Unmap(), true
+	}
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+	ip, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return ip.Unmap(), true
+}
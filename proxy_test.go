@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+// proxyV2Header builds a version 2 PROXY header for a TCP connection from
+// 'src', a nil 'src' builds a LOCAL header
+func proxyV2Header(src *net.TCPAddr) []byte {
+	h := append([]byte{}, proxyV2Signature...)
+	if src == nil {
+		return append(h, 0x20, 0x00, 0x00, 0x00)
+	}
+
+	var addrs []byte
+	fam := byte(0x11)
+	if ip4 := src.IP.To4(); ip4 != nil {
+		addrs = append(addrs, ip4...)
+		addrs = append(addrs, 127, 0, 0, 1)
+	} else {
+		fam = 0x21
+		addrs = append(addrs, src.IP.To16()...)
+		addrs = append(addrs, net.IPv6loopback...)
+	}
+	addrs = append(addrs, byte(src.Port>>8), byte(src.Port), 0x01, 0xbb)
+	// A TLV, which is ignored
+	addrs = append(addrs, 0x04, 0x00, 0x01, 0xff)
+
+	h = append(h, 0x21, fam, byte(len(addrs)>>8), byte(len(addrs)))
+	return append(h, addrs...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		header string
+		addr   string
+		err    bool
+	}{
+		{"v1 tcp4", "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n", "192.0.2.1:56324", false},
+		{"v1 tcp6", "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n", "[2001:db8::1]:56324", false},
+		{"v1 unknown", "PROXY UNKNOWN\r\n", "", false},
+		{"v1 mismatched family", "PROXY TCP4 2001:db8::1 2001:db8::2 56324 443\r\n", "", true},
+		{"v1 bad port", "PROXY TCP4 192.0.2.1 198.51.100.1 99999 443\r\n", "", true},
+		{"v1 no crlf", "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\n", "", true},
+		{"v1 too long", "PROXY " + strings.Repeat("x", 200) + "\r\n", "", true},
+		{"v2 tcp4", string(proxyV2Header(&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 56324})), "192.0.2.1:56324", false},
+		{"v2 tcp6", string(proxyV2Header(&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324})), "[2001:db8::1]:56324", false},
+		{"v2 local", string(proxyV2Header(nil)), "", false},
+		{"v2 bad signature", "\r\n\r\n\x00\r\nQUIT!\x21\x11\x00\x00", "", true},
+		{"missing", "GET / HTTP/1.1\r\n", "", true},
+	} {
+		r := bufio.NewReader(strings.NewReader(test.header + "rest"))
+		addr, err := readProxyHeader(r)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+
+		got := ""
+		if addr != nil {
+			got = addr.String()
+		}
+		if got != test.addr {
+			t.Errorf("%s: expected address %q, got %q", test.name, test.addr, got)
+		}
+		if rest, _ := r.ReadString(0); rest != "rest" {
+			t.Errorf("%s: expected the data after the header to remain, got %q", test.name, rest)
+		}
+	}
+}
+
+func TestForwardedClient(t *testing.T) {
+	trusted := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+
+	for _, test := range []struct {
+		header []string
+		client string
+	}{
+		{[]string{"X-Forwarded-For", "198.51.100.7"}, "198.51.100.7"},
+		{[]string{"X-Forwarded-For", "203.0.113.1, 198.51.100.7, 10.0.0.2"}, "198.51.100.7"},
+		{[]string{"X-Forwarded-For", "10.0.0.3, 10.0.0.2"}, "10.0.0.3"},
+		{[]string{"X-Forwarded-For", "unknown, 10.0.0.2"}, "10.0.0.2"},
+		{[]string{"Forwarded", `for=192.0.2.60;proto=https, for="[2001:db8::1]:4711"`}, "2001:db8::1"},
+		{[]string{"Forwarded", "for=_hidden"}, ""},
+		{nil, ""},
+	} {
+		h := http.Header{}
+		if test.header != nil {
+			h.Set(test.header[0], test.header[1])
+		}
+		ip, ok := forwardedClient(h, trusted)
+		if test.client == "" {
+			if ok {
+				t.Errorf("%v: expected no client, got %s", test.header, ip)
+			}
+			continue
+		}
+		if !ok || ip.String() != test.client {
+			t.Errorf("%v: expected %s, got %s", test.header, test.client, ip)
+		}
+	}
+}
+
+// addrHandler responds to every message with the client's address
+func addrHandler(c *conn, op opCode, data []byte) error {
+	return c.writeMessage(c.context(), text, []byte(c.remoteAddr().String()))
+}
+
+// dialAddr upgrades a connection to 'l' after writing 'prefix', and returns
+// the address the server sees it as
+func dialAddr(t *testing.T, l net.Listener, prefix []byte, headers ...string) (string, error) {
+	t.Helper()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := c.Write(prefix); err != nil {
+		return "", err
+	}
+	if err := writeUpgradeRequest(c, "/", headers...); err != nil {
+		return "", err
+	}
+	r := bufio.NewReader(c)
+	res, err := readUpgradeResponse(r)
+	if err != nil {
+		return "", err
+	}
+	if res.StatusCode != 101 {
+		return "", &rejection{status: res.StatusCode}
+	}
+
+	if err := writeFrame(c, true, text, []byte("?")); err != nil {
+		t.Fatal(err)
+	}
+	_, data, err := readFrame(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data), nil
+}
+
+func TestServerProxyProtocol(t *testing.T) {
+	s := &server{handler: addrHandler, proxyProtocol: true}
+	s.filter.setLists(nil, []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")})
+	l, err := s.listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go s.serve(context.Background(), l)
+
+	addr, err := dialAddr(t, l, []byte("PROXY TCP4 203.0.113.9 127.0.0.1 40000 3000\r\n"))
+	if err != nil || addr != "203.0.113.9:40000" {
+		t.Errorf("expected the address from the v1 header, got %q %v", addr, err)
+	}
+
+	addr, err = dialAddr(t, l, proxyV2Header(&net.TCPAddr{IP: net.ParseIP("2001:db8::9"), Port: 40000}))
+	if err != nil || addr != "[2001:db8::9]:40000" {
+		t.Errorf("expected the address from the v2 header, got %q %v", addr, err)
+	}
+
+	if _, err := dialAddr(t, l, []byte("PROXY TCP4 192.0.2.1 127.0.0.1 40000 3000\r\n")); err == nil {
+		t.Errorf("expected the filter to apply to the proxied address")
+	}
+	if _, err := dialAddr(t, l, nil); err == nil {
+		t.Errorf("expected a connection without a header to be refused")
+	}
+}
+
+func TestServerForwardedFor(t *testing.T) {
+	s := &server{handler: addrHandler, trustedProxies: []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}}
+	s.filter.setLists(nil, []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")})
+	l, err := s.listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go s.serve(context.Background(), l)
+
+	addr, err := dialAddr(t, l, nil, "X-Forwarded-For: 198.51.100.7, 127.0.0.2")
+	if err != nil || addr != "198.51.100.7:0" {
+		t.Errorf("expected the forwarded address, got %q %v", addr, err)
+	}
+
+	_, err = dialAddr(t, l, nil, "X-Forwarded-For: 192.0.2.1")
+	if rej, ok := err.(*rejection); !ok || rej.status != http.StatusForbidden {
+		t.Errorf("expected the filter to refuse the forwarded address with 403, got %v", err)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// tokenBucket allows 'rate' events per second on average with bursts of up to
+// 'burst' events. It isn't safe for concurrent use.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	if burst < 1 {
+		burst = int(math.Max(1, math.Ceil(rate)))
+	}
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: now}
+}
+
+// refill adds the tokens earned since the last call
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(b.burst, b.tokens+elapsed*b.rate)
+	}
+	b.last = now
+}
+
+// check reports whether 'n' tokens are available without taking them,
+// otherwise it returns how long until they will be
+func (b *tokenBucket) check(now time.Time, n float64) (bool, time.Duration) {
+	b.refill(now)
+	if b.tokens >= n {
+		return true, 0
+	}
+	return false, b.wait(n)
+}
+
+// allow takes 'n' tokens if they're available, otherwise it returns how long
+// until they will be
+func (b *tokenBucket) allow(now time.Time, n float64) (bool, time.Duration) {
+	ok, wait := b.check(now, n)
+	if ok {
+		b.tokens -= n
+	}
+	return ok, wait
+}
+
+// take takes 'n' tokens even if that puts the bucket in debt, and returns
+// how long the caller should wait for the debt to be paid off
+func (b *tokenBucket) take(now time.Time, n float64) time.Duration {
+	b.refill(now)
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return b.wait(0)
+}
+
+// wait returns how long until the bucket holds 'n' tokens
+func (b *tokenBucket) wait(n float64) time.Duration {
+	if b.rate <= 0 {
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Duration((n - b.tokens) / b.rate * float64(time.Second))
+}
+
+// full reports whether the bucket has refilled completely, at which point it
+// holds no more state than a new bucket
+func (b *tokenBucket) full(now time.Time) bool {
+	b.refill(now)
+	return b.tokens >= b.burst
+}
+
+// limitPolicy is what happens to messages received faster than a
+// connection's rate limits allow
+type limitPolicy uint8
+
+const (
+	// limitDelay stops reading until the peer is back under the limit, so
+	// TCP pushes back on the sender
+	limitDelay = limitPolicy(iota)
+	// limitDrop discards messages over the limit
+	limitDrop
+	// limitClose closes the connection with statusViolation
+	limitClose
+)
+
+func (p limitPolicy) String() string {
+	switch p {
+	case limitDelay:
+		return "delay"
+	case limitDrop:
+		return "drop"
+	case limitClose:
+		return "close"
+	}
+	return ""
+}
+
+func parseLimitPolicy(s string) (limitPolicy, error) {
+	for _, p := range []limitPolicy{limitDelay, limitDrop, limitClose} {
+		if s == p.String() {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown rate limit policy %q, expected delay, drop or close", s)
+}
+
+type connLimits struct {
+	// messageRate and byteRate are the data messages and payload bytes per
+	// second a connection may send, zero is unlimited
+	messageRate  float64
+	messageBurst int
+	byteRate     float64
+	byteBurst    int
+	// policy applies when messageRate or byteRate is exceeded
+	policy limitPolicy
+	// egressByteRate shapes the payload bytes per second sent to a
+	// connection, zero is unlimited
+	egressByteRate  float64
+	egressByteBurst int
+}
+
+// enabled reports whether any of the limits are set
+func (l connLimits) enabled() bool {
+	return l.messageRate > 0 || l.byteRate > 0 || l.egressByteRate > 0
+}
+
+// connLimiter rate limits a single connection. Its buckets are nil when
+// they're unlimited.
+type connLimiter struct {
+	policy limitPolicy
+	// messages and bytes are only used by the goroutine reading the
+	// connection, egress is guarded by the connection's write lock
+	messages *tokenBucket
+	bytes    *tokenBucket
+	egress   *tokenBucket
+}
+
+func newConnLimiter(l connLimits, now time.Time) *connLimiter {
+	cl := &connLimiter{policy: l.policy}
+	if l.messageRate > 0 {
+		cl.messages = newTokenBucket(l.messageRate, l.messageBurst, now)
+	}
+	if l.byteRate > 0 {
+		cl.bytes = newTokenBucket(l.byteRate, l.byteBurst, now)
+	}
+	if l.egressByteRate > 0 {
+		cl.egress = newTokenBucket(l.egressByteRate, l.egressByteBurst, now)
+	}
+	return cl
+}
+
+// received accounts for a data message of 'n' bytes. With limitDelay it
+// returns how long to wait before reading on, otherwise it reports whether
+// the message is within the limits, taking nothing if it isn't.
+func (l *connLimiter) received(now time.Time, n int) (time.Duration, bool) {
+	if l.policy == limitDelay {
+		var wait time.Duration
+		if l.messages != nil {
+			wait = l.messages.take(now, 1)
+		}
+		if l.bytes != nil {
+			wait = max(wait, l.bytes.take(now, float64(n)))
+		}
+		return wait, true
+	}
+
+	if l.messages != nil {
+		if ok, _ := l.messages.check(now, 1); !ok {
+			return 0, false
+		}
+	}
+	if l.bytes != nil {
+		// A message bigger than the burst could never be allowed, so it
+		// costs at most a full bucket
+		charge := math.Min(float64(n), l.bytes.burst)
+		if ok, _ := l.bytes.check(now, charge); !ok {
+			return 0, false
+		}
+		l.bytes.take(now, charge)
+	}
+	if l.messages != nil {
+		l.messages.take(now, 1)
+	}
+	return 0, true
+}
+
+// sending accounts for 'n' payload bytes about to be sent and returns how
+// long to wait before sending them
+func (l *connLimiter) sending(now time.Time, n int) time.Duration {
+	if l.egress == nil {
+		return 0
+	}
+	return l.egress.take(now, float64(n))
+}
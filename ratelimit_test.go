@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := newTokenBucket(2, 3, now)
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := b.allow(now, 1); !ok {
+			t.Fatalf("expected burst token %d to be allowed", i+1)
+		}
+	}
+	ok, wait := b.allow(now, 1)
+	if ok || wait != 500*time.Millisecond {
+		t.Errorf("expected empty bucket to wait 500ms, got ok=%t wait=%v", ok, wait)
+	}
+
+	if ok, _ := b.allow(now.Add(500*time.Millisecond), 1); !ok {
+		t.Errorf("expected a token after refilling")
+	}
+
+	// Taking more than is available leaves the bucket in debt
+	if wait := b.take(now.Add(500*time.Millisecond), 4); wait != 2*time.Second {
+		t.Errorf("expected a 2s wait to pay off the debt, got %v", wait)
+	}
+	if !b.full(now.Add(time.Hour)) {
+		t.Errorf("expected the bucket to refill")
+	}
+}
+
+func TestConnLimiter(t *testing.T) {
+	now := time.Now()
+
+	l := newConnLimiter(connLimits{messageRate: 10, messageBurst: 1, byteRate: 100, byteBurst: 100, policy: limitDrop}, now)
+	if _, ok := l.received(now, 50); !ok {
+		t.Fatal("expected the first message to be allowed")
+	}
+	if _, ok := l.received(now, 10); ok {
+		t.Error("expected a second message to be over the message rate")
+	}
+	// A rejected message takes no bytes, so the remaining 50 are enough
+	if _, ok := l.received(now.Add(100*time.Millisecond), 50); !ok {
+		t.Error("expected a message once the rate allows it")
+	}
+
+	l = newConnLimiter(connLimits{byteRate: 100, byteBurst: 100, policy: limitDelay}, now)
+	if wait, _ := l.received(now, 150); wait != 500*time.Millisecond {
+		t.Errorf("expected to wait 500ms for 50 bytes over the burst, got %v", wait)
+	}
+
+	l = newConnLimiter(connLimits{egressByteRate: 1000, egressByteBurst: 1000}, now)
+	if wait := l.sending(now, 1000); wait != 0 {
+		t.Errorf("expected the burst to be sent straight away, waited %v", wait)
+	}
+	if wait := l.sending(now, 100); wait != 100*time.Millisecond {
+		t.Errorf("expected to wait 100ms, got %v", wait)
+	}
+}
+
+func TestConnLimiterLargeMessage(t *testing.T) {
+	now := time.Now()
+	for _, policy := range []limitPolicy{limitDrop, limitClose} {
+		// The burst defaults to a second's worth, 100 bytes
+		l := newConnLimiter(connLimits{byteRate: 100, policy: policy}, now)
+		if _, ok := l.received(now, 500); !ok {
+			t.Errorf("%s: expected a message over the burst to be allowed when idle", policy)
+		}
+		if _, ok := l.received(now, 1); ok {
+			t.Errorf("%s: expected the large message to have used the burst", policy)
+		}
+		if _, ok := l.received(now.Add(time.Second), 500); !ok {
+			t.Errorf("%s: expected the burst to refill after a second", policy)
+		}
+	}
+}
+
+func TestConnRateLimitLargeMessage(t *testing.T) {
+	client, r := limitedConn(t, connLimits{byteRate: 100, policy: limitClose})
+
+	big := payloadOf('*', 1000)
+	go writeFrame(client, true, binary, big)
+
+	h, data, err := readFrame(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.op != binary || len(data) != len(big) {
+		t.Errorf("expected the message to be echoed rather than the connection closed, got %s of %d byte(s)", h.op, len(data))
+	}
+}
+
+// limitedConn serves a connection limited by 'limits' over a pipe
+func limitedConn(t *testing.T, limits connLimits) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	client, srv := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+
+	c := newConn(context.Background(), srv, nil)
+	c.limits = newConnLimiter(limits, time.Now())
+	go c.handle()
+
+	return client, bufio.NewReader(client)
+}
+
+func TestConnRateLimitDrop(t *testing.T) {
+	client, r := limitedConn(t, connLimits{messageRate: 0.001, messageBurst: 1, policy: limitDrop})
+
+	go func() {
+		writeFrame(client, true, text, []byte("one"))
+		writeFrame(client, true, text, []byte("two"))
+		writeFrame(client, true, connclose, []byte{0x03, 0xe8})
+	}()
+
+	h, data, err := readFrame(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.op != text || string(data) != "one" {
+		t.Fatalf("expected echo of one, got %s %q", h.op, data)
+	}
+	if h, _, err = readFrame(r); err != nil || h.op != connclose {
+		t.Errorf("expected the second message to be dropped and the close answered, got %v %v", h, err)
+	}
+}
+
+func TestConnRateLimitClose(t *testing.T) {
+	client, r := limitedConn(t, connLimits{byteRate: 0.001, byteBurst: 4, policy: limitClose})
+
+	go func() {
+		writeFrame(client, true, text, []byte("four"))
+		writeFrame(client, true, text, []byte("more"))
+	}()
+
+	if _, data, err := readFrame(r); err != nil || string(data) != "four" {
+		t.Fatalf("expected echo of four, got %q %v", data, err)
+	}
+	h, data, err := readFrame(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.op != connclose || len(data) < 2 || status(data[0])<<8|status(data[1]) != statusViolation {
+		t.Errorf("expected close with %d, got %s %v", statusViolation, h.op, data)
+	}
+}
+
+func TestConnRateLimitDelay(t *testing.T) {
+	client, r := limitedConn(t, connLimits{messageRate: 20, messageBurst: 1, egressByteRate: 1 << 20})
+
+	start := time.Now()
+	go func() {
+		for i := 0; i < 3; i++ {
+			writeFrame(client, true, text, []byte("hi"))
+		}
+	}()
+	for i := 0; i < 3; i++ {
+		if _, _, err := readFrame(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The first message uses the burst, the next two wait 50ms each
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Errorf("expected messages to be delayed to 20 a second, 3 took %v", elapsed)
+	}
+}
+
+func TestConnShapingControlFrames(t *testing.T) {
+	client, srv := net.Pipe()
+	defer client.Close()
+	r := bufio.NewReader(client)
+
+	c := newConn(context.Background(), srv, nil)
+	c.limits = newConnLimiter(connLimits{egressByteRate: 1000, egressByteBurst: 4096}, time.Now())
+
+	// The first frame uses the burst, the next is shaped for seconds
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.writeMessage(ctx, binary, make([]byte, 3*4096))
+
+	if h, _, err := readFrame(r); err != nil || h.op != binary || h.isFin {
+		t.Fatalf("expected the first frame of the message, got %v %v", h, err)
+	}
+
+	start := time.Now()
+	go c.writeFrames(ctx, ping, []byte("p"))
+	h, data, err := readFrame(r)
+	if err != nil || h.op != ping || string(data) != "p" {
+		t.Fatalf("expected the ping between the message's frames, got %v %q %v", h, data, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the ping not to wait for the message's shaping, it took %v", elapsed)
+	}
+}
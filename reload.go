@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// reloadConfig applies 'next' to the running server in place of 'prev'.
+// Settings that can only be changed by a restart are kept at their current
+// values and named in the returned list, the returned config is the one now
+// in effect. An invalid config is rejected without changing anything.
+func (s *server) reloadConfig(prev, next *config) (*config, []string, error) {
+	if err := next.validate(); err != nil {
+		return nil, nil, err
+	}
+
+	effective := *next
+	var restart []string
+
+	keep := func(name string, changed bool, revert func()) {
+		if changed {
+			restart = append(restart, name)
+			revert()
+		}
+	}
+	keep("listen", !reflect.DeepEqual(prev.Listen, next.Listen), func() { effective.Listen = prev.Listen })
+	keep("handler", prev.Handler != next.Handler, func() { effective.Handler = prev.Handler })
+	keep("proxy.protocol", prev.Proxy.Protocol != next.Proxy.Protocol, func() { effective.Proxy.Protocol = prev.Proxy.Protocol })
+	keep("admin", prev.Admin != next.Admin, func() { effective.Admin = prev.Admin })
+	keep("log.format", prev.Log.Format != next.Log.Format, func() { effective.Log.Format = prev.Log.Format })
+
+	// Only the certificate can be swapped on a running TLS listener
+	prevTLS, nextTLS := prev.TLS, next.TLS
+	prevTLS.Cert, prevTLS.Key, nextTLS.Cert, nextTLS.Key = "", "", "", ""
+	tlsChanged := !reflect.DeepEqual(prevTLS, nextTLS) || (prev.TLS.Cert == "") != (next.TLS.Cert == "")
+	keep("tls", tlsChanged, func() { effective.TLS = prev.TLS })
+
+	// Read the certificate first so that a bad key pair rejects the reload
+	// before anything has changed, it's only put in use once everything else
+	// has been applied
+	var kp *keyPair
+	if effective.TLS.Cert != "" {
+		var err error
+		if kp, err = readKeyPair(effective.TLS.Cert, effective.TLS.Key); err != nil {
+			return nil, nil, fmt.Errorf("tls: %w", err)
+		}
+	}
+
+	level, err := parseLogLevel(effective.Log.Level)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	readTimeout, writeTimeout := time.Duration(effective.Timeouts.Read), time.Duration(effective.Timeouts.Write)
+	trustedProxies, _ := parsePrefixes(effective.Proxy.Trusted)
+
+	s.mu.Lock()
+	s.upgrade.origin.allowed = effective.AllowedOrigins
+	s.upgrade.subprotocols = effective.Subprotocols
+	s.maxMessageSize = effective.Limits.MaxMessageSize
+	s.connLimits = effective.Limits.connLimits()
+	s.handshakeTimeout = time.Duration(effective.Timeouts.Handshake)
+	s.readTimeout, s.writeTimeout = readTimeout, writeTimeout
+	s.pingInterval = time.Duration(effective.Keepalive.Interval)
+	s.logPayloads = effective.Log.Payloads
+	s.trustedProxies = trustedProxies
+	certs := s.certs
+	conns := make([]*conn, 0, len(s.conns))
+	for _, c := range s.conns {
+		conns = append(conns, c)
+	}
+	s.mu.Unlock()
+
+	s.admission.setLimits(effective.Limits.admissionLimits())
+	s.filter.setLists(effective.IPFilter.prefixes())
+
+	if s.logLevel != nil {
+		s.logLevel.Set(level)
+	}
+
+	// Existing connections pick up the new timeouts, the rest of the
+	// settings only apply to new connections
+	for _, c := range conns {
+		c.setTimeouts(readTimeout, writeTimeout)
+	}
+
+	if kp != nil {
+		for _, r := range certs {
+			r.use(kp)
+		}
+	}
+
+	return &effective, restart, nil
+}
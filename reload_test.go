@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestReloadConfig(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, _ := writeTestCert(t, dir)
+
+	prev := defaultConfig()
+	prev.TLS.Cert, prev.TLS.Key = certFile, keyFile
+
+	var out bytes.Buffer
+	logger, level, err := prev.newLogger(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := prev.newServer(logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.logLevel = level
+
+	l, err := s.listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	client, srv := net.Pipe()
+	defer client.Close()
+	c := newConn(context.Background(), srv, nil)
+	s.track(c)
+
+	first, _ := s.certs[0].getCertificate(nil)
+
+	// A new key pair under a new name
+	nextCert, nextKey := filepath.Join(dir, "next-cert.pem"), filepath.Join(dir, "next-key.pem")
+	if err := writeSelfSignedCert(nextCert, nextKey, []string{"localhost"}); err != nil {
+		t.Fatal(err)
+	}
+
+	next := *prev
+	next.Listen = []string{":4000"}
+	next.TLS.Cert, next.TLS.Key = nextCert, nextKey
+	next.AllowedOrigins = []string{"https://example.com"}
+	next.Timeouts.Read = duration(time.Minute)
+	next.Log.Level = "debug"
+
+	effective, restart, err := s.reloadConfig(prev, &next)
+	if err != nil {
+		t.Fatalf("failed to reload: %v", err)
+	}
+
+	if !reflect.DeepEqual(restart, []string{"listen"}) {
+		t.Errorf("expected only listen to need a restart, got %v", restart)
+	}
+	if !reflect.DeepEqual(effective.Listen, prev.Listen) {
+		t.Errorf("expected listen to keep its current value, got %v", effective.Listen)
+	}
+	if !reflect.DeepEqual(s.upgrade.origin.allowed, next.AllowedOrigins) {
+		t.Errorf("expected origins to be replaced, got %v", s.upgrade.origin.allowed)
+	}
+	if level.Level() != slog.LevelDebug {
+		t.Errorf("expected log level to be debug, got %v", level.Level())
+	}
+	if d := time.Duration(c.readTimeout.Load()); d != time.Minute {
+		t.Errorf("expected existing connection to get the new read timeout, got %v", d)
+	}
+	second, _ := s.certs[0].getCertificate(nil)
+	if second == first {
+		t.Errorf("expected the certificate to be reloaded")
+	}
+
+	// A key pair that doesn't load rejects the whole reload
+	bad := *effective
+	bad.TLS.Key = filepath.Join(dir, "missing.pem")
+	bad.AllowedOrigins = nil
+	if _, _, err := s.reloadConfig(effective, &bad); err == nil {
+		t.Errorf("expected a missing key to be rejected")
+	}
+	if len(s.upgrade.origin.allowed) != 1 {
+		t.Errorf("expected a rejected reload to leave the settings alone")
+	}
+	if cert, _ := s.certs[0].getCertificate(nil); cert != second {
+		t.Errorf("expected a rejected reload to keep the certificate")
+	}
+
+	invalid := *effective
+	invalid.Limits.MaxMessageSize = -1
+	if _, _, err := s.reloadConfig(effective, &invalid); err == nil {
+		t.Errorf("expected an invalid config to be rejected")
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// request is the client's parsed upgrade request
+type request struct {
+	method     string
+	host       string
+	path       string
+	query      url.Values
+	header     http.Header
+	cookies    []*http.Cookie
+	remoteAddr string
+	// clientAddr is the address a trusted proxy forwarded the request for,
+	// nil when it wasn't forwarded
+	clientAddr net.Addr
+	// tls is nil when the connection isn't using TLS
+	tls *tls.ConnectionState
+	// identity is set by the authenticator when the request is accepted
+	identity *identity
+	// endpoint and params are set by the router, endpoint is nil when the
+	// server has no router
+	endpoint    *endpoint
+	params      map[string]string
+	subprotocol string
+	// hr is the request as parsed by net/http
+	hr *http.Request
+}
+
+// readRequest reads the upgrade request from 'r', which must be reading from
+// 'c'. Reading stops at the end of the request so any frames the client sent
+// straight after it remain buffered in 'r'.
+func readRequest(r *bufio.Reader, c net.Conn) (*request, error) {
+	hr, err := http.ReadRequest(r)
+	if err != nil {
+		return nil, err
+	}
+
+	hr.RemoteAddr = c.RemoteAddr().String()
+
+	req := &request{
+		method:     hr.Method,
+		host:       hr.Host,
+		path:       hr.URL.Path,
+		query:      hr.URL.Query(),
+		header:     hr.Header,
+		cookies:    hr.Cookies(),
+		remoteAddr: hr.RemoteAddr,
+		hr:         hr,
+	}
+
+	if tc, ok := c.(*tls.Conn); ok {
+		state := tc.ConnectionState()
+		req.tls = &state
+		hr.TLS = &state
+	}
+
+	return req, nil
+}
+
+// isUpgrade reports whether the client is asking to switch to WebSocket
+func (r *request) isUpgrade() bool {
+	return headerHasToken(r.header, "Upgrade", "websocket") &&
+		headerHasToken(r.header, "Connection", "upgrade")
+}
+
+// headerHasToken reports whether the comma separated header 'name' contains
+// 'token', ignoring case
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// cookie returns the named cookie
+func (r *request) cookie(name string) (*http.Cookie, bool) {
+	for _, c := range r.cookies {
+		if c.Name == name {
+			return c, true
+		}
+	}
+	return nil, false
+}
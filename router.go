@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// handler is called with every complete message received on a connection.
+// The data is only valid until the handler returns.
+type handler func(c *conn, op opCode, data []byte) error
+
+// echoHandler sends every message straight back to the peer
+func echoHandler(c *conn, op opCode, data []byte) error {
+	return c.writeMessage(c.context(), op, data)
+}
+
+// discardHandler ignores every message
+func discardHandler(c *conn, op opCode, data []byte) error {
+	return nil
+}
+
+// endpoint is what a route serves
+type endpoint struct {
+	handler handler
+	// subprotocols the endpoint speaks, in order of preference
+	subprotocols []string
+	// maxPayload limits the size of a message, zero uses payloadSize
+	maxPayload int
+	// authenticate replaces the server's authenticator for this endpoint
+	authenticate authenticateFunc
+}
+
+type route struct {
+	pattern  string
+	segments []string
+	endpoint *endpoint
+}
+
+// router maps request paths to endpoints. Patterns are absolute paths whose
+// segments may be parameters in the form "{name}", e.g. "/rooms/{id}".
+type router struct {
+	routes []route
+}
+
+// handle registers 'e' to serve requests matching 'pattern'
+func (rt *router) handle(pattern string, e *endpoint) error {
+	if !strings.HasPrefix(pattern, "/") {
+		return fmt.Errorf("pattern %q must start with '/'", pattern)
+	}
+	if e.handler == nil {
+		return fmt.Errorf("pattern %q has no handler", pattern)
+	}
+
+	segments := splitPath(pattern)
+	for _, seg := range segments {
+		if strings.HasPrefix(seg, "{") != strings.HasSuffix(seg, "}") || seg == "{}" {
+			return fmt.Errorf("pattern %q has a malformed parameter %q", pattern, seg)
+		}
+	}
+
+	for _, r := range rt.routes {
+		if r.pattern == pattern {
+			return fmt.Errorf("pattern %q is already registered", pattern)
+		}
+	}
+
+	rt.routes = append(rt.routes, route{pattern, segments, e})
+	return nil
+}
+
+// match returns the endpoint for 'path' and its path parameters. When more
+// than one route matches, the one with the most literal segments wins so that
+// "/rooms/new" is preferred over "/rooms/{id}".
+func (rt *router) match(path string) (*endpoint, map[string]string, bool) {
+	segments := splitPath(path)
+
+	var best *route
+	var bestParams map[string]string
+	bestLiterals := -1
+
+	for i := range rt.routes {
+		r := &rt.routes[i]
+		if len(r.segments) != len(segments) {
+			continue
+		}
+
+		params := make(map[string]string)
+		literals := 0
+		matched := true
+		for j, seg := range r.segments {
+			if name, ok := strings.CutPrefix(seg, "{"); ok {
+				params[strings.TrimSuffix(name, "}")] = segments[j]
+				continue
+			}
+			if seg != segments[j] {
+				matched = false
+				break
+			}
+			literals++
+		}
+
+		if matched && literals > bestLiterals {
+			best, bestParams, bestLiterals = r, params, literals
+		}
+	}
+
+	if best == nil {
+		return nil, nil, false
+	}
+	return best.endpoint, bestParams, true
+}
+
+func splitPath(path string) []string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return []string{}
+	}
+	return strings.Split(path, "/")
+}
+
+// selectSubprotocol picks the first protocol in 'supported' that the client
+// offered in its Sec-WebSocket-Protocol header
+func selectSubprotocol(r *request, supported []string) string {
+	offered := make(map[string]struct{})
+	for _, h := range r.header.Values("Sec-WebSocket-Protocol") {
+		for _, p := range strings.Split(h, ",") {
+			offered[strings.TrimSpace(p)] = struct{}{}
+		}
+	}
+
+	for _, p := range supported {
+		if _, ok := offered[p]; ok {
+			return p
+		}
+	}
+	return ""
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"testing"
+)
+
+func TestRouterMatch(t *testing.T) {
+	rooms, newRoom, root := &endpoint{handler: echoHandler}, &endpoint{handler: echoHandler}, &endpoint{handler: echoHandler}
+
+	var rt router
+	for pattern, e := range map[string]*endpoint{"/rooms/{id}": rooms, "/rooms/new": newRoom, "/": root} {
+		if err := rt.handle(pattern, e); err != nil {
+			t.Fatalf("failed to register %s: %v", pattern, err)
+		}
+	}
+
+	tests := []struct {
+		path     string
+		endpoint *endpoint
+		id       string
+	}{
+		{"/", root, ""},
+		{"/rooms/42", rooms, "42"},
+		{"/rooms/42/", rooms, "42"},
+		{"/rooms/new", newRoom, ""},
+		{"/rooms", nil, ""},
+		{"/rooms/42/members", nil, ""},
+	}
+
+	for _, test := range tests {
+		e, params, ok := rt.match(test.path)
+		if test.endpoint == nil {
+			if ok {
+				t.Errorf("%s: expected no match", test.path)
+			}
+			continue
+		}
+		if e != test.endpoint {
+			t.Errorf("%s: matched the wrong endpoint", test.path)
+		}
+		if params["id"] != test.id {
+			t.Errorf("%s: expected id=%q, got %q", test.path, test.id, params["id"])
+		}
+	}
+
+	if err := rt.handle("/rooms/{id", rooms); err == nil {
+		t.Errorf("expected malformed parameter to be rejected")
+	}
+	if err := rt.handle("/", root); err == nil {
+		t.Errorf("expected duplicate pattern to be rejected")
+	}
+}
+
+func TestRoutedUpgrade(t *testing.T) {
+	var rt router
+	rt.handle("/rooms/{id}", &endpoint{
+		handler: func(c *conn, op opCode, data []byte) error {
+			return c.writeMessage(c.context(), op, []byte(c.param("id")+"/"+c.query("user")+": "+string(data)))
+		},
+		subprotocols: []string{"chat.v2", "chat.v1"},
+	})
+
+	s := &server{upgrade: upgradeOptions{router: &rt}}
+	l, err := s.listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go s.serve(context.Background(), l)
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := writeUpgradeRequest(c, "/rooms/42?user=bob", "Sec-WebSocket-Protocol: chat.v1, chat.v2"); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(c)
+	res, err := readUpgradeResponse(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != 101 {
+		t.Fatalf("expected status 101, got %d", res.StatusCode)
+	}
+	if p := res.Header.Get("Sec-WebSocket-Protocol"); p != "chat.v2" {
+		t.Errorf("expected subprotocol chat.v2, got %q", p)
+	}
+
+	// Masked text frame "hi"
+	mask := []byte{1, 2, 3, 4}
+	if _, err := c.Write([]byte{0x81, 0x82, mask[0], mask[1], mask[2], mask[3], 'h' ^ mask[0], 'i' ^ mask[1]}); err != nil {
+		t.Fatal(err)
+	}
+
+	var h header
+	if err := h.read(r); err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, h.length)
+	if _, err := r.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "42/bob: hi" {
+		t.Errorf("expected handler to see path and query parameters, got %q", data)
+	}
+
+	res, _ = upgradeOverPipe(t, &upgradeOptions{router: &rt}, "/lobby")
+	if res.StatusCode != 404 {
+		t.Errorf("expected unknown path to get 404, got %d", res.StatusCode)
+	}
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"runtime/debug"
+	"slices"
+	"sync"
+	"time"
+)
+
+type server struct {
+	// mu guards the fields that can be changed by reloadConfig while the
+	// server is running, and conns
+	mu sync.RWMutex
+	// conns are the open WebSocket connections by id
+	conns map[uint64]*conn
+	// certs serve the certificate of each TLS listener
+	certs []*certReloader
+	// admission limits how many connections are open and how quickly they
+	// can be opened
+	admission admission
+	// filter refuses connections from denied networks as they're accepted
+	filter ipFilter
+
+	// tls is nil for a plain ws:// listener
+	tls *tlsOptions
+	// proxyProtocol expects every connection to start with a PROXY protocol
+	// header giving the client's address
+	proxyProtocol bool
+	// trustedProxies are the networks whose Forwarded and X-Forwarded-For
+	// headers are believed
+	trustedProxies []netip.Prefix
+	upgrade        upgradeOptions
+	// http serves requests that aren't asking to upgrade, when nil every
+	// request is treated as an upgrade
+	http http.Handler
+	// handler serves connections that aren't routed, nil echoes
+	handler handler
+	// maxMessageSize limits messages on connections that aren't routed,
+	// zero uses payloadSize
+	maxMessageSize int
+	// connLimits rate limit each connection
+	connLimits connLimits
+	// handshakeTimeout bounds reading the upgrade request, zero disables it
+	handshakeTimeout time.Duration
+	// readTimeout closes connections that have sent nothing for that long
+	// and writeTimeout bounds sending a message, zero disables them
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	// pingInterval is how often connections are pinged to keep them alive
+	// and measure their round trip time, zero disables pings
+	pingInterval time.Duration
+	// logger receives the server's logs, nil uses slog.Default
+	logger *slog.Logger
+	// logPayloads includes frame payloads in debug logs
+	logPayloads bool
+	// logLevel, when set, is the level of 'logger' so it can be changed at
+	// runtime
+	logLevel *slog.LevelVar
+	// crashOnPanic lets a panic while serving a connection take down the
+	// process instead of only closing the connection, so tests see it
+	crashOnPanic bool
+}
+
+func (s *server) log() *slog.Logger {
+	if s.logger == nil {
+		return slog.Default()
+	}
+	return s.logger
+}
+
+// listen opens a listener on 'addr', wrapping it in TLS when configured
+func (s *server) listen(addr string) (net.Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// The PROXY header comes before anything else, TLS included
+	if s.proxyProtocol {
+		l = proxyListener{l}
+	}
+
+	if s.tls == nil {
+		return l, nil
+	}
+
+	cfg, certs, err := s.tls.config()
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	s.mu.Lock()
+	s.certs = append(s.certs, certs)
+	s.mu.Unlock()
+
+	return tls.NewListener(l, cfg), nil
+}
+
+// minAcceptBackoff and maxAcceptBackoff bound the wait after a failed
+// accept, it doubles with each failure in a row
+const (
+	minAcceptBackoff = 5 * time.Millisecond
+	maxAcceptBackoff = time.Second
+)
+
+// serve accepts connections from 'l' until it's closed or 'ctx' is done.
+// Cancelling 'ctx' closes 'l' and every connection accepted from it.
+func (s *server) serve(ctx context.Context, l net.Listener) error {
+	stop := context.AfterFunc(ctx, func() {
+		l.Close()
+	})
+	defer stop()
+
+	var backoff time.Duration
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+
+			// Errors such as running out of file descriptors pass as
+			// connections close, so back off and keep accepting
+			backoff = min(max(2*backoff, minAcceptBackoff), maxAcceptBackoff)
+			s.log().Warn("failed to accept incoming connection", "err", err, "retry_in", backoff)
+			if err := sleepContext(ctx, backoff); err != nil {
+				return err
+			}
+			continue
+		}
+		backoff = 0
+
+		go s.handle(ctx, c)
+	}
+}
+
+func (s *server) handle(ctx context.Context, c net.Conn) {
+	// The client's address is in the PROXY header, so read it first
+	if pc := asProxyConn(c); pc != nil {
+		if err := pc.init(); err != nil {
+			s.log().Info("failed to read proxy header", "remote_addr", pc.Conn.RemoteAddr().String(), "err", err)
+			c.Close()
+			return
+		}
+	}
+
+	// Refuse filtered addresses before spending anything on them
+	if ok, list := s.filter.allowed(addrIP(c.RemoteAddr())); !ok {
+		metrics.filtered.with(list).inc()
+		s.log().Debug("refused connection from filtered address", "remote_addr", c.RemoteAddr().String(), "list", list)
+		c.Close()
+		return
+	}
+
+	id := newConnID()
+	log := s.log().With("conn_id", id, "remote_addr", c.RemoteAddr().String())
+
+	defer func(c net.Conn) {
+		log.Debug("closing connection")
+		c.Close()
+	}(c)
+	defer s.recoverPanic(log)
+
+	s.mu.RLock()
+	handshakeTimeout := s.handshakeTimeout
+	s.mu.RUnlock()
+
+	// Complete the TLS handshake up front so a failure is reported as such
+	// rather than as a failed upgrade. It's bounded by the handshake timeout
+	// so a client that never sends a ClientHello doesn't hold on forever.
+	if tc, ok := c.(*tls.Conn); ok {
+		hctx := ctx
+		if handshakeTimeout > 0 {
+			var cancel context.CancelFunc
+			hctx, cancel = context.WithTimeout(ctx, handshakeTimeout)
+			defer cancel()
+		}
+		if err := tc.HandshakeContext(hctx); err != nil {
+			log.Info("tls handshake failed", "err", err)
+			return
+		}
+	}
+
+	r := bufio.NewReader(c)
+
+	// Stop waiting for a request when the context is cancelled, once
+	// upgraded the connection closes itself
+	stop := context.AfterFunc(ctx, func() {
+		c.SetReadDeadline(aLongTimeAgo)
+	})
+	defer stop()
+
+	for first := true; ; first = false {
+		if ctx.Err() != nil {
+			return
+		}
+
+		switch {
+		case first && handshakeTimeout > 0:
+			c.SetReadDeadline(time.Now().Add(handshakeTimeout))
+		case s.http != nil:
+			c.SetReadDeadline(time.Now().Add(httpIdleTimeout))
+		}
+
+		req, err := readRequest(r, c)
+		if err != nil {
+			if err == io.EOF || errors.Is(err, os.ErrDeadlineExceeded) {
+				return
+			}
+			log.Info("failed to read request", "err", err)
+			sendHttpResponse(c, 400, nil)
+			return
+		}
+
+		if s.http == nil || req.isUpgrade() {
+			if !stop() {
+				return
+			}
+			c.SetReadDeadline(time.Time{})
+			s.serveWS(ctx, c, r, req, id, log)
+			return
+		}
+
+		keepAlive, err := serveHTTP(c, req, s.http)
+		if err != nil {
+			log.Info("failed to respond", "err", err)
+			return
+		}
+		if !keepAlive {
+			return
+		}
+	}
+}
+
+// serveWS upgrades the connection and serves it until it's closed
+func (s *server) serveWS(ctx context.Context, c net.Conn, r *bufio.Reader, req *request, id uint64, log *slog.Logger) {
+	// Take a copy of the settings so a reload doesn't change them mid-way
+	// through the upgrade
+	s.mu.RLock()
+	opts := s.upgrade
+	maxMessageSize := s.maxMessageSize
+	connLimits := s.connLimits
+	readTimeout, writeTimeout := s.readTimeout, s.writeTimeout
+	pingInterval := s.pingInterval
+	logPayloads := s.logPayloads
+	trustedProxies := s.trustedProxies
+	s.mu.RUnlock()
+
+	// Behind a trusted proxy the client is whoever the proxy says it is
+	clientAddr := c.RemoteAddr()
+	if containsAddr(trustedProxies, addrIP(clientAddr)) {
+		if ip, ok := forwardedClient(req.header, trustedProxies); ok {
+			clientAddr = net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, 0))
+			req.clientAddr = clientAddr
+			log = log.With("client_addr", ip.String())
+
+			if ok, list := s.filter.allowed(ip); !ok {
+				metrics.filtered.with(list).inc()
+				metrics.handshakeRejected("filtered")
+				sendHttpResponse(c, http.StatusForbidden, nil)
+				log.Info("refused connection from filtered address", "list", list)
+				return
+			}
+		}
+	}
+
+	release, err := s.admission.admit(clientAddr, time.Now())
+	if err != nil {
+		reason := "rate_limited"
+		if rej, ok := err.(*rejection); ok && rej.status == http.StatusServiceUnavailable {
+			reason = "max_connections"
+		}
+		metrics.handshakeRejected(reason)
+		sendRejection(c, err, http.StatusServiceUnavailable)
+		log.Info("refused connection", "err", err)
+		return
+	}
+	defer release()
+
+	req, err = upgradeRequest(ctx, c, req, &opts)
+	if err != nil {
+		log.Info("failed to upgrade client", "err", err)
+		return
+	}
+
+	log = log.With("path", req.path)
+	log.Info("new connection")
+
+	var conn *conn = newConn(ctx, c, r)
+	conn.id, conn.log, conn.logPayloads = id, log, logPayloads
+	conn.setTimeouts(readTimeout, writeTimeout)
+	conn.req = req
+	conn.subprotocol = req.subprotocol
+	conn.crashOnPanic = s.crashOnPanic
+	if s.handler != nil {
+		conn.handler = s.handler
+	}
+	if maxMessageSize > 0 {
+		conn.p = newPayloadSize(maxMessageSize)
+	}
+	if connLimits.enabled() {
+		conn.limits = newConnLimiter(connLimits, time.Now())
+	}
+	if e := req.endpoint; e != nil {
+		conn.handler = e.handler
+		if e.maxPayload > 0 {
+			conn.p = newPayloadSize(e.maxPayload)
+		}
+	}
+
+	metrics.activeConns.inc()
+	defer metrics.activeConns.dec()
+
+	s.track(conn)
+	defer s.untrack(conn)
+
+	if pingInterval > 0 {
+		go conn.keepAlive(pingInterval)
+	}
+	go conn.sendLoop()
+
+	// When 'handle' is done, so is the client so we can close the connection
+	err = conn.handle()
+	var ce *CloseError
+	if !errors.As(err, &ce) {
+		log.Warn("failed to handle connection", "err", err)
+		return
+	}
+
+	log.Info("client disconnected", "code", int(ce.Code), "reason", ce.Reason, "clean", ce.Clean)
+}
+
+// recoverPanic stops a panic while reading requests or upgrading from killing
+// every other connection with it, the connection is closed on the way out.
+// Once upgraded the connection recovers its own panics.
+func (s *server) recoverPanic(log *slog.Logger) {
+	if s.crashOnPanic {
+		return
+	}
+	if v := recover(); v != nil {
+		metrics.panics.with("request").inc()
+		log.Error("recovered from panic", "panic", v, "stack", string(debug.Stack()))
+	}
+}
+
+func (s *server) track(c *conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conns == nil {
+		s.conns = make(map[uint64]*conn)
+	}
+	s.conns[c.id] = c
+}
+
+func (s *server) untrack(c *conn) {
+	s.mu.Lock()
+	delete(s.conns, c.id)
+	s.mu.Unlock()
+}
+
+// lookup returns the open connection with 'id'
+func (s *server) lookup(id uint64) (*conn, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	c, ok := s.conns[id]
+	return c, ok
+}
+
+// openConns returns the open connections ordered by id
+func (s *server) openConns() []*conn {
+	s.mu.RLock()
+	conns := make([]*conn, 0, len(s.conns))
+	for _, c := range s.conns {
+		conns = append(conns, c)
+	}
+	s.mu.RUnlock()
+
+	slices.SortFunc(conns, func(a, b *conn) int { return cmp.Compare(a.id, b.id) })
+	return conns
+}
+
+// waitClosed waits until every connection has closed or 'ctx' is done
+func (s *server) waitClosed(ctx context.Context) error {
+	t := time.NewTicker(50 * time.Millisecond)
+	defer t.Stop()
+
+	for len(s.openConns()) > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// flakyListener fails its first 'failures' accepts, as a listener out of
+// file descriptors does
+type flakyListener struct {
+	net.Listener
+	failures atomic.Int32
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if l.failures.Add(-1) >= 0 {
+		return nil, &net.OpError{Op: "accept", Net: "tcp", Err: syscall.EMFILE}
+	}
+	return l.Listener.Accept()
+}
+
+func TestServeAcceptErrors(t *testing.T) {
+	s := &server{}
+	inner, err := s.listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &flakyListener{Listener: inner}
+	l.failures.Store(3)
+
+	served := make(chan error, 1)
+	go func() {
+		served <- s.serve(context.Background(), l)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, _, err := dial(ctx, "ws://"+l.Addr().String()+"/", nil)
+	if err != nil {
+		t.Fatalf("expected the server to keep accepting after errors, got %v", err)
+	}
+	if err := c.writeMessage(ctx, text, []byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	if _, data, err := c.readMessage(ctx); err != nil || string(data) != "hi" {
+		t.Errorf("expected an echo, got %q %v", data, err)
+	}
+
+	l.Close()
+	select {
+	case err := <-served:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Errorf("expected serve to stop once the listener closed, got %v", err)
+		}
+	case <-ctx.Done():
+		t.Fatal("expected serve to return once the listener closed")
+	}
+}
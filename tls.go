@@ -0,0 +1,364 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultReloadInterval is how often the certificate files are checked for changes
+const defaultReloadInterval = 10 * time.Second
+
+type tlsOptions struct {
+	certFile     string
+	keyFile      string
+	minVersion   uint16
+	cipherSuites []uint16
+	// clientCAFile is a PEM bundle of CAs used to verify client certificates,
+	// leaving it empty disables client certificate authentication
+	clientCAFile string
+	// requireClientCert rejects clients that don't present a certificate,
+	// otherwise a certificate is only verified if one is given
+	requireClientCert bool
+	// reloadInterval is the minimum time between checks of the certificate
+	// files, zero uses defaultReloadInterval
+	reloadInterval time.Duration
+}
+
+// config builds a server side tls.Config from the options. The certificate is
+// served through the returned certReloader so that it can be replaced on disk
+// without restarting the server.
+func (o *tlsOptions) config() (*tls.Config, *certReloader, error) {
+	if o.certFile == "" || o.keyFile == "" {
+		return nil, nil, fmt.Errorf("tls requires both a certificate and a key file")
+	}
+
+	interval := o.reloadInterval
+	if interval == 0 {
+		interval = defaultReloadInterval
+	}
+
+	r, err := newCertReloader(o.certFile, o.keyFile, interval)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	minVersion := o.minVersion
+	if minVersion == 0 {
+		minVersion = tls.VersionTLS12
+	}
+
+	cfg := &tls.Config{
+		GetCertificate: r.getCertificate,
+		MinVersion:     minVersion,
+		CipherSuites:   o.cipherSuites,
+		// The upgrade is always done over HTTP/1.1, RFC 8441 (HTTP/2) is not supported
+		NextProtos: []string{"http/1.1"},
+	}
+
+	if o.clientCAFile != "" {
+		pool, err := loadCertPool(o.clientCAFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+		if o.requireClientCert {
+			cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	} else if o.requireClientCert {
+		return nil, nil, fmt.Errorf("requiring client certificates needs a client CA bundle")
+	}
+
+	return cfg, r, nil
+}
+
+// loadCertPool reads a PEM bundle of certificates into a pool
+func loadCertPool(name string) (*x509.CertPool, error) {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("no certificates found in %s", name)
+	}
+	return pool, nil
+}
+
+// certNames returns the common name and every DNS, email and URI subject
+// alternative name of 'cert'
+func certNames(cert *x509.Certificate) []string {
+	names := make([]string, 0, 1+len(cert.DNSNames)+len(cert.EmailAddresses)+len(cert.URIs))
+	if cert.Subject.CommonName != "" {
+		names = append(names, cert.Subject.CommonName)
+	}
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, u := range cert.URIs {
+		names = append(names, u.String())
+	}
+	return names
+}
+
+// allowCertNames returns a client certificate check that accepts a verified
+// certificate whose common name or any subject alternative name is in 'names'
+func allowCertNames(names ...string) func(*x509.Certificate, [][]*x509.Certificate) error {
+	allowed := make(map[string]struct{}, len(names))
+	for _, n := range names {
+		allowed[n] = struct{}{}
+	}
+
+	return func(cert *x509.Certificate, chains [][]*x509.Certificate) error {
+		if cert == nil || len(chains) == 0 {
+			return fmt.Errorf("no verified client certificate")
+		}
+		for _, n := range certNames(cert) {
+			if _, ok := allowed[n]; ok {
+				return nil
+			}
+		}
+		return fmt.Errorf("client certificate %q is not allowed", cert.Subject.CommonName)
+	}
+}
+
+// certReloader serves a certificate from disk, reloading it when either the
+// certificate or the key file changes
+type certReloader struct {
+	certFile string
+	keyFile  string
+	interval time.Duration
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+func newCertReloader(certFile, keyFile string, interval time.Duration) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile, interval: interval}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// reload unconditionally loads the key pair from disk
+func (r *certReloader) reload() error {
+	r.mu.RLock()
+	certFile, keyFile := r.certFile, r.keyFile
+	r.mu.RUnlock()
+
+	return r.load(certFile, keyFile)
+}
+
+// load loads the key pair from 'certFile' and 'keyFile', which are then
+// watched for changes instead of the current files
+func (r *certReloader) load(certFile, keyFile string) error {
+	kp, err := readKeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	r.use(kp)
+	return nil
+}
+
+// keyPair is a certificate read from disk but not yet in use
+type keyPair struct {
+	certFile string
+	keyFile  string
+	cert     *tls.Certificate
+	modTime  time.Time
+}
+
+func readKeyPair(certFile, keyFile string) (*keyPair, error) {
+	modTime, err := latestModTime(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load key pair: %w", err)
+	}
+	return &keyPair{certFile: certFile, keyFile: keyFile, cert: &cert, modTime: modTime}, nil
+}
+
+// use serves 'kp', watching its files for changes instead of the current ones
+func (r *certReloader) use(kp *keyPair) {
+	r.mu.Lock()
+	r.certFile, r.keyFile = kp.certFile, kp.keyFile
+	r.cert = kp.cert
+	r.modTime = kp.modTime
+	r.lastCheck = time.Now()
+	r.mu.Unlock()
+}
+
+// latestModTime returns the most recent modification time of the files
+func latestModTime(names ...string) (time.Time, error) {
+	var latest time.Time
+	for _, name := range names {
+		fi, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// maybeReload reloads the key pair if 'interval' has passed since the last
+// check and the files have changed since they were loaded
+func (r *certReloader) maybeReload() error {
+	r.mu.RLock()
+	due := time.Since(r.lastCheck) >= r.interval
+	loaded := r.modTime
+	certFile, keyFile := r.certFile, r.keyFile
+	r.mu.RUnlock()
+
+	if !due {
+		return nil
+	}
+
+	modTime, err := latestModTime(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+
+	if !modTime.After(loaded) {
+		r.mu.Lock()
+		r.lastCheck = time.Now()
+		r.mu.Unlock()
+		return nil
+	}
+
+	return r.reload()
+}
+
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	// A failed reload keeps serving the previous certificate, the files may be
+	// mid-way through being replaced
+	if err := r.maybeReload(); err != nil {
+		r.mu.Lock()
+		r.lastCheck = time.Now()
+		r.mu.Unlock()
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// parseTLSVersion parses versions in the form "1.2"
+func parseTLSVersion(v string) (uint16, error) {
+	switch strings.TrimSpace(v) {
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unknown tls version %q", v)
+}
+
+// parseCipherSuites maps IANA cipher suite names to their ids, insecure suites
+// are rejected
+func parseCipherSuites(names []string) ([]uint16, error) {
+	known := make(map[string]uint16)
+	for _, s := range tls.CipherSuites() {
+		known[s.Name] = s.ID
+	}
+
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := known[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// generateSelfSignedCert creates a PEM encoded certificate and key valid for
+// 'hosts', which may be host names or IP addresses. It's intended for local
+// development and tests only.
+func generateSelfSignedCert(hosts []string, validFor time.Duration) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"fws development"}},
+		NotBefore:             now.Add(-time.Minute),
+		NotAfter:              now.Add(validFor),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+	if len(hosts) > 0 {
+		template.Subject.CommonName = hosts[0]
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+
+	return certPEM, keyPEM, nil
+}
+
+// writeSelfSignedCert generates a self-signed certificate for 'hosts' and
+// writes the key pair to 'certFile' and 'keyFile'
+func writeSelfSignedCert(certFile, keyFile string, hosts []string) error {
+	certPEM, keyPEM, err := generateSelfSignedCert(hosts, 365*24*time.Hour)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(certFile, certPEM, 0644); err != nil {
+		return err
+	}
+	return os.WriteFile(keyFile, keyPEM, 0600)
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func startTLSServer(t *testing.T, opts *tlsOptions) string {
+	t.Helper()
+
+	s := &server{tls: opts}
+	l, err := s.listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go s.serve(context.Background(), l)
+
+	return l.Addr().String()
+}
+
+func writeTestCert(t *testing.T, dir string) (string, string, []byte) {
+	t.Helper()
+
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	certPEM, keyPEM, err := generateSelfSignedCert([]string{"127.0.0.1", "localhost"}, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to generate certificate: %v", err)
+	}
+	if err := os.WriteFile(certFile, certPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile, certPEM
+}
+
+func TestTLSUpgrade(t *testing.T) {
+	certFile, keyFile, certPEM := writeTestCert(t, t.TempDir())
+	addr := startTLSServer(t, &tlsOptions{certFile: certFile, keyFile: keyFile})
+
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(certPEM)
+
+	c, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: pool, ServerName: "localhost", NextProtos: []string{"http/1.1"}})
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer c.Close()
+
+	if p := c.ConnectionState().NegotiatedProtocol; p != "http/1.1" {
+		t.Errorf("expected ALPN protocol http/1.1, got %q", p)
+	}
+
+	if err := writeUpgradeRequest(c, "/"); err != nil {
+		t.Fatalf("failed to write request: %v", err)
+	}
+	res, err := readUpgradeResponse(bufio.NewReader(c))
+	if err != nil {
+		t.Fatalf("failed to read response: %v", err)
+	}
+	if res.StatusCode != 101 {
+		t.Errorf("expected status 101, got %d", res.StatusCode)
+	}
+}
+
+func TestTLSHandshakeTimeout(t *testing.T) {
+	certFile, keyFile, _ := writeTestCert(t, t.TempDir())
+	s := &server{tls: &tlsOptions{certFile: certFile, keyFile: keyFile}, handshakeTimeout: 100 * time.Millisecond}
+	l, err := s.listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go s.serve(context.Background(), l)
+
+	// Connect but never send a ClientHello
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Errorf("expected the server to give up on the handshake and close, got %v", err)
+	}
+}
+
+func TestTLSMinVersion(t *testing.T) {
+	certFile, keyFile, _ := writeTestCert(t, t.TempDir())
+	addr := startTLSServer(t, &tlsOptions{certFile: certFile, keyFile: keyFile, minVersion: tls.VersionTLS13})
+
+	c, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12})
+	if err == nil {
+		c.Close()
+		t.Errorf("expected a TLS 1.2 client to be rejected")
+	}
+}
+
+func TestCertReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, _ := writeTestCert(t, dir)
+
+	r, err := newCertReloader(certFile, keyFile, 0)
+	if err != nil {
+		t.Fatalf("failed to create reloader: %v", err)
+	}
+
+	first, _ := r.getCertificate(nil)
+
+	// Make sure the new files have a later modification time
+	writeTestCert(t, dir)
+	later := time.Now().Add(time.Second)
+	os.Chtimes(certFile, later, later)
+
+	second, _ := r.getCertificate(nil)
+	if first == second {
+		t.Errorf("expected certificate to be reloaded after the files changed")
+	}
+
+	third, _ := r.getCertificate(nil)
+	if second != third {
+		t.Errorf("expected certificate to be unchanged when the files haven't changed")
+	}
+}
+
+func TestParseCipherSuites(t *testing.T) {
+	ids, err := parseCipherSuites([]string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"})
+	if err != nil || len(ids) != 1 || ids[0] != tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 {
+		t.Errorf("failed to parse cipher suite: ids=%v, err=%v", ids, err)
+	}
+
+	if _, err := parseCipherSuites([]string{"TLS_RSA_WITH_RC4_128_SHA"}); err == nil {
+		t.Errorf("expected insecure cipher suite to be rejected")
+	}
+}
+
+func TestClientCertAuth(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, certPEM := writeTestCert(t, dir)
+
+	// Each client certificate is self-signed, so the bundle is the
+	// certificate itself
+	clientCertPEM, clientKeyPEM, err := generateSelfSignedCert([]string{"device-1"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(caFile, clientCertPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+	clientCert, err := tls.X509KeyPair(clientCertPEM, clientKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &server{
+		tls:     &tlsOptions{certFile: certFile, keyFile: keyFile, clientCAFile: caFile},
+		upgrade: upgradeOptions{authorizeClientCert: allowCertNames("device-1")},
+	}
+	l, err := s.listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer l.Close()
+	go s.serve(context.Background(), l)
+
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(certPEM)
+
+	tests := []struct {
+		name   string
+		certs  []tls.Certificate
+		status int
+	}{
+		{"allowed", []tls.Certificate{clientCert}, 101},
+		{"no certificate", nil, 403},
+	}
+
+	for _, test := range tests {
+		c, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{RootCAs: pool, ServerName: "localhost", Certificates: test.certs})
+		if err != nil {
+			t.Fatalf("%s: failed to dial: %v", test.name, err)
+		}
+
+		if err := writeUpgradeRequest(c, "/"); err != nil {
+			t.Fatalf("%s: failed to write request: %v", test.name, err)
+		}
+		res, err := readUpgradeResponse(bufio.NewReader(c))
+		if err != nil {
+			t.Fatalf("%s: failed to read response: %v", test.name, err)
+		}
+		if res.StatusCode != test.status {
+			t.Errorf("%s: expected status %d, got %d", test.name, test.status, res.StatusCode)
+		}
+		c.Close()
+	}
+}
+
+func TestAllowCertNames(t *testing.T) {
+	certPEM, _, err := generateSelfSignedCert([]string{"device-1", "device-1.fleet.local"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(certPEM)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chains := [][]*x509.Certificate{{cert}}
+
+	if err := allowCertNames("device-1.fleet.local")(cert, chains); err != nil {
+		t.Errorf("expected SAN to be allowed: %v", err)
+	}
+	if err := allowCertNames("device-2")(cert, chains); err == nil {
+		t.Errorf("expected unknown name to be rejected")
+	}
+	if err := allowCertNames("device-1")(cert, nil); err == nil {
+		t.Errorf("expected unverified certificate to be rejected")
+	}
+}
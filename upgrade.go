@@ -2,19 +2,47 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"crypto/sha1"
+	"crypto/x509"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"net"
-	"strings"
+	"net/http"
 )
 
 const handshakeGuid string = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
 
-func sendHttpResponse(w io.Writer, code int) error {
+type upgradeOptions struct {
+	// authorizeClientCert is called with the verified client certificate and
+	// its chains when the connection uses TLS, returning an error rejects the
+	// upgrade with 403
+	authorizeClientCert func(cert *x509.Certificate, chains [][]*x509.Certificate) error
+	// origin restricts which web pages may connect
+	origin originPolicy
+	// authenticate decides whether the request is allowed to upgrade and who
+	// the peer is, nil accepts everyone
+	authenticate authenticateFunc
+	// router maps the request path to an endpoint, nil serves every path
+	// with the server's handler
+	router *router
+	// subprotocols are offered when there's no router, routed requests use
+	// their endpoint's
+	subprotocols []string
+}
+
+func sendHttpResponse(w io.Writer, code int, header http.Header) error {
 	res := ""
-	res += fmt.Sprintf("HTTP/1.1 %d Bad Request\r\n", code)
+	res += fmt.Sprintf("HTTP/1.1 %d %s\r\n", code, http.StatusText(code))
+	for k, vs := range header {
+		for _, v := range vs {
+			res += fmt.Sprintf("%s: %s\r\n", k, v)
+		}
+	}
+	res += fmt.Sprintf("Content-Length: 0\r\n")
+	res += fmt.Sprintf("Connection: close\r\n")
 	res += fmt.Sprintf("\r\n")
 	if _, err := w.Write([]byte(res)); err != nil {
 		return err
@@ -22,6 +50,25 @@ func sendHttpResponse(w io.Writer, code int) error {
 	return nil
 }
 
+// sendRejection responds to a refused upgrade, errors that aren't a
+// *rejection are sent as 'fallback'
+func sendRejection(w io.Writer, err error, fallback int) error {
+	var rej *rejection
+	if errors.As(err, &rej) {
+		return sendHttpResponse(w, rej.status, rej.header)
+	}
+	return sendHttpResponse(w, fallback, nil)
+}
+
+// rejectionStatus returns the status 'sendRejection' responds to 'err' with
+func rejectionStatus(err error, fallback int) int {
+	var rej *rejection
+	if errors.As(err, &rej) {
+		return rej.status
+	}
+	return fallback
+}
+
 func generateAcceptKey(key string) (string, error) {
 	combinedKey := key + handshakeGuid
 	hasher := sha1.New()
@@ -32,45 +79,123 @@ func generateAcceptKey(key string) (string, error) {
 	return base64.StdEncoding.EncodeToString(hasher.Sum(nil)), nil
 }
 
-func upgrade(c net.Conn) error {
-	reqHeaders := make(map[string]string, 0)
+// upgrade reads the client's handshake from 'r', which reads from 'c', and
+// switches the connection to the WebSocket protocol. Cancelling 'ctx' fails
+// the upgrade.
+func upgrade(ctx context.Context, c net.Conn, r *bufio.Reader, opts *upgradeOptions) (*request, error) {
+	stop := context.AfterFunc(ctx, func() {
+		c.SetDeadline(aLongTimeAgo)
+	})
+	defer stop()
 
-	scanner := bufio.NewScanner(c)
-	for scanner.Scan() {
-		entry := scanner.Text()
-		if entry == "" { // We're at the end of the request
-			break
+	req, err := readRequest(r, c)
+	if err != nil {
+		if err == io.EOF {
+			return nil, fmt.Errorf("client %s disconnected", c.RemoteAddr())
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
 		}
-		splits := strings.Split(entry, ":")
-		if len(splits) < 2 { // We need at least 2 parts to form the key/val pair
-			continue
+		metrics.handshakeRejected("bad_request")
+		if err := sendHttpResponse(c, 400, nil); err != nil {
+			return nil, err
 		}
-		reqHeaders[strings.TrimSpace(splits[0])] = strings.TrimSpace(splits[1])
+		return nil, handshakeError(400, "failed to read request: %w", err)
 	}
 
-	if err := scanner.Err(); err != nil {
-		if err == io.EOF {
-			return fmt.Errorf("client %s disconnected\n", c.RemoteAddr())
+	return upgradeRequest(ctx, c, req, opts)
+}
+
+// upgradeRequest switches the connection to the WebSocket protocol for an
+// already read request
+func upgradeRequest(ctx context.Context, c net.Conn, req *request, opts *upgradeOptions) (*request, error) {
+	if opts == nil {
+		opts = &upgradeOptions{}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	stop := context.AfterFunc(ctx, func() {
+		c.SetDeadline(aLongTimeAgo)
+	})
+	defer stop()
+
+	secWebSocketKey := req.header.Get("Sec-WebSocket-Key")
+	if secWebSocketKey == "" {
+		metrics.handshakeRejected("missing_key")
+		if err := sendHttpResponse(c, 400, nil); err != nil {
+			return nil, err
+		}
+		return nil, handshakeError(400, "handshake invalid, could not find 'Sec-WebSocket-Key' in client request")
+	}
+
+	authenticate := opts.authenticate
+
+	if opts.router != nil {
+		e, params, ok := opts.router.match(req.path)
+		if !ok {
+			metrics.handshakeRejected("not_found")
+			if err := sendHttpResponse(c, 404, nil); err != nil {
+				return nil, err
+			}
+			return nil, handshakeError(404, "no route for path %q", req.path)
+		}
+		req.endpoint, req.params = e, params
+
+		if e.authenticate != nil {
+			authenticate = e.authenticate
+		}
+		req.subprotocol = selectSubprotocol(req, e.subprotocols)
+	} else {
+		req.subprotocol = selectSubprotocol(req, opts.subprotocols)
+	}
+
+	if !opts.origin.allow(req) {
+		metrics.handshakeRejected("origin")
+		if err := sendHttpResponse(c, 403, nil); err != nil {
+			return nil, err
 		}
-		if err := sendHttpResponse(c, 500); err != nil {
-			return err
+		return nil, handshakeError(403, "origin %q is not allowed", req.header.Get("Origin"))
+	}
+
+	if opts.authorizeClientCert != nil {
+		var cert *x509.Certificate
+		var chains [][]*x509.Certificate
+		if req.tls != nil {
+			chains = req.tls.VerifiedChains
+			if len(chains) > 0 {
+				cert = chains[0][0]
+			}
+		}
+
+		if err := opts.authorizeClientCert(cert, chains); err != nil {
+			metrics.handshakeRejected("client_cert")
+			if err := sendHttpResponse(c, 403, nil); err != nil {
+				return nil, err
+			}
+			return nil, handshakeError(403, "client certificate rejected: %w", err)
 		}
 	}
 
-	secWebSocketKey, ok := reqHeaders["Sec-WebSocket-Key"]
-	if !ok {
-		if err := sendHttpResponse(c, 400); err != nil {
-			return err
+	if authenticate != nil {
+		id, err := authenticate(req)
+		if err != nil {
+			metrics.handshakeRejected("auth")
+			if err := sendRejection(c, err, 401); err != nil {
+				return nil, err
+			}
+			return nil, handshakeError(rejectionStatus(err, 401), "authentication failed: %w", err)
 		}
-		return fmt.Errorf("handshake invalid, could not find 'Sec-WebSocket-Key' in client request")
+		req.identity = id
 	}
 
 	acceptKey, err := generateAcceptKey(secWebSocketKey)
 	if err != nil {
-		if err := sendHttpResponse(c, 500); err != nil {
-			return err
+		if err := sendHttpResponse(c, 500, nil); err != nil {
+			return nil, err
 		}
-		return err
+		return nil, &ErrHandshake{Status: 500, Err: err}
 	}
 
 	handshakeRes := ""
@@ -79,11 +204,15 @@ func upgrade(c net.Conn) error {
 	handshakeRes += fmt.Sprintf("Connection: Upgrade\r\n")
 	handshakeRes += fmt.Sprintf("Sec-WebSocket-Accept: %s\r\n", acceptKey)
 	handshakeRes += fmt.Sprintf("Sec-WebSocket-Version: %d\r\n", 13)
+	if req.subprotocol != "" {
+		handshakeRes += fmt.Sprintf("Sec-WebSocket-Protocol: %s\r\n", req.subprotocol)
+	}
 	handshakeRes += fmt.Sprintf("\r\n")
 
 	if _, err := c.Write([]byte(handshakeRes)); err != nil {
-		return err
+		return nil, contextErr(ctx, err)
 	}
 
-	return nil
+	metrics.handshakeAccepted()
+	return req, nil
 }
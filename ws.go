@@ -1,12 +1,25 @@
 package main
 
 import (
-	"log"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
 	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 const sockAddr string = ":3000"
 
+// shutdownTimeout is how long connections have to close after the server is
+// asked to stop
+const shutdownTimeout = 10 * time.Second
+
 type status uint16
 
 const (
@@ -15,8 +28,11 @@ const (
 	statusProtoErr
 	statusUnacceptable
 	_
-	_
-	_
+	// statusNoStatus and statusAbnormal are never sent, they report a close
+	// frame without a status and a connection closed without a close frame
+	statusNoStatus
+	statusAbnormal
+	statusInvalidData
 	statusViolation
 	statusTooBig
 	_
@@ -33,6 +49,12 @@ func (s status) String() string {
 		return "protocol error"
 	case statusUnacceptable:
 		return "unacceptable data"
+	case statusNoStatus:
+		return "no status"
+	case statusAbnormal:
+		return "abnormal closure"
+	case statusInvalidData:
+		return "invalid data"
 	case statusViolation:
 		return "violation"
 	case statusTooBig:
@@ -43,42 +65,138 @@ func (s status) String() string {
 	return "unknown"
 }
 
-func handle(c net.Conn) {
-	defer func(c net.Conn) {
-		log.Printf("Closing connection to %s\n", c.RemoteAddr())
-		c.Close()
-	}(c)
+// commands are run by naming them as the first argument, without one the
+// server is started
+var commands = map[string]func(args []string) int{
+	"bench":       benchCommand,
+	"conformance": conformanceCommand,
+	"connect":     connectCommand,
+	"fuzzclient":  fuzzClientCommand,
+	"fuzzserver":  fuzzServerCommand,
+}
 
-	var conn *conn = newConn(c)
+func main() {
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			os.Exit(cmd(os.Args[2:]))
+		}
+	}
+
+	// SIGHUP would otherwise kill the process if it arrived before the reload
+	// handler is running
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	cfg, printConfig, err := parseFlags(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
 
-	// When 'handle' is done, so is the client so we can close the connection
-	if err := conn.handle(); err != nil {
-		log.Printf("failed to handle connection: %v\n", err)
+	if err := cfg.validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid configuration:\n%v\n", err)
+		os.Exit(2)
+	}
+
+	if printConfig {
+		if err := cfg.print(os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
 		return
 	}
 
-	log.Printf("client %s disconnected\n", c.RemoteAddr())
-}
+	logger, level, err := cfg.newLogger(os.Stderr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	slog.SetDefault(logger)
 
-func main() {
-	log.Printf("starting socket server on %s", sockAddr)
-	l, err := net.Listen("tcp", sockAddr)
+	s, err := cfg.newServer(logger)
 	if err != nil {
-		log.Fatalf("failed to start socket server: %v\n", err)
+		logger.Error("failed to create server", "err", err)
+		os.Exit(1)
 	}
+	s.logLevel = level
+
+	// Stopping closes every connection as going away
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	for {
-		c, err := l.Accept()
+	listeners := make([]net.Listener, 0, len(cfg.Listen))
+	for _, addr := range cfg.Listen {
+		l, err := s.listen(addr)
 		if err != nil {
-			log.Printf("failed to accept incoming connection: %v\n", err)
+			logger.Error("failed to start socket server", "addr", addr, "err", err)
+			os.Exit(1)
+		}
+		listeners = append(listeners, l)
+	}
+
+	errs := make(chan error, len(listeners)+1)
+	for _, l := range listeners {
+		logger.Info("starting socket server", "addr", l.Addr().String(), "tls", s.tls != nil)
+		go func(l net.Listener) {
+			errs <- s.serve(ctx, l)
+		}(l)
+	}
+
+	if cfg.Admin.Listen != "" {
+		l, err := net.Listen("tcp", cfg.Admin.Listen)
+		if err != nil {
+			logger.Error("failed to start admin server", "addr", cfg.Admin.Listen, "err", err)
+			os.Exit(1)
+		}
+		logger.Info("starting admin server", "addr", l.Addr().String())
+		admin := &http.Server{Handler: newAdminHandler(s, cfg.Admin.Token), ReadHeaderTimeout: 10 * time.Second}
+		go func() {
+			errs <- admin.Serve(l)
+		}()
+	}
+
+	go reloadOnSignal(hup, s, cfg, logger)
+
+	err = <-errs
+	if ctx.Err() != nil {
+		logger.Info("shutting down", "open_connections", len(s.openConns()))
+		wait, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := s.waitClosed(wait); err != nil {
+			logger.Warn("connections still open at shutdown", "open_connections", len(s.openConns()))
+		}
+		return
+	}
+	if err != nil {
+		logger.Error("socket server stopped", "err", err)
+		os.Exit(1)
+	}
+}
+
+// reloadOnSignal re-reads the configuration every time a signal is received
+// on 'hup' and applies it to 's'
+func reloadOnSignal(hup <-chan os.Signal, s *server, cfg *config, logger *slog.Logger) {
+	for range hup {
+		logger.Info("reloading configuration")
+
+		fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		next, _, err := parseFlags(fs, os.Args[1:])
+		if err != nil {
+			logger.Error("failed to read configuration, keeping the current one", "err", err)
 			continue
 		}
 
-		if err := upgrade(c); err != nil {
-			log.Printf("failed to upgrade client: %v\n", err)
+		effective, restart, err := s.reloadConfig(cfg, next)
+		if err != nil {
+			logger.Error("rejected new configuration, keeping the current one", "err", err)
+			continue
+		}
+		for _, name := range restart {
+			logger.Warn("setting can only be changed by a restart, keeping the current value", "setting", name)
 		}
 
-		log.Printf("new connection from %s\n", c.RemoteAddr())
-		go handle(c)
+		cfg = effective
+		logger.Info("configuration reloaded")
 	}
 }
@@ -1,6 +1,10 @@
 package main
 
 import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
 	"testing"
 )
 
@@ -16,6 +20,58 @@ func isEqual(a, b []byte) bool {
 	return true
 }
 
+// writeUpgradeRequest writes a client handshake for 'path' with any extra
+// headers, in the form "Key: value"
+func writeUpgradeRequest(w io.Writer, path string, headers ...string) error {
+	req := fmt.Sprintf("GET %s HTTP/1.1\r\n", path)
+	req += "Host: localhost\r\n"
+	req += "Upgrade: websocket\r\n"
+	req += "Connection: Upgrade\r\n"
+	req += "Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n"
+	req += "Sec-WebSocket-Version: 13\r\n"
+	for _, h := range headers {
+		req += h + "\r\n"
+	}
+	req += "\r\n"
+	_, err := w.Write([]byte(req))
+	return err
+}
+
+// readUpgradeResponse reads the server's handshake response
+func readUpgradeResponse(r *bufio.Reader) (*http.Response, error) {
+	return http.ReadResponse(r, nil)
+}
+
+// writeFrame writes a single masked client frame
+func writeFrame(w io.Writer, fin bool, op opCode, data []byte) error {
+	bw := bufio.NewWriter(w)
+	h := header{isFin: fin, op: op, length: uint64(len(data)), isMasked: true, mask: []byte{0x12, 0x34, 0x56, 0x78}}
+	if err := h.write(bw); err != nil {
+		return err
+	}
+	masked := make([]byte, len(data))
+	for i := range data {
+		masked[i] = data[i] ^ h.mask[i%4]
+	}
+	if _, err := bw.Write(masked); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// readFrame reads a single server frame
+func readFrame(r *bufio.Reader) (*header, []byte, error) {
+	h := &header{}
+	if err := h.read(r); err != nil {
+		return nil, nil, err
+	}
+	data := make([]byte, h.length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, nil, err
+	}
+	return h, data, nil
+}
+
 func TestAcceptKeyGeneration(t *testing.T) {
 	var key string = "dGhlIHNhbXBsZSBub25jZQ=="
 	var expected string = "s3pPLMBiTxaQ9kYGzzhZRbK+xOo="